@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/m/authz"
+	"example.com/m/store"
+)
+
+// clients are the registered OAuth clients
+var clients *ClientRegistry
+
+// OAuthClient is an application allowed to log users in through the auth
+// service. Confidential clients authenticate with a secret at the token
+// endpoint, public clients such as single page apps have none and rely on
+// PKCE alone.
+type OAuthClient struct {
+	ID   string `json:"client_id"`
+	Name string `json:"name"`
+	// SecretHash is a bcrypt hash of the client secret, empty for public
+	// clients
+	SecretHash string `json:"secret_hash,omitempty"`
+	// RedirectURIs must match the redirect_uri of a request exactly
+	RedirectURIs []string  `json:"redirect_uris"`
+	CreatedAt    time.Time `json:"created_at"`
+	CreatedBy    string    `json:"created_by"`
+}
+
+// Public reports whether the client has no secret
+func (c OAuthClient) Public() bool {
+	return c.SecretHash == ""
+}
+
+// AllowsRedirect reports whether uri is one of the client's redirect URIs
+func (c OAuthClient) AllowsRedirect(uri string) bool {
+	for _, allowed := range c.RedirectURIs {
+		if uri == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientRegistry holds the registered OAuth clients, persisted in a JSON file
+// next to the signing keys
+type ClientRegistry struct {
+	mu       sync.Mutex
+	filename string
+	clients  map[string]OAuthClient
+}
+
+// LoadClients loads the clients file, a missing file has no clients
+func LoadClients(filename string) (*ClientRegistry, error) {
+	c := &ClientRegistry{filename: filename, clients: make(map[string]OAuthClient)}
+	data, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &c.clients); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Get returns the client with the ID
+func (c *ClientRegistry) Get(id string) (OAuthClient, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	client, ok := c.clients[id]
+	return client, ok
+}
+
+// List returns all clients, oldest first
+func (c *ClientRegistry) List() []OAuthClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	list := make([]OAuthClient, 0, len(c.clients))
+	for _, client := range c.clients {
+		list = append(list, client)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+// Add registers a client and saves the file
+func (c *ClientRegistry) Add(client OAuthClient) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.clients[client.ID] = client
+	if err := c.saveLocked(); err != nil {
+		delete(c.clients, client.ID)
+		return err
+	}
+	return nil
+}
+
+// Delete removes a client and saves the file. It returns ErrNotFound for
+// unknown clients.
+func (c *ClientRegistry) Delete(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	client, ok := c.clients[id]
+	if !ok {
+		return store.ErrNotFound
+	}
+	delete(c.clients, id)
+	if err := c.saveLocked(); err != nil {
+		c.clients[id] = client
+		return err
+	}
+	return nil
+}
+
+func (c *ClientRegistry) saveLocked() error {
+	data, err := json.MarshalIndent(c.clients, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.WriteFileAtomic(c.filename, data, 0600)
+}
+
+// ClientRegistration is the body of a client registration
+type ClientRegistration struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	// Public clients get no secret
+	Public bool `json:"public"`
+}
+
+// RegisteredClient is returned once on registration, the secret is not shown
+// again
+type RegisteredClient struct {
+	ID           string   `json:"client_id"`
+	Secret       string   `json:"client_secret,omitempty"`
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+}
+
+// checkRedirectURI makes sure a redirect URI is absolute and has no
+// fragment. Plain http is only allowed for local development.
+func checkRedirectURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" || u.Fragment != "" {
+		return errors.New("redirect URIs must be absolute URLs without a fragment")
+	}
+	host := u.Hostname()
+	if u.Scheme != "https" && !(u.Scheme == "http" && (host == "localhost" || host == "127.0.0.1")) {
+		return errors.New("redirect URIs must use https, or http on localhost")
+	}
+	return nil
+}
+
+// requireAdmin authenticates the request and makes sure its token carries
+// the admin role. Otherwise it writes the error response and returns "".
+func requireAdmin(w http.ResponseWriter, r *http.Request) string {
+	claims := authenticateRequest(w, r)
+	if claims == nil {
+		return ""
+	}
+	if !authz.HasRole(claims.Roles, authz.RoleAdmin) {
+		http.Error(w, "Admin access required", http.StatusForbidden)
+		logger.Printf("User %s is not an admin\n", claims.Subject)
+		return ""
+	}
+	return claims.Subject
+}
+
+// ClientsHandler lists the OAuth clients (GET) or registers a new one (POST),
+// admins only
+func ClientsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+	admin := requireAdmin(w, r)
+	if admin == "" {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(clients.List())
+		return
+	}
+
+	var req ClientRegistration
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" || len(req.RedirectURIs) == 0 {
+		http.Error(w, "Missing name or redirect_uris", http.StatusBadRequest)
+		logger.Println("Invalid client registration:", err)
+		return
+	}
+	for _, uri := range req.RedirectURIs {
+		if err := checkRedirectURI(uri); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Printf("Invalid redirect URI %q: %v\n", uri, err)
+			return
+		}
+	}
+
+	client := OAuthClient{
+		ID:           generateAuthToken(),
+		Name:         strings.TrimSpace(req.Name),
+		RedirectURIs: req.RedirectURIs,
+		CreatedAt:    time.Now().UTC(),
+		CreatedBy:    admin,
+	}
+	registered := RegisteredClient{ID: client.ID, Name: client.Name, RedirectURIs: client.RedirectURIs}
+	if !req.Public {
+		registered.Secret = generateAuthToken() + generateAuthToken()
+		hash, err := hashPassword(registered.Secret)
+		if err != nil {
+			http.Error(w, "Error hashing client secret", http.StatusInternalServerError)
+			logger.Println("Error hashing client secret:", err)
+			return
+		}
+		client.SecretHash = hash
+	}
+	if err := clients.Add(client); err != nil {
+		http.Error(w, "Error saving clients", http.StatusInternalServerError)
+		logger.Println("Error saving clients:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(registered)
+	logger.Printf("Admin %s registered OAuth client %s (%s)\n", admin, client.ID, client.Name)
+}
+
+// ClientHandler removes an OAuth client and revokes its tokens, DELETE
+// /oauth/clients/{id}, admins only
+func ClientHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Only DELETE method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+	admin := requireAdmin(w, r)
+	if admin == "" {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/oauth/clients/")
+	if err := clients.Delete(id); err == store.ErrNotFound {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		logger.Println("Delete requested for unknown client:", id)
+		return
+	} else if err != nil {
+		http.Error(w, "Error saving clients", http.StatusInternalServerError)
+		logger.Println("Error saving clients:", err)
+		return
+	}
+
+	err := tokens.UpdateTokens(func(authTokens map[string]store.Token) error {
+		for tokenID, record := range authTokens {
+			if record.ClientID == id {
+				store.RevokeToken(authTokens, tokenID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "Error updating auth tokens", http.StatusInternalServerError)
+		logger.Println("Error updating auth tokens:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Client deleted"})
+	logger.Printf("Admin %s deleted OAuth client %s\n", admin, id)
+}
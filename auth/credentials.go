@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"example.com/m/store"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// hashPassword returns a bcrypt hash of the password. bcrypt generates and
+// embeds a random per-user salt, so no separate salt field is stored.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// checkPassword reports whether the password matches the stored credential
+func checkPassword(credential store.Credential, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(credential.PasswordHash), []byte(password)) == nil
+}
+
+// dummyHash is a hash of the same cost as hashPassword's that no password is
+// checked against for real, see checkNoPassword
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("no such user"), bcrypt.DefaultCost)
+
+// checkNoPassword spends as long as checkPassword for a user without a
+// credential, so the response time does not tell which usernames exist. It
+// always reports false.
+func checkNoPassword(password string) bool {
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+	return false
+}
+
+// MigrateLegacyCredentials creates a credential for every user that had
+// none when passwords started to be stored. Before that, a login succeeded
+// when the password equalled the username, so that is the password those
+// users keep until they set a new one.
+//
+// The migration runs once and then writes the marker file, so users added
+// later without a credential, like pending users added by an admin or
+// signups whose password could not be stored, never get their username as
+// password. Pending users are skipped for the same reason, accounts from
+// before passwords were stored are all active.
+func MigrateLegacyCredentials(users store.UserStore, marker string) (int, error) {
+	if _, err := os.Stat(marker); err == nil {
+		return 0, nil
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	list, err := users.ListUsers()
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, user := range list {
+		if user.Status == store.StatusPending {
+			continue
+		}
+		if _, err := users.GetCredential(user.Name); err != store.ErrNotFound {
+			if err != nil {
+				return migrated, err
+			}
+			continue
+		}
+		hash, err := hashPassword(user.Name)
+		if err != nil {
+			return migrated, err
+		}
+		err = users.CreateCredential(user.Name, store.Credential{PasswordHash: hash, Legacy: true})
+		if err != nil && err != store.ErrExists {
+			return migrated, err
+		}
+		migrated++
+	}
+	note := fmt.Sprintf("Legacy credentials migrated at %s for %d users\n", time.Now().UTC().Format(time.RFC3339), migrated)
+	return migrated, os.WriteFile(marker, []byte(note), 0600)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"example.com/m/store"
+	"example.com/m/token"
+)
+
+// storedKey is a signing key as persisted in the keys file. HMAC keys are
+// derived from the shared secret, so only Ed25519 keys store key material.
+type storedKey struct {
+	ID        string    `json:"kid"`
+	Alg       string    `json:"alg"`
+	Use       string    `json:"use,omitempty"`
+	Seed      []byte    `json:"seed,omitempty"`
+	NotBefore time.Time `json:"not_before"`
+	// SignUntil ends the period in which new tokens are signed with the key.
+	// NotAfter is later by the token lifetime, so tokens signed just before
+	// a rotation stay verifiable until they expire.
+	SignUntil time.Time `json:"sign_until"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// Keyring holds the auth service's signing keys and rotates them. A new key
+// is published a while before it starts signing so verifiers that cache the
+// key set already know it, and old keys are kept until their tokens expire.
+//
+// Besides the keys of auth tokens, of the configured algorithm, it keeps
+// Ed25519 keys for the id tokens of OAuth clients. Clients check those
+// against the published keys, which does not work for HS256 keys, and id
+// tokens cannot be used in place of auth tokens.
+type Keyring struct {
+	mu         sync.Mutex
+	filename   string
+	alg        string
+	hmacSecret []byte
+	rotation   time.Duration
+	keys       []storedKey
+}
+
+// LoadKeyring loads the keys file, creating keys if there are none
+func LoadKeyring(filename, alg string, hmacSecret []byte, rotation time.Duration) (*Keyring, error) {
+	if alg != token.AlgHS256 && alg != token.AlgEdDSA {
+		return nil, token.ErrUnsupported
+	}
+	if alg == token.AlgHS256 && len(hmacSecret) == 0 {
+		return nil, errors.New("HS256 signing requires TOKEN_HMAC_SECRET")
+	}
+
+	k := &Keyring{filename: filename, alg: alg, hmacSecret: hmacSecret, rotation: rotation}
+	data, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &k.keys); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := k.Rotate(time.Now()); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Rotate drops keys past their validity and creates the current and next
+// signing keys of auth and id tokens when they are missing
+func (k *Keyring) Rotate(now time.Time) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	changed := false
+	keys := k.keys[:0]
+	for _, key := range k.keys {
+		if now.Before(key.NotAfter) {
+			keys = append(keys, key)
+		} else {
+			changed = true
+		}
+	}
+	k.keys = keys
+
+	for _, line := range []struct{ alg, use string }{{k.alg, ""}, {token.AlgEdDSA, token.UseIDToken}} {
+		// Start signing with a new key right away if there is no current
+		// key, e.g. on first start or after the signing algorithm was changed
+		current := k.signingKeyLocked(line.alg, line.use, now)
+		if current == nil {
+			key, err := k.newKey(line.alg, line.use, now)
+			if err != nil {
+				return err
+			}
+			k.keys = append(k.keys, key)
+			current = &k.keys[len(k.keys)-1]
+			changed = true
+		}
+
+		// Publish the next key during the last quarter of the current one
+		if !now.Before(current.SignUntil.Add(-k.rotation/4)) && !k.hasKeyAfter(line.alg, line.use, current.SignUntil) {
+			key, err := k.newKey(line.alg, line.use, current.SignUntil)
+			if err != nil {
+				return err
+			}
+			k.keys = append(k.keys, key)
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	return k.saveLocked()
+}
+
+// RunRotation rotates the keys periodically until the process exits
+func (k *Keyring) RunRotation(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := k.Rotate(time.Now()); err != nil {
+			logger.Println("Error rotating signing keys:", err)
+		}
+	}
+}
+
+// SigningKey returns the key new auth tokens are signed with
+func (k *Keyring) SigningKey() (*token.Key, error) {
+	return k.currentKey(k.alg, "")
+}
+
+// IDTokenKey returns the key new id tokens are signed with
+func (k *Keyring) IDTokenKey() (*token.Key, error) {
+	return k.currentKey(token.AlgEdDSA, token.UseIDToken)
+}
+
+func (k *Keyring) currentKey(alg, use string) (*token.Key, error) {
+	now := time.Now()
+	k.mu.Lock()
+	current := k.signingKeyLocked(alg, use, now)
+	k.mu.Unlock()
+
+	if current == nil {
+		// The rotation loop has not caught up yet
+		if err := k.Rotate(now); err != nil {
+			return nil, err
+		}
+		return k.currentKey(alg, use)
+	}
+	return k.tokenKey(*current), nil
+}
+
+// Key returns the verification key of auth tokens with the given ID. Id token
+// keys are not returned, so id tokens are never accepted as auth tokens.
+func (k *Keyring) Key(kid string) (*token.Key, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, key := range k.keys {
+		if key.ID == kid && key.Use == "" {
+			return k.tokenKey(key), nil
+		}
+	}
+	return nil, token.ErrUnknownKey
+}
+
+// JWKSet returns the public form of all keys that are still valid
+func (k *Keyring) JWKSet() token.JWKSet {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	set := token.JWKSet{Keys: []token.JWK{}}
+	for _, key := range k.keys {
+		set.Keys = append(set.Keys, k.tokenKey(key).JWK())
+	}
+	return set
+}
+
+func (k *Keyring) signingKeyLocked(alg, use string, now time.Time) *storedKey {
+	for i := len(k.keys) - 1; i >= 0; i-- {
+		key := &k.keys[i]
+		if key.Alg == alg && key.Use == use && !now.Before(key.NotBefore) && now.Before(key.SignUntil) {
+			return key
+		}
+	}
+	return nil
+}
+
+func (k *Keyring) hasKeyAfter(alg, use string, t time.Time) bool {
+	for _, key := range k.keys {
+		if key.Alg == alg && key.Use == use && !key.NotBefore.Before(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *Keyring) newKey(alg, use string, notBefore time.Time) (storedKey, error) {
+	key := storedKey{
+		ID:        generateAuthToken()[:16],
+		Alg:       alg,
+		Use:       use,
+		NotBefore: notBefore.UTC(),
+		SignUntil: notBefore.Add(k.rotation).UTC(),
+		NotAfter:  notBefore.Add(k.rotation + tokenTTL).UTC(),
+	}
+	if alg == token.AlgEdDSA {
+		key.Seed = make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(key.Seed); err != nil {
+			return storedKey{}, err
+		}
+	}
+	return key, nil
+}
+
+func (k *Keyring) tokenKey(key storedKey) *token.Key {
+	tk := &token.Key{
+		ID:        key.ID,
+		Alg:       key.Alg,
+		NotBefore: key.NotBefore,
+		NotAfter:  key.NotAfter,
+		Use:       key.Use,
+	}
+	switch key.Alg {
+	case token.AlgHS256:
+		tk.Secret = token.DeriveHMACKey(k.hmacSecret, key.ID)
+	case token.AlgEdDSA:
+		tk.PrivateKey = ed25519.NewKeyFromSeed(key.Seed)
+		tk.PublicKey = tk.PrivateKey.Public().(ed25519.PublicKey)
+	}
+	return tk
+}
+
+func (k *Keyring) saveLocked() error {
+	data, err := json.MarshalIndent(k.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.WriteFileAtomic(k.filename, data, 0600)
+}
+
+// KeysHandler publishes the verification keys so other services can check
+// tokens without calling the auth service for every request
+func KeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keyring.JWKSet())
+}
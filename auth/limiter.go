@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// limiter slows down repeated failed logins
+var limiter *loginLimiter
+
+// limitPolicy sets how failed logins for one key, a username or a client
+// address, are slowed down
+type limitPolicy struct {
+	// FreeAttempts failures are allowed without delay, each further failure
+	// doubles the wait starting at BaseDelay, up to MaxDelay
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	// LockoutAfter failures lock the key for LockoutDuration, or until an
+	// admin unlocks it
+	LockoutAfter    int
+	LockoutDuration time.Duration
+	// Forget is how long after the last failure the count starts over
+	Forget time.Duration
+}
+
+// failures is the failed login count of one key
+type failures struct {
+	count        int
+	last         time.Time
+	blockedUntil time.Time
+}
+
+// loginLimiter counts failed logins per username and per client address and
+// tells how long the next attempt has to wait. Addresses get a more lenient
+// policy since several users can share one. The counts are kept in memory,
+// a restart of the auth service clears them.
+type loginLimiter struct {
+	mu    sync.Mutex
+	users map[string]*failures
+	ips   map[string]*failures
+	user  limitPolicy
+	ip    limitPolicy
+}
+
+func newLoginLimiter(user, ip limitPolicy) *loginLimiter {
+	return &loginLimiter{
+		users: make(map[string]*failures),
+		ips:   make(map[string]*failures),
+		user:  user,
+		ip:    ip,
+	}
+}
+
+// Wait returns how long a login for the username from the address has to
+// wait, zero if it may go ahead
+func (l *loginLimiter) Wait(username, ip string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	wait := time.Duration(0)
+	for _, f := range []*failures{l.users[username], l.ips[ip]} {
+		if f != nil && f.blockedUntil.After(now) && f.blockedUntil.Sub(now) > wait {
+			wait = f.blockedUntil.Sub(now)
+		}
+	}
+	return wait
+}
+
+// Fail records a failed login. It returns true if this failure locked the
+// username.
+func (l *loginLimiter) Fail(username, ip string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	locked := record(l.users, username, l.user, now)
+	record(l.ips, ip, l.ip, now)
+	return locked
+}
+
+// Succeed clears the failures of the username. The address keeps its count,
+// otherwise one valid account would let an address guess others.
+func (l *loginLimiter) Succeed(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.users, username)
+}
+
+// Unlock clears the failures of a username or an address and reports
+// whether there were any
+func (l *loginLimiter) Unlock(username, ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	found := false
+	if _, ok := l.users[username]; ok && username != "" {
+		delete(l.users, username)
+		found = true
+	}
+	if _, ok := l.ips[ip]; ok && ip != "" {
+		delete(l.ips, ip)
+		found = true
+	}
+	return found
+}
+
+// RunCleanup forgets old failures periodically until the process exits, so
+// guessed usernames do not pile up
+func (l *loginLimiter) RunCleanup(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		l.mu.Lock()
+		forget(l.users, l.user, now)
+		forget(l.ips, l.ip, now)
+		l.mu.Unlock()
+	}
+}
+
+// record adds a failure for key and blocks it according to policy. It
+// returns true if the failure started a lockout.
+func record(counts map[string]*failures, key string, policy limitPolicy, now time.Time) bool {
+	f := counts[key]
+	if f == nil || now.Sub(f.last) > policy.Forget {
+		f = &failures{}
+		counts[key] = f
+	}
+	f.count++
+	f.last = now
+
+	if f.count >= policy.LockoutAfter {
+		f.blockedUntil = now.Add(policy.LockoutDuration)
+		return f.count == policy.LockoutAfter
+	}
+	if f.count > policy.FreeAttempts {
+		delay := policy.BaseDelay << (f.count - policy.FreeAttempts - 1)
+		if delay > policy.MaxDelay || delay <= 0 {
+			delay = policy.MaxDelay
+		}
+		f.blockedUntil = now.Add(delay)
+	}
+	return false
+}
+
+func forget(counts map[string]*failures, policy limitPolicy, now time.Time) {
+	for key, f := range counts {
+		if now.Sub(f.last) > policy.Forget && !f.blockedUntil.After(now) {
+			delete(counts, key)
+		}
+	}
+}
+
+// UnlockRequest names the username or client address to unlock
+type UnlockRequest struct {
+	Username string `json:"username"`
+	IP       string `json:"ip"`
+}
+
+// UnlockHandler lets an admin clear the failed logins of a username or a
+// client address, POST /unlock
+func UnlockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	admin := requireAdmin(w, r)
+	if admin == "" {
+		return
+	}
+
+	var req UnlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Username == "" && req.IP == "") {
+		http.Error(w, "Missing username or ip", http.StatusBadRequest)
+		logger.Println("Missing username or ip in unlock request:", err)
+		return
+	}
+
+	unlocked := limiter.Unlock(req.Username, req.IP)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"unlocked": unlocked})
+	logger.Printf("Admin %s unlocked logins of user %q ip %q (had failures: %v)\n", admin, req.Username, req.IP, unlocked)
+}
+
+// writeTooManyAttempts rejects a login that came too soon after failed ones
+func writeTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("Too many failed login attempts, try again in %d seconds", seconds), http.StatusTooManyRequests)
+}
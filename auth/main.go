@@ -8,6 +8,18 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/m/authz"
+	"example.com/m/mailer"
+	"example.com/m/store"
+	"example.com/m/svcauth"
+	"example.com/m/tlsutil"
+	"example.com/m/token"
+	"example.com/m/validate"
 )
 
 // User represents a simple user structure
@@ -18,14 +30,28 @@ type User struct {
 
 // TokenResponse represents the response with the auth token
 type TokenResponse struct {
-	AuthToken string `json:"auth_token"`
-	Message   string `json:"message"`
+	AuthToken string    `json:"auth_token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	ExpiresIn int64     `json:"expires_in"`
+	Message   string    `json:"message"`
+	// Username is the user the token was issued to
+	Username string `json:"username"`
 }
 
 var (
 	// Logger for writing to the console and log file
 	logger *log.Logger
 	logFile *os.File
+
+	// users and tokens hold the shared user and token data
+	users  store.UserStore
+	tokens store.TokenStore
+
+	// tokenTTL is how long an issued auth token stays valid
+	tokenTTL = 24 * time.Hour
+
+	// services authenticates the calls of the other services
+	services *svcauth.Service
 )
 func HealthHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -49,47 +75,151 @@ func AuthHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Load userStore from file for each request
-	userStore, err := LoadUserStore("/app/shared_data/users.json")
-	if err != nil {
-		http.Error(w, "Error loading user store", http.StatusInternalServerError)
-		logger.Println("Error loading user store:", err)
-		return
-	}
-
 	var user User
-	err = json.NewDecoder(r.Body).Decode(&user)
+	err := json.NewDecoder(r.Body).Decode(&user)
 	if err != nil {
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		logger.Println("Error decoding request body:", err)
 		return
 	}
 
-	// Check if the username exists and the password matches the username
-	if _, exists := userStore[user.Username]; exists && user.Password == user.Username {
-		authToken := generateAuthToken()
-		response := TokenResponse{
-			AuthToken: authToken,
-			Message:   "Authentication successful",
-		}
+	// Refuse attempts that come too soon after failed ones, before spending
+	// time on the password hash
+	ip := clientIP(r)
+	if wait := limiter.Wait(user.Username, ip, time.Now()); wait > 0 {
+		writeTooManyAttempts(w, wait)
+		logger.Printf("Login for user %s from %s blocked for %s after failed attempts\n", user.Username, ip, wait.Round(time.Second))
+		return
+	}
 
-		// Update auth tokens file
-		if err := UpdateAuthTokens(user.Username, authToken); err != nil {
+	// Check if the username exists and the password matches the stored hash
+	account, userErr := users.GetUser(user.Username)
+	credential, credErr := users.GetCredential(user.Username)
+	for _, err := range []error{userErr, credErr} {
+		if err != nil && err != store.ErrNotFound {
+			http.Error(w, "Error loading user store", http.StatusInternalServerError)
+			logger.Println("Error loading user store:", err)
+			return
+		}
+	}
+	var valid bool
+	if userErr == nil && credErr == nil {
+		valid = checkPassword(credential, user.Password)
+	} else {
+		valid = checkNoPassword(user.Password)
+	}
+	if valid {
+		limiter.Succeed(user.Username)
+		if account.Status == store.StatusDisabled {
+			http.Error(w, "Account disabled", http.StatusForbidden)
+			logger.Println("Login attempt for disabled user:", user.Username)
+			return
+		}
+		if account.Status == store.StatusPending {
+			http.Error(w, "Email address not verified, please use the link in the verification email", http.StatusForbidden)
+			logger.Println("Login attempt for unverified user:", user.Username)
+			return
+		}
+		if credential.Legacy {
+			logger.Println("User is still using the migrated legacy password:", user.Username)
+		}
+		// With a second factor the token is only issued by /mfa/verify
+		if credential.TOTP != nil && credential.TOTP.Enabled {
+			writeMFAChallenge(w, user.Username)
+			return
+		}
+		// Issue a token in a new session, other sessions stay logged in
+		session := store.Token{
+			Username:  user.Username,
+			UserAgent: r.UserAgent(),
+			ClientIP:  clientIP(r),
+		}
+		var authToken string
+		var record store.Token
+		err := tokens.UpdateTokens(func(authTokens map[string]store.Token) error {
+			var err error
+			authToken, record, err = issueAuthToken(authTokens, session, authz.Effective(account.Roles))
+			return err
+		})
+		if err != nil {
 			http.Error(w, "Error updating auth tokens", http.StatusInternalServerError)
 			logger.Println("Error updating auth tokens:", err)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+		json.NewEncoder(w).Encode(newTokenResponse(authToken, record, "Authentication successful"))
 		logger.Println("Authentication successful for user:", user.Username)
 	} else {
+		// Unknown usernames count too, so they are answered the same way
+		if limiter.Fail(user.Username, ip, time.Now()) {
+			logger.Println("Logins locked after repeated failures for user:", user.Username)
+		}
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		logger.Println("Invalid credentials for user:", user.Username)
 	}
 }
 
-// generateAuthToken generates a simple UUID-based token
+// CredentialsHandler sets the password for a newly added user
+func CredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	var user User
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		logger.Println("Error decoding request body:", err)
+		return
+	}
+	if user.Username == "" {
+		http.Error(w, "Missing username or password", http.StatusBadRequest)
+		logger.Println("Missing username or password in credentials request")
+		return
+	}
+	if msg := validate.Password(user.Password); msg != "" {
+		validate.WriteErrors(w, validate.Errors{{Field: "password", Message: msg}})
+		logger.Printf("Invalid password for user %s: %s\n", user.Username, msg)
+		return
+	}
+
+	if _, err := users.GetUser(user.Username); err == store.ErrNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		logger.Println("Credentials requested for unknown user:", user.Username)
+		return
+	} else if err != nil {
+		http.Error(w, "Error loading user store", http.StatusInternalServerError)
+		logger.Println("Error loading user store:", err)
+		return
+	}
+
+	hash, err := hashPassword(user.Password)
+	if err != nil {
+		http.Error(w, "Error hashing password", http.StatusInternalServerError)
+		logger.Println("Error hashing password:", err)
+		return
+	}
+
+	// Only the first password can be set here; existing users keep theirs
+	err = users.CreateCredential(user.Username, store.Credential{PasswordHash: hash})
+	if err == store.ErrExists {
+		http.Error(w, "Password already set", http.StatusConflict)
+		logger.Println("Attempted to overwrite credentials for user:", user.Username)
+		return
+	} else if err != nil {
+		http.Error(w, "Error saving credentials", http.StatusInternalServerError)
+		logger.Println("Error saving credentials:", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Password set successfully"))
+	logger.Println("Password set for user:", user.Username)
+}
+
+// generateAuthToken generates a random hex ID, used as the token ID
 func generateAuthToken() string {
 	b := make([]byte, 16)
 	_, err := rand.Read(b)
@@ -100,101 +230,163 @@ func generateAuthToken() string {
 	return hex.EncodeToString(b)
 }
 
-// LoadUserStore loads user details from a JSON file
-func LoadUserStore(filename string) (map[string]string, error) {
-	file, err := os.Open(filename)
+// getenv returns the environment variable or def when it is not set
+func getenv(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+func main() {
+	// Open log file
+	var err error
+	logFile, err = os.OpenFile("/logs/auth.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
 	if err != nil {
-		return nil, err
+		fmt.Println("Error opening log file:", err)
+		os.Exit(1)
 	}
-	defer file.Close()
+	defer logFile.Close()
+
+	// Set up logger
+	logger = log.New(logFile, "", log.Ldate|log.Ltime|log.Lshortfile)
 
-	var userStore map[string]map[string]string
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&userStore); err != nil {
-		return nil, err
+	users, tokens, err = store.Open(store.ConfigFromEnv())
+	if err != nil {
+		logger.Fatalln("Error opening store:", err)
 	}
 
-	// Flatten the nested map
-	flatUserStore := make(map[string]string)
-	for username, details := range userStore {
-		if password, exists := details["name"]; exists {
-			flatUserStore[username] = password
+	if ttl := os.Getenv("AUTH_TOKEN_TTL"); ttl != "" {
+		tokenTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			logger.Fatalln("Invalid AUTH_TOKEN_TTL:", err)
 		}
 	}
 
-	return flatUserStore, nil
-}
-
-// UpdateAuthTokens updates the auth tokens file with a new token for the user
-func UpdateAuthTokens(username, authToken string) error {
-	// Load existing auth tokens
-	file, err := os.OpenFile("/app/shared_data/authtokens.json", os.O_RDWR|os.O_CREATE, 0666)
+	if ttl := os.Getenv("AUTH_RESET_TTL"); ttl != "" {
+		resetTokenTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			logger.Fatalln("Invalid AUTH_RESET_TTL:", err)
+		}
+	}
+	if ttl := os.Getenv("AUTH_MFA_TTL"); ttl != "" {
+		mfaTokenTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			logger.Fatalln("Invalid AUTH_MFA_TTL:", err)
+		}
+	}
+	mfaIssuer = getenv("MFA_ISSUER", mfaIssuer)
+	mail, err = mailer.FromEnv()
 	if err != nil {
-		return err
+		logger.Fatalln("Error setting up mailer:", err)
 	}
-	defer file.Close()
+	publicURL = strings.TrimSuffix(getenv("PUBLIC_URL", "http://localhost:8080"), "/")
 
-	var authTokens map[string]string
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&authTokens); err != nil && err.Error() != "EOF" {
-		return err
+	// Slow down password guessing, per username and per client address
+	lockoutAfter, err := strconv.Atoi(getenv("AUTH_LOCKOUT_AFTER", "10"))
+	if err != nil || lockoutAfter < 1 {
+		logger.Fatalln("Invalid AUTH_LOCKOUT_AFTER:", err)
 	}
-
-	// Update or add the new token
-	if authTokens == nil {
-		authTokens = make(map[string]string)
+	lockoutDuration, err := time.ParseDuration(getenv("AUTH_LOCKOUT_DURATION", "15m"))
+	if err != nil {
+		logger.Fatalln("Invalid AUTH_LOCKOUT_DURATION:", err)
 	}
-	authTokens[username] = authToken
-
-	// Rewind file and write updated tokens
-	file.Seek(0, 0) // Move to the beginning of the file
-	file.Truncate(0) // Clear the file
-	encoder := json.NewEncoder(file)
-	if err := encoder.Encode(authTokens); err != nil {
-		return err
+	forget := time.Hour
+	if lockoutDuration > forget {
+		forget = lockoutDuration
 	}
+	limiter = newLoginLimiter(
+		limitPolicy{FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: 5 * time.Minute,
+			LockoutAfter: lockoutAfter, LockoutDuration: lockoutDuration, Forget: forget},
+		limitPolicy{FreeAttempts: 20, BaseDelay: time.Second, MaxDelay: 5 * time.Minute,
+			LockoutAfter: 10 * lockoutAfter, LockoutDuration: lockoutDuration, Forget: forget},
+	)
+	go limiter.RunCleanup(time.Minute)
 
-	return nil
-}
-func CheckAndCreateFile(filename string) error {
-	// Check if the file exists
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		// File does not exist, create it
-		file, err := os.Create(filename)
-		if err != nil {
-			return fmt.Errorf("error creating file: %w", err)
-		}
-		defer file.Close()
+	// Load the signing keys and keep rotating them
+	keysFile := getenv("AUTH_KEYS_FILE", "/app/keys/signing_keys.json")
+	rotation, err := time.ParseDuration(getenv("AUTH_KEY_ROTATION", "24h"))
+	if err != nil {
+		logger.Fatalln("Invalid AUTH_KEY_ROTATION:", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(keysFile), 0700); err != nil {
+		logger.Fatalln("Error creating keys directory:", err)
+	}
+	keyring, err = LoadKeyring(keysFile, getenv("AUTH_SIGNING_ALG", token.AlgHS256), []byte(os.Getenv("TOKEN_HMAC_SECRET")), rotation)
+	if err != nil {
+		logger.Fatalln("Error loading signing keys:", err)
+	}
+	go keyring.RunRotation(time.Minute)
 
-		// Write '{}' to the file
-		_, err = file.Write([]byte("{}"))
+	// OAuth clients are kept next to the signing keys
+	clients, err = LoadClients(getenv("AUTH_CLIENTS_FILE", filepath.Join(filepath.Dir(keysFile), "oauth_clients.json")))
+	if err != nil {
+		logger.Fatalln("Error loading OAuth clients:", err)
+	}
+	oauthIssuer = strings.TrimSuffix(getenv("OIDC_ISSUER", oauthIssuer), "/")
+	if ttl := os.Getenv("OAUTH_TOKEN_TTL"); ttl != "" {
+		oauthTokenTTL, err = time.ParseDuration(ttl)
 		if err != nil {
-			return fmt.Errorf("error writing to file: %w", err)
+			logger.Fatalln("Invalid OAUTH_TOKEN_TTL:", err)
 		}
 	}
+	// Signing keys are kept for AUTH_TOKEN_TTL after they were used
+	if oauthTokenTTL > tokenTTL {
+		oauthTokenTTL = tokenTTL
+	}
 
-	return nil
-}
-func main() {
-	// Open log file
-	var err error
-	CheckAndCreateFile("/app/shared_data/users.json")
-	CheckAndCreateFile("/app/shared_data/authtokens.json")
-	logFile, err = os.OpenFile("/logs/auth.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	services, err = svcauth.FromEnv()
 	if err != nil {
-		fmt.Println("Error opening log file:", err)
-		os.Exit(1)
+		logger.Fatalln("Error setting up service authentication:", err)
 	}
-	defer logFile.Close()
+	services.Logger = logger
+	if err := tlsutil.TrustCAFromEnv(); err != nil {
+		logger.Fatalln("Error loading TLS_CA_FILE:", err)
+	}
+	backend = services.Client()
+	userinfoURL = strings.TrimSuffix(getenv("USERINFO_URL", userinfoURL), "/")
 
-	// Set up logger
-	logger = log.New(logFile, "", log.Ldate|log.Ltime|log.Lshortfile)
+	// Give users created before passwords were stored a credential, once
+	migrated, err := MigrateLegacyCredentials(users, filepath.Join(filepath.Dir(keysFile), "credentials_migrated"))
+	if err != nil {
+		logger.Println("Error migrating legacy credentials:", err)
+	} else if migrated > 0 {
+		logger.Printf("Migrated legacy credentials for %d users\n", migrated)
+	}
 
 	http.HandleFunc("/auth", AuthHandler)
+	http.HandleFunc("/credentials", CredentialsHandler)
+	http.HandleFunc("/refresh", RefreshHandler)
+	http.HandleFunc("/logout", LogoutHandler)
+	http.HandleFunc("/sessions", SessionsHandler)
+	http.HandleFunc("/sessions/", SessionHandler)
+	http.HandleFunc("/reset/request", ResetRequestHandler)
+	http.HandleFunc("/reset/confirm", ResetConfirmHandler)
+	http.HandleFunc("/unlock", UnlockHandler)
+	http.HandleFunc("/mfa", MFAHandler)
+	http.HandleFunc("/mfa/enroll", MFAEnrollHandler)
+	http.HandleFunc("/mfa/confirm", MFAConfirmHandler)
+	http.HandleFunc("/mfa/verify", MFAVerifyHandler)
+	http.HandleFunc("/mfa/recovery-codes", MFARecoveryCodesHandler)
+	http.HandleFunc("/mfa/disable", MFADisableHandler)
+	http.HandleFunc("/oauth/clients", ClientsHandler)
+	http.HandleFunc("/oauth/clients/", ClientHandler)
+	http.HandleFunc("/oauth/authorize", AuthorizeHandler)
+	http.HandleFunc("/oauth/token", TokenHandler)
+	http.HandleFunc("/oauth/userinfo", UserInfoHandler)
+	http.HandleFunc("/.well-known/openid-configuration", DiscoveryHandler)
+	http.HandleFunc("/keys", KeysHandler)
+	http.HandleFunc("/revocations", RevocationsHandler)
 	http.HandleFunc("/health", HealthHandler)
 
+	// Only the webserver and the other services may call the auth service,
+	// except for the endpoints of OAuth clients, the key documents and the
+	// admin endpoints, which authenticate their callers themselves
+	handler := services.Middleware(http.DefaultServeMux, "/health", "/keys", "/revocations",
+		"/.well-known/openid-configuration", "/oauth/token", "/oauth/userinfo",
+		"/oauth/clients", "/oauth/clients/", "/unlock")
 
 	fmt.Println("Authentication server started at http://auth:8082")
 	logger.Println("Authentication server started at http://auth:8082")
-	log.Fatal(http.ListenAndServe(":8082", nil))
+	log.Fatal(tlsutil.ListenAndServe(":8082", handler, logger))
 }
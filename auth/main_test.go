@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/m/store"
+	"example.com/m/token"
+)
+
+// TestSignupAndLoginConcurrent creates users in parallel the way userinfo
+// does, through its own store on the same directory, while their passwords
+// are set with /credentials and they log in with /auth, and checks that every
+// user can log in afterwards
+func TestSignupAndLoginConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	logger = log.New(io.Discard, "", 0)
+	auth, err := store.NewJSONStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userinfo, err := store.NewJSONStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, tokens = auth, auth
+	keyring, err = LoadKeyring(filepath.Join(dir, "keys.json"), token.AlgHS256, []byte("test-hmac-secret"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter = newLoginLimiter(
+		limitPolicy{FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: time.Minute, LockoutAfter: 10, LockoutDuration: time.Minute, Forget: time.Hour},
+		limitPolicy{FreeAttempts: 20, BaseDelay: time.Second, MaxDelay: time.Minute, LockoutAfter: 100, LockoutDuration: time.Minute, Forget: time.Hour},
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/credentials", CredentialsHandler)
+	mux.HandleFunc("/auth", AuthHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	post := func(path string, user User) (int, TokenResponse) {
+		data, _ := json.Marshal(user)
+		resp, err := http.Post(server.URL+path, "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Error(err)
+			return 0, TokenResponse{}
+		}
+		defer resp.Body.Close()
+		var res TokenResponse
+		if path == "/auth" && resp.StatusCode == http.StatusOK {
+			json.NewDecoder(resp.Body).Decode(&res)
+		}
+		return resp.StatusCode, res
+	}
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		user := User{Username: fmt.Sprintf("user%02d", i), Password: fmt.Sprintf("Passw0rd-%02d!", i)}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			now := time.Now().UTC()
+			err := userinfo.CreateUser(store.User{Name: user.Username, Email: user.Username + "@example.com",
+				Status: store.StatusActive, CreatedAt: now, UpdatedAt: now})
+			if err != nil {
+				t.Errorf("create %s: %v", user.Username, err)
+				return
+			}
+			if status, _ := post("/credentials", user); status != http.StatusOK {
+				t.Errorf("/credentials %s: status %d", user.Username, status)
+				return
+			}
+			if status, res := post("/auth", user); status != http.StatusOK || res.AuthToken == "" {
+				t.Errorf("/auth %s: status %d", user.Username, status)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Nothing was lost: every user logs in again and has both tokens
+	for i := 0; i < n; i++ {
+		user := User{Username: fmt.Sprintf("user%02d", i), Password: fmt.Sprintf("Passw0rd-%02d!", i)}
+		if status, res := post("/auth", user); status != http.StatusOK || res.Username != user.Username {
+			t.Errorf("second login of %s: status %d", user.Username, status)
+		}
+	}
+	s, err := store.NewJSONStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authTokens, err := s.Tokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logins := make(map[string]int)
+	for _, record := range authTokens {
+		logins[record.Username]++
+	}
+	for i := 0; i < n; i++ {
+		if name := fmt.Sprintf("user%02d", i); logins[name] != 2 {
+			t.Errorf("%d login tokens of %s, want 2", logins[name], name)
+		}
+	}
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/m/authz"
+	"example.com/m/store"
+	"example.com/m/totp"
+)
+
+var (
+	// mfaTokenTTL is how long the second step of a login may take
+	mfaTokenTTL = 5 * time.Minute
+	// mfaIssuer names the site in authenticator apps
+	mfaIssuer = "My Website"
+)
+
+// recoveryCodeCount is how many recovery codes are handed out at a time
+const recoveryCodeCount = 10
+
+// MFAChallenge is returned by /auth instead of a token when the user has a
+// second factor. The login is finished at /mfa/verify.
+type MFAChallenge struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Message     string `json:"message"`
+}
+
+// MFAVerifyRequest finishes a login with an authenticator or recovery code
+type MFAVerifyRequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+// MFACodeRequest carries an authenticator or recovery code
+type MFACodeRequest struct {
+	Code string `json:"code"`
+}
+
+// MFAStatus tells whether the user has a second factor
+type MFAStatus struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+// MFAEnrollment is the secret to add to an authenticator app
+type MFAEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// RecoveryCodes are shown to the user once, only their hashes are stored
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+	Message       string   `json:"message"`
+}
+
+// writeMFAChallenge answers a login with a correct password by asking for the
+// second factor
+func writeMFAChallenge(w http.ResponseWriter, username string) {
+	var challenge string
+	err := tokens.UpdateTokens(func(authTokens map[string]store.Token) error {
+		var err error
+		challenge, err = store.IssueOneTimeToken(authTokens, username, store.PurposeMFALogin, mfaTokenTTL)
+		return err
+	})
+	if err != nil {
+		http.Error(w, "Error updating auth tokens", http.StatusInternalServerError)
+		logger.Println("Error updating auth tokens:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MFAChallenge{
+		MFARequired: true,
+		MFAToken:    challenge,
+		ExpiresIn:   int64(mfaTokenTTL.Seconds()),
+		Message:     "Second factor required",
+	})
+	logger.Println("Second factor requested for user:", username)
+}
+
+// checkSecondFactor checks an authenticator code or a recovery code. On
+// success it updates the credential so the code cannot be used again, and
+// returns which kind of code it was. It returns "" for a wrong code.
+func checkSecondFactor(credential *store.Credential, code string, now time.Time) string {
+	if credential.TOTP == nil || !credential.TOTP.Enabled {
+		return ""
+	}
+	// Work on a copy, the stored credential only changes with SetCredential
+	t := *credential.TOTP
+	t.RecoveryCodes = slices.Clone(t.RecoveryCodes)
+
+	if step, ok := totp.Validate(t.Secret, code, now, t.LastStep); ok {
+		t.LastStep = step
+		credential.TOTP = &t
+		return "authenticator code"
+	}
+	hash := hashRecoveryCode(code)
+	for i, stored := range t.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			t.RecoveryCodes = slices.Delete(t.RecoveryCodes, i, i+1)
+			credential.TOTP = &t
+			return "recovery code"
+		}
+	}
+	return ""
+}
+
+// verifyCode checks the second factor of a user like a password, failures
+// count towards the login limits. If it returns false with a wait, the
+// attempt was not checked because of earlier failures.
+func verifyCode(r *http.Request, username, code string, credential *store.Credential) (time.Duration, bool) {
+	ip := clientIP(r)
+	now := time.Now()
+	if wait := limiter.Wait(username, ip, now); wait > 0 {
+		logger.Printf("Code for user %s from %s blocked for %s after failed attempts\n", username, ip, wait.Round(time.Second))
+		return wait, false
+	}
+
+	method := checkSecondFactor(credential, code, now)
+	if method == "" {
+		if limiter.Fail(username, ip, now) {
+			logger.Println("Logins locked after repeated failures for user:", username)
+		}
+		logger.Println("Invalid second factor code for user:", username)
+		return 0, false
+	}
+	limiter.Succeed(username)
+	logger.Printf("Second factor of user %s accepted with a %s\n", username, method)
+	return 0, true
+}
+
+// generateRecoveryCodes returns new recovery codes and their hashes
+func generateRecoveryCodes() ([]string, []string, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(code)
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a recovery code, ignoring case, dashes and spaces.
+// The codes are random, so a fast hash is enough.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// credentialLocks holds a mutex per user, see lockCredential
+var credentialLocks sync.Map
+
+// lockCredential serialises the changes of a user's credential, so two
+// requests cannot both accept the same code or recovery code before either
+// has saved it as used. Only the auth service changes credentials. The
+// returned function releases the lock.
+func lockCredential(username string) func() {
+	m, _ := credentialLocks.LoadOrStore(username, &sync.Mutex{})
+	mu := m.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// loadCredential returns the credential of the user, writing the error
+// response if it cannot be loaded
+func loadCredential(w http.ResponseWriter, username string) (store.Credential, bool) {
+	credential, err := users.GetCredential(username)
+	if err == store.ErrNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		logger.Println("No credentials for user:", username)
+		return credential, false
+	} else if err != nil {
+		http.Error(w, "Error loading user store", http.StatusInternalServerError)
+		logger.Println("Error loading user store:", err)
+		return credential, false
+	}
+	return credential, true
+}
+
+// saveCredential stores the credential, writing the error response if it
+// cannot be saved
+func saveCredential(w http.ResponseWriter, username string, credential store.Credential) bool {
+	if err := users.SetCredential(username, credential); err != nil {
+		http.Error(w, "Error saving credentials", http.StatusInternalServerError)
+		logger.Printf("Error saving credentials for user %s: %v\n", username, err)
+		return false
+	}
+	return true
+}
+
+// writeCodeError answers a request whose code verifyCode rejected
+func writeCodeError(w http.ResponseWriter, wait time.Duration, status int) {
+	if wait > 0 {
+		writeTooManyAttempts(w, wait)
+		return
+	}
+	http.Error(w, "Invalid code", status)
+}
+
+// MFAHandler tells whether the caller has a second factor, GET /mfa
+func MFAHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	claims := authenticateRequest(w, r)
+	if claims == nil {
+		return
+	}
+	credential, ok := loadCredential(w, claims.Subject)
+	if !ok {
+		return
+	}
+
+	status := MFAStatus{}
+	if credential.TOTP != nil && credential.TOTP.Enabled {
+		status.Enabled = true
+		status.RecoveryCodesLeft = len(credential.TOTP.RecoveryCodes)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// MFAEnrollHandler starts setting up an authenticator app, POST /mfa/enroll.
+// It returns a new secret, which is used once a code is confirmed with
+// /mfa/confirm. Enrolling again before that replaces the secret.
+func MFAEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	claims := authenticateRequest(w, r)
+	if claims == nil {
+		return
+	}
+	defer lockCredential(claims.Subject)()
+	credential, ok := loadCredential(w, claims.Subject)
+	if !ok {
+		return
+	}
+	if credential.TOTP != nil && credential.TOTP.Enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		logger.Println("Second factor already enabled for user:", claims.Subject)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		http.Error(w, "Error generating secret", http.StatusInternalServerError)
+		logger.Println("Error generating TOTP secret:", err)
+		return
+	}
+	credential.TOTP = &store.TOTP{Secret: secret}
+	if !saveCredential(w, claims.Subject, credential) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MFAEnrollment{Secret: secret, URI: totp.URI(mfaIssuer, claims.Subject, secret)})
+	logger.Println("Second factor enrollment started for user:", claims.Subject)
+}
+
+// MFAConfirmHandler enables the enrolled authenticator app once it shows a
+// valid code and returns the recovery codes, POST /mfa/confirm
+func MFAConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	claims := authenticateRequest(w, r)
+	if claims == nil {
+		return
+	}
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "Missing code", http.StatusBadRequest)
+		logger.Println("Missing code in confirm request:", err)
+		return
+	}
+	defer lockCredential(claims.Subject)()
+	credential, ok := loadCredential(w, claims.Subject)
+	if !ok {
+		return
+	}
+	if credential.TOTP == nil {
+		http.Error(w, "No enrollment in progress", http.StatusBadRequest)
+		logger.Println("Second factor confirmed without enrollment for user:", claims.Subject)
+		return
+	}
+	if credential.TOTP.Enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		logger.Println("Second factor already enabled for user:", claims.Subject)
+		return
+	}
+
+	step, ok := totp.Validate(credential.TOTP.Secret, req.Code, time.Now(), 0)
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		logger.Println("Invalid code confirming second factor for user:", claims.Subject)
+		return
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		http.Error(w, "Error generating recovery codes", http.StatusInternalServerError)
+		logger.Println("Error generating recovery codes:", err)
+		return
+	}
+	credential.TOTP = &store.TOTP{
+		Secret:        credential.TOTP.Secret,
+		Enabled:       true,
+		LastStep:      step,
+		RecoveryCodes: hashes,
+	}
+	if !saveCredential(w, claims.Subject, credential) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodes{RecoveryCodes: codes, Message: "Two-factor authentication enabled"})
+	logger.Println("Second factor enabled for user:", claims.Subject)
+}
+
+// MFARecoveryCodesHandler replaces the recovery codes of the caller, POST
+// /mfa/recovery-codes with a current code
+func MFARecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	claims := authenticateRequest(w, r)
+	if claims == nil {
+		return
+	}
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "Missing code", http.StatusBadRequest)
+		logger.Println("Missing code in recovery codes request:", err)
+		return
+	}
+	defer lockCredential(claims.Subject)()
+	credential, ok := loadCredential(w, claims.Subject)
+	if !ok {
+		return
+	}
+	if credential.TOTP == nil || !credential.TOTP.Enabled {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+		logger.Println("Recovery codes requested without second factor for user:", claims.Subject)
+		return
+	}
+	if wait, ok := verifyCode(r, claims.Subject, req.Code, &credential); !ok {
+		writeCodeError(w, wait, http.StatusForbidden)
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		http.Error(w, "Error generating recovery codes", http.StatusInternalServerError)
+		logger.Println("Error generating recovery codes:", err)
+		return
+	}
+	credential.TOTP.RecoveryCodes = hashes
+	if !saveCredential(w, claims.Subject, credential) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodes{RecoveryCodes: codes, Message: "New recovery codes created, the old ones no longer work"})
+	logger.Println("Recovery codes replaced for user:", claims.Subject)
+}
+
+// MFADisableHandler removes the caller's second factor, POST /mfa/disable
+// with a current code. An enrollment that was not confirmed yet is cancelled
+// without one.
+func MFADisableHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	claims := authenticateRequest(w, r)
+	if claims == nil {
+		return
+	}
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		logger.Println("Error decoding request body:", err)
+		return
+	}
+	defer lockCredential(claims.Subject)()
+	credential, ok := loadCredential(w, claims.Subject)
+	if !ok {
+		return
+	}
+	if credential.TOTP == nil {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+		logger.Println("Second factor disabled without one for user:", claims.Subject)
+		return
+	}
+	if credential.TOTP.Enabled {
+		if wait, ok := verifyCode(r, claims.Subject, req.Code, &credential); !ok {
+			writeCodeError(w, wait, http.StatusForbidden)
+			return
+		}
+	}
+
+	credential.TOTP = nil
+	if !saveCredential(w, claims.Subject, credential) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+	logger.Println("Second factor disabled for user:", claims.Subject)
+}
+
+// MFAVerifyHandler finishes a login with the second factor, POST /mfa/verify.
+// It takes the mfa_token returned by /auth and an authenticator code or a
+// recovery code, and returns the auth token like /auth.
+func MFAVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	var req MFAVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MFAToken == "" || req.Code == "" {
+		http.Error(w, "Missing mfa_token or code", http.StatusBadRequest)
+		logger.Println("Missing mfa_token or code in verify request:", err)
+		return
+	}
+
+	// Look at the challenge without using it up, a mistyped code can be
+	// tried again
+	authTokens, err := tokens.Tokens()
+	if err != nil {
+		http.Error(w, "Error loading auth tokens", http.StatusInternalServerError)
+		logger.Println("Error loading auth tokens:", err)
+		return
+	}
+	challenge, err := store.FindOneTimeToken(authTokens, req.MFAToken, store.PurposeMFALogin)
+	if err != nil {
+		http.Error(w, "Invalid or expired login, please log in again", http.StatusBadRequest)
+		logger.Println("Invalid or expired mfa token")
+		return
+	}
+	username := challenge.Username
+	defer lockCredential(username)()
+	credential, ok := loadCredential(w, username)
+	if !ok {
+		return
+	}
+	if wait, ok := verifyCode(r, username, req.Code, &credential); !ok {
+		writeCodeError(w, wait, http.StatusUnauthorized)
+		return
+	}
+	if !saveCredential(w, username, credential) {
+		return
+	}
+	account, err := users.GetUser(username)
+	if err != nil {
+		http.Error(w, "Error loading user store", http.StatusInternalServerError)
+		logger.Println("Error loading user store:", err)
+		return
+	}
+
+	session := store.Token{
+		Username:  username,
+		UserAgent: r.UserAgent(),
+		ClientIP:  clientIP(r),
+	}
+	var authToken string
+	var record store.Token
+	err = tokens.UpdateTokens(func(authTokens map[string]store.Token) error {
+		// Using up the challenge here makes sure it finishes one login only
+		if _, err := store.UseOneTimeToken(authTokens, req.MFAToken, store.PurposeMFALogin); err != nil {
+			return err
+		}
+		var err error
+		authToken, record, err = issueAuthToken(authTokens, session, authz.Effective(account.Roles))
+		return err
+	})
+	if err == store.ErrNotFound {
+		http.Error(w, "Invalid or expired login, please log in again", http.StatusBadRequest)
+		logger.Println("Mfa token used up concurrently for user:", username)
+		return
+	} else if err != nil {
+		http.Error(w, "Error updating auth tokens", http.StatusInternalServerError)
+		logger.Println("Error updating auth tokens:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newTokenResponse(authToken, record, "Authentication successful"))
+	logger.Println("Authentication successful for user:", username)
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/m/store"
+	"example.com/m/token"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Scopes an OAuth client can ask for, with the OpenID Connect meaning
+const (
+	scopeOpenID  = "openid"
+	scopeProfile = "profile"
+	scopeEmail   = "email"
+)
+
+// authCodeTTL is how long an authorization code can be exchanged for a token
+const authCodeTTL = time.Minute
+
+var (
+	// oauthIssuer is the address of the auth service as seen by OAuth
+	// clients, the iss of id tokens and the base of the endpoints
+	oauthIssuer = "http://auth:8082"
+	// oauthTokenTTL is how long an access token of an OAuth client is valid
+	oauthTokenTTL = time.Hour
+	// userinfoURL is the userinfo service, asked for the user's details by
+	// /oauth/userinfo through backend, which signs the calls as this service
+	userinfoURL = "http://userinfo:8083"
+	backend     *http.Client
+
+	codes = &authCodes{codes: make(map[string]authCode)}
+)
+
+// authCode is a code handed to a client through the browser, to be exchanged
+// for tokens at the token endpoint
+type authCode struct {
+	ClientID      string
+	RedirectURI   string
+	Username      string
+	Scope         string
+	Nonce         string
+	CodeChallenge string
+	AuthTime      time.Time
+	ExpiresAt     time.Time
+}
+
+// authCodes holds the codes that were not exchanged yet. They live for a
+// minute, so they are kept in memory; a restart of the auth service means
+// the user has to log in to the client again.
+type authCodes struct {
+	mu    sync.Mutex
+	codes map[string]authCode
+}
+
+// Issue stores a code and returns its value
+func (c *authCodes) Issue(code authCode) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for value, old := range c.codes {
+		if !now.Before(old.ExpiresAt) {
+			delete(c.codes, value)
+		}
+	}
+	value := generateAuthToken() + generateAuthToken()
+	c.codes[value] = code
+	return value
+}
+
+// Use returns the code and removes it, so it works only once
+func (c *authCodes) Use(value string) (authCode, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	code, ok := c.codes[value]
+	delete(c.codes, value)
+	if !ok || !time.Now().Before(code.ExpiresAt) {
+		return authCode{}, false
+	}
+	return code, true
+}
+
+// AuthorizeRequest is an OAuth authorization request passed on by the
+// webserver, which shows the consent page. Decision is empty to check the
+// request, or "approve" or "deny" once the user answered.
+type AuthorizeRequest struct {
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	ResponseType        string `json:"response_type"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	Nonce               string `json:"nonce"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+	Decision            string `json:"decision"`
+}
+
+// AuthorizeResponse either describes the request for the consent page, or
+// gives the address to send the browser back to the client with
+type AuthorizeResponse struct {
+	ClientName string   `json:"client_name,omitempty"`
+	Scopes     []string `json:"scopes,omitempty"`
+	Redirect   string   `json:"redirect,omitempty"`
+}
+
+// OAuthError is an error response of the OAuth endpoints, RFC 6749 section
+// 5.2
+type OAuthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// TokenGrant is the token endpoint's response
+type TokenGrant struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope"`
+	IDToken     string `json:"id_token,omitempty"`
+}
+
+// IDClaims are the claims of an OpenID Connect id token
+type IDClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	AuthTime  int64  `json:"auth_time"`
+	Nonce     string `json:"nonce,omitempty"`
+}
+
+// UserInfo is the response of the userinfo endpoint, the OpenID Connect
+// standard claims taken from the user's details
+type UserInfo struct {
+	Subject           string `json:"sub"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Name              string `json:"name,omitempty"`
+	Birthdate         string `json:"birthdate,omitempty"`
+	UpdatedAt         int64  `json:"updated_at,omitempty"`
+	Email             string `json:"email,omitempty"`
+	EmailVerified     *bool  `json:"email_verified,omitempty"`
+}
+
+// writeOAuthError writes an OAuth error response
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(OAuthError{Error: code, Description: description})
+}
+
+// redirectURL adds params to the query of a client's redirect URI
+func redirectURL(uri string, params url.Values) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// checkScope returns the requested scopes, openid if none are requested. It
+// returns false if a scope is unknown.
+func checkScope(scope string) ([]string, bool) {
+	scopes := strings.Fields(scope)
+	if len(scopes) == 0 {
+		return []string{scopeOpenID}, true
+	}
+	for _, s := range scopes {
+		if s != scopeOpenID && s != scopeProfile && s != scopeEmail {
+			return nil, false
+		}
+	}
+	return scopes, true
+}
+
+// pkceChallenge returns the S256 code challenge of a code verifier, RFC 7636
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthorizeHandler checks an authorization request and, once the user
+// approved it on the consent page, issues the code, POST /oauth/authorize.
+// It is called by the webserver with the token of the logged in user.
+func AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	claims := authenticateRequest(w, r)
+	if claims == nil {
+		return
+	}
+	var req AuthorizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Invalid request payload")
+		logger.Println("Error decoding authorization request:", err)
+		return
+	}
+
+	// Errors about the client or its redirect URI cannot be sent to the
+	// client, the user sees them instead
+	client, ok := clients.Get(req.ClientID)
+	if !ok {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_client", "Unknown client")
+		logger.Println("Authorization request for unknown client:", req.ClientID)
+		return
+	}
+	// The token request has to repeat the redirect_uri exactly as given here
+	requestedRedirect := req.RedirectURI
+	if req.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		req.RedirectURI = client.RedirectURIs[0]
+	}
+	if !client.AllowsRedirect(req.RedirectURI) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "The redirect_uri is not registered for the client")
+		logger.Printf("Unregistered redirect URI %q for client %s\n", req.RedirectURI, client.ID)
+		return
+	}
+
+	// Other errors go back to the client
+	redirectError := func(code, description string) {
+		params := url.Values{"error": {code}, "error_description": {description}}
+		if req.State != "" {
+			params.Set("state", req.State)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AuthorizeResponse{Redirect: redirectURL(req.RedirectURI, params)})
+		logger.Printf("Authorization request of client %s for user %s refused: %s\n", client.ID, claims.Subject, code)
+	}
+	scopes, ok := checkScope(req.Scope)
+	switch {
+	case req.ResponseType != "code":
+		redirectError("unsupported_response_type", "Only the code response type is supported")
+		return
+	case req.CodeChallenge == "" || req.CodeChallengeMethod != "S256":
+		redirectError("invalid_request", "PKCE with the S256 method is required")
+		return
+	case !ok:
+		redirectError("invalid_scope", "Supported scopes are openid, profile and email")
+		return
+	}
+
+	switch req.Decision {
+	case "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AuthorizeResponse{ClientName: client.Name, Scopes: scopes})
+	case "deny":
+		redirectError("access_denied", "The user denied the request")
+	case "approve":
+		// The user logged in when the session started, refreshing the token
+		// does not ask for the password again
+		authTime := time.Unix(claims.IssuedAt, 0)
+		if authTokens, err := tokens.Tokens(); err == nil && !authTokens[claims.ID].CreatedAt.IsZero() {
+			authTime = authTokens[claims.ID].CreatedAt
+		}
+		code := codes.Issue(authCode{
+			ClientID:      client.ID,
+			RedirectURI:   requestedRedirect,
+			Username:      claims.Subject,
+			Scope:         strings.Join(scopes, " "),
+			Nonce:         req.Nonce,
+			CodeChallenge: req.CodeChallenge,
+			AuthTime:      authTime,
+			ExpiresAt:     time.Now().Add(authCodeTTL),
+		})
+		params := url.Values{"code": {code}}
+		if req.State != "" {
+			params.Set("state", req.State)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AuthorizeResponse{Redirect: redirectURL(req.RedirectURI, params)})
+		logger.Printf("User %s authorized client %s for %q\n", claims.Subject, client.ID, strings.Join(scopes, " "))
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Unknown decision")
+		logger.Println("Unknown decision in authorization request:", req.Decision)
+	}
+}
+
+// TokenHandler exchanges an authorization code for an access token and, with
+// the openid scope, an id token, POST /oauth/token
+func TokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Invalid form body")
+		logger.Println("Error parsing token request:", err)
+		return
+	}
+	if grantType := r.PostForm.Get("grant_type"); grantType != "authorization_code" {
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Only the authorization_code grant is supported")
+		logger.Println("Unsupported grant type:", grantType)
+		return
+	}
+
+	// Confidential clients authenticate with HTTP Basic or form fields
+	clientID, secret, basic := r.BasicAuth()
+	if !basic {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	client, ok := clients.Get(clientID)
+	if ok && client.Public() {
+		ok = secret == ""
+	} else if ok {
+		ok = bcrypt.CompareHashAndPassword([]byte(client.SecretHash), []byte(secret)) == nil
+	}
+	if !ok {
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		logger.Println("Client authentication failed for client:", clientID)
+		return
+	}
+
+	code, ok := codes.Use(r.PostForm.Get("code"))
+	if !ok || code.ClientID != client.ID || code.RedirectURI != r.PostForm.Get("redirect_uri") {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid, expired or used authorization code")
+		logger.Println("Invalid authorization code from client:", client.ID)
+		return
+	}
+	verifier := r.PostForm.Get("code_verifier")
+	if len(verifier) < 43 || len(verifier) > 128 ||
+		subtle.ConstantTimeCompare([]byte(pkceChallenge(verifier)), []byte(code.CodeChallenge)) != 1 {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid code_verifier")
+		logger.Println("PKCE verification failed for client:", client.ID)
+		return
+	}
+
+	// The account may have been disabled since the user approved
+	if user, err := users.GetUser(code.Username); err != nil || user.Status != store.StatusActive {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The user can no longer log in")
+		logger.Printf("Token for inactive user %s refused: %v\n", code.Username, err)
+		return
+	}
+
+	session := store.Token{
+		Username:  code.Username,
+		ClientID:  client.ID,
+		UserAgent: client.Name,
+		ClientIP:  clientIP(r),
+	}
+	var accessToken string
+	var record store.Token
+	err := tokens.UpdateTokens(func(authTokens map[string]store.Token) error {
+		var err error
+		accessToken, record, err = issueToken(authTokens, session, code.Scope, nil, oauthTokenTTL)
+		return err
+	})
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Error issuing token")
+		logger.Println("Error updating auth tokens:", err)
+		return
+	}
+
+	grant := TokenGrant{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(time.Until(record.ExpiresAt).Seconds()),
+		Scope:       code.Scope,
+	}
+	if slices.Contains(strings.Fields(code.Scope), scopeOpenID) {
+		key, err := keyring.IDTokenKey()
+		if err == nil {
+			grant.IDToken, err = token.Sign(IDClaims{
+				Issuer:    oauthIssuer,
+				Subject:   code.Username,
+				Audience:  client.ID,
+				IssuedAt:  record.IssuedAt.Unix(),
+				ExpiresAt: record.ExpiresAt.Unix(),
+				AuthTime:  code.AuthTime.Unix(),
+				Nonce:     code.Nonce,
+			}, key)
+		}
+		if err != nil {
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "Error signing id token")
+			logger.Println("Error signing id token:", err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(grant)
+	logger.Printf("Issued OAuth token for user %s to client %s\n", code.Username, client.ID)
+}
+
+// UserInfoHandler returns the claims about the user of an access token
+// issued with the openid scope, GET or POST /oauth/userinfo. The claims are
+// taken from the user's details served by the userinfo service.
+func UserInfoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	invalidToken := func(description string) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description="`+description+`"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_token", description)
+	}
+	raw, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Missing bearer token", http.StatusUnauthorized)
+		logger.Println("Userinfo request without bearer token")
+		return
+	}
+	var claims token.Claims
+	if err := token.Parse(strings.TrimSpace(raw), keyring, &claims); err != nil {
+		invalidToken("The access token is invalid or expired")
+		logger.Println("Invalid userinfo token:", err)
+		return
+	}
+	authTokens, err := tokens.Tokens()
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Error loading tokens")
+		logger.Println("Error loading auth tokens:", err)
+		return
+	}
+	record, ok := authTokens[claims.ID]
+	if !ok || record.RevokedAt != nil || record.ClientID == "" || record.ClientID != claims.ClientID || !claims.HasScope(scopeOpenID) {
+		invalidToken("The access token is revoked or not an OpenID Connect token")
+		logger.Printf("Userinfo token of user %s rejected\n", claims.Subject)
+		return
+	}
+
+	// The details come from the userinfo service, which checks the token
+	// again and sees that the auth service forwards it
+	req, _ := http.NewRequest(http.MethodGet, userinfoURL+"/userdetails", nil)
+	req.Header.Set("Authorization", strings.TrimSpace(raw))
+	req.Header.Set("username", claims.Subject)
+	resp, err := backend.Do(req)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Error fetching user details")
+		logger.Println("Error fetching user details from userinfo:", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		invalidToken("The user no longer exists")
+		logger.Printf("Userinfo for user %s failed: user not found\n", claims.Subject)
+		return
+	} else if resp.StatusCode != http.StatusOK {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Error fetching user details")
+		logger.Printf("Unexpected status code %d from userinfo for user %s\n", resp.StatusCode, claims.Subject)
+		return
+	}
+	var user store.User
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Error parsing user details")
+		logger.Println("Error parsing user details from userinfo:", err)
+		return
+	}
+
+	info := UserInfo{Subject: user.Name}
+	if claims.HasScope(scopeProfile) {
+		info.PreferredUsername = user.Name
+		info.Name = user.DisplayName
+		if info.Name == "" {
+			info.Name = user.Name
+		}
+		info.Birthdate = user.BirthDate
+		if !user.UpdatedAt.IsZero() {
+			info.UpdatedAt = user.UpdatedAt.Unix()
+		}
+	}
+	if claims.HasScope(scopeEmail) {
+		verified := user.Status != store.StatusPending
+		info.Email = user.Email
+		info.EmailVerified = &verified
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(info)
+	logger.Printf("Userinfo of user %s sent to client %s\n", user.Name, claims.ClientID)
+}
+
+// DiscoveryHandler serves the OpenID Connect discovery document, GET
+// /.well-known/openid-configuration. The authorization endpoint is the
+// webserver's, where users log in and give their consent.
+func DiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                oauthIssuer,
+		"authorization_endpoint":                publicURL + "/oauth/authorize",
+		"token_endpoint":                        oauthIssuer + "/oauth/token",
+		"userinfo_endpoint":                     oauthIssuer + "/oauth/userinfo",
+		"jwks_uri":                              oauthIssuer + "/keys",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{token.AlgEdDSA},
+		"scopes_supported":                      []string{scopeOpenID, scopeProfile, scopeEmail},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported": []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce",
+			"preferred_username", "name", "birthdate", "updated_at", "email", "email_verified"},
+	})
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/m/store"
+	"example.com/m/svcauth"
+	"example.com/m/token"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	testClientID     = "demo-client"
+	testClientSecret = "demo-secret"
+	testRedirectURI  = "http://localhost:8084/callback"
+	testVerifier     = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+// idTokenClaims are the claims of an id token as a client reads them
+type idTokenClaims struct {
+	IDClaims
+}
+
+func (c idTokenClaims) Expiry() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+// oauthTestServer sets up the auth service's globals with the test store, a
+// keyring in a temporary directory, a confidential client and a fake userinfo
+// service, and serves the OAuth endpoints. It returns the server and the auth token of ann's login to
+// the site.
+func oauthTestServer(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+	dir := t.TempDir()
+	testStore(t)
+
+	var err error
+	keyring, err = LoadKeyring(filepath.Join(dir, "keys.json"), token.AlgHS256, []byte("test-hmac-secret"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients, err = LoadClients(filepath.Join(dir, "clients.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(testClientSecret), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = clients.Add(OAuthClient{ID: testClientID, Name: "Demo", SecretHash: string(hash),
+		RedirectURIs: []string{testRedirectURI}, CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var authToken string
+	err = tokens.UpdateTokens(func(authTokens map[string]store.Token) error {
+		var err error
+		authToken, _, err = issueAuthToken(authTokens, store.Token{Username: "ann"}, nil)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// userinfo answers /userdetails for the access tokens auth forwards
+	services = &svcauth.Service{Name: "auth", Key: []byte("auth-service-test-key"), Logger: logger}
+	userinfoService := &svcauth.Service{Name: "userinfo", Key: []byte("userinfo-service-test-key"), Logger: logger,
+		Trusted: map[string][]byte{"auth": services.Key}}
+	services.Trusted = map[string][]byte{"userinfo": userinfoService.Key}
+	backend = services.Client()
+	userinfo := httptest.NewServer(userinfoService.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var claims token.Claims
+		err := token.Parse(r.Header.Get("Authorization"), keyring, &claims)
+		if err != nil || svcauth.Caller(r) != "auth" || claims.ClientID == "" || claims.Subject != r.Header.Get("username") {
+			http.Error(w, "Invalid authentication credentials", http.StatusUnauthorized)
+			return
+		}
+		user, err := users.GetUser(claims.Subject)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(user)
+	})))
+	t.Cleanup(userinfo.Close)
+	userinfoURL = userinfo.URL
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/authorize", AuthorizeHandler)
+	mux.HandleFunc("/oauth/token", TokenHandler)
+	mux.HandleFunc("/oauth/userinfo", UserInfoHandler)
+	mux.HandleFunc("/keys", KeysHandler)
+	mux.HandleFunc("/revocations", RevocationsHandler)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	oauthIssuer = server.URL
+	return server, authToken
+}
+
+// authorize approves an authorization request as ann and returns the code
+func authorize(t *testing.T, server *httptest.Server, authToken, redirectURI string) string {
+	t.Helper()
+	body, _ := json.Marshal(AuthorizeRequest{
+		ClientID:            testClientID,
+		RedirectURI:         redirectURI,
+		ResponseType:        "code",
+		Scope:               "openid profile email",
+		State:               "xyz",
+		Nonce:               "n-0S6_WzA2Mj",
+		CodeChallenge:       pkceChallenge(testVerifier),
+		CodeChallengeMethod: "S256",
+		Decision:            "approve",
+	})
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/oauth/authorize", bytes.NewReader(body))
+	req.Header.Set("Authorization", authToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("authorize: status %d", resp.StatusCode)
+	}
+
+	var res AuthorizeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	redirect, err := url.Parse(res.Redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := redirect.Scheme + "://" + redirect.Host + redirect.Path; got != testRedirectURI {
+		t.Fatalf("redirected to %s, want %s", got, testRedirectURI)
+	}
+	if state := redirect.Query().Get("state"); state != "xyz" {
+		t.Errorf("state = %q, want xyz", state)
+	}
+	code := redirect.Query().Get("code")
+	if code == "" {
+		t.Fatalf("no code in %s", res.Redirect)
+	}
+	return code
+}
+
+// exchange redeems a code at the token endpoint. It returns the status and
+// decodes the grant or the OAuth error.
+func exchange(t *testing.T, server *httptest.Server, code, verifier, redirectURI string) (int, TokenGrant, OAuthError) {
+	t.Helper()
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"code_verifier": {verifier},
+		"redirect_uri":  {redirectURI},
+	}
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(testClientID, testClientSecret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var grant TokenGrant
+	var oauthErr OAuthError
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusOK {
+		err = json.Unmarshal(data, &grant)
+	} else {
+		err = json.Unmarshal(data, &oauthErr)
+	}
+	if err != nil {
+		t.Fatalf("token response %q: %v", data, err)
+	}
+	return resp.StatusCode, grant, oauthErr
+}
+
+func TestOAuthCodeFlow(t *testing.T) {
+	server, authToken := oauthTestServer(t)
+
+	code := authorize(t, server, authToken, testRedirectURI)
+	status, grant, _ := exchange(t, server, code, testVerifier, testRedirectURI)
+	if status != http.StatusOK {
+		t.Fatalf("token: status %d", status)
+	}
+	if grant.TokenType != "Bearer" || grant.AccessToken == "" || grant.Scope != "openid profile email" {
+		t.Errorf("grant = %+v", grant)
+	}
+
+	// Clients check the id token against the id token keys in /keys
+	keys := token.NewRemoteKeySet(server.URL, nil)
+	keys.Use = token.UseIDToken
+	var claims idTokenClaims
+	if err := token.Parse(grant.IDToken, keys, &claims); err != nil {
+		t.Fatalf("id token: %v", err)
+	}
+	if claims.Issuer != server.URL || claims.Subject != "ann" || claims.Audience != testClientID || claims.Nonce != "n-0S6_WzA2Mj" {
+		t.Errorf("id token claims = %+v", claims.IDClaims)
+	}
+	// and it cannot be used as an auth token
+	var authClaims token.Claims
+	if err := token.Parse(grant.IDToken, keyring, &authClaims); !errors.Is(err, token.ErrUnknownKey) {
+		t.Errorf("id token as auth token: %v, want %v", err, token.ErrUnknownKey)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/oauth/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+grant.AccessToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("userinfo: status %d", resp.StatusCode)
+	}
+	var info UserInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Subject != "ann" || info.Name != "Ann" || info.Email != "ann@example.com" ||
+		info.EmailVerified == nil || !*info.EmailVerified {
+		t.Errorf("userinfo = %+v", info)
+	}
+
+	// A code works only once
+	status, _, oauthErr := exchange(t, server, code, testVerifier, testRedirectURI)
+	if status != http.StatusBadRequest || oauthErr.Error != "invalid_grant" {
+		t.Errorf("reused code: status %d, error %q", status, oauthErr.Error)
+	}
+}
+
+func TestOAuthTokenRefused(t *testing.T) {
+	server, authToken := oauthTestServer(t)
+
+	tests := []struct {
+		name        string
+		verifier    string
+		redirectURI string
+	}{
+		{"wrong verifier", strings.Repeat("a", 43), testRedirectURI},
+		{"short verifier", "too-short", testRedirectURI},
+		{"redirect_uri mismatch", testVerifier, "http://localhost:8084/other"},
+		{"redirect_uri missing", testVerifier, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := authorize(t, server, authToken, testRedirectURI)
+			status, grant, oauthErr := exchange(t, server, code, tt.verifier, tt.redirectURI)
+			if status != http.StatusBadRequest || oauthErr.Error != "invalid_grant" || grant.AccessToken != "" {
+				t.Errorf("status %d, error %q, want 400 invalid_grant", status, oauthErr.Error)
+			}
+			// The failed attempt used up the code
+			status, _, _ = exchange(t, server, code, testVerifier, testRedirectURI)
+			if status != http.StatusBadRequest {
+				t.Errorf("code after a failed exchange: status %d, want 400", status)
+			}
+		})
+	}
+}
+
+func TestOAuthAuthorizeUnregisteredRedirect(t *testing.T) {
+	server, authToken := oauthTestServer(t)
+
+	body, _ := json.Marshal(AuthorizeRequest{
+		ClientID:            testClientID,
+		RedirectURI:         "http://evil.example/callback",
+		ResponseType:        "code",
+		CodeChallenge:       pkceChallenge(testVerifier),
+		CodeChallengeMethod: "S256",
+		Decision:            "approve",
+	})
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/oauth/authorize", bytes.NewReader(body))
+	req.Header.Set("Authorization", authToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		AuthorizeResponse
+		OAuthError
+	}
+	json.NewDecoder(resp.Body).Decode(&res)
+	if resp.StatusCode != http.StatusBadRequest || res.Redirect != "" || res.OAuthError.Error != "invalid_request" {
+		t.Errorf("status %d, response %+v, want 400 invalid_request without a redirect", resp.StatusCode, res)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"example.com/m/mailer"
+	"example.com/m/store"
+	"example.com/m/validate"
+)
+
+var (
+	// resetTokenTTL is how long a password reset link works
+	resetTokenTTL = 30 * time.Minute
+
+	// mail sends the password reset emails
+	mail mailer.Mailer
+	// publicURL is the address of the webserver, used in the links in emails
+	publicURL string
+)
+
+// ResetRequest asks for a password reset link, by username or email address
+type ResetRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// ResetConfirm sets a new password with the token from a reset link
+type ResetConfirm struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// resetAccounts returns the users a reset was requested for. Several
+// accounts can share an email address, each gets its own link.
+func resetAccounts(req ResetRequest) ([]store.User, error) {
+	if req.Username != "" {
+		user, err := users.GetUser(req.Username)
+		if err == store.ErrNotFound {
+			return nil, nil
+		}
+		return []store.User{user}, err
+	}
+
+	list, err := users.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+	var matches []store.User
+	for _, user := range list {
+		if strings.EqualFold(user.Email, req.Email) {
+			matches = append(matches, user)
+		}
+	}
+	return matches, nil
+}
+
+// sendResetEmail issues a reset token for the user and mails the link
+func sendResetEmail(user store.User) error {
+	var secret string
+	err := tokens.UpdateTokens(func(authTokens map[string]store.Token) error {
+		var err error
+		secret, err = store.IssueOneTimeToken(authTokens, user.Name, store.PurposeResetPassword, resetTokenTTL)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	link := publicURL + "/reset?token=" + url.QueryEscape(secret)
+	return mail.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hello %s,\n\nsomeone asked to reset the password of your account. To choose a new password, open:\n\n%s\n\n"+
+			"The link works once and expires in %d minutes. If you did not ask for this, you can ignore this email.\n",
+			user.Name, link, int(resetTokenTTL.Minutes())),
+	})
+}
+
+// ResetRequestHandler mails a password reset link, POST /reset/request. The
+// response is the same whether or not the account exists, so it cannot be
+// used to find out which usernames or addresses are registered.
+func ResetRequestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	var req ResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Username == "" && req.Email == "") {
+		http.Error(w, "Missing username or email", http.StatusBadRequest)
+		logger.Println("Missing username or email in reset request:", err)
+		return
+	}
+
+	accounts, err := resetAccounts(req)
+	if err != nil {
+		http.Error(w, "Error loading user store", http.StatusInternalServerError)
+		logger.Println("Error loading user store:", err)
+		return
+	}
+	for _, user := range accounts {
+		if user.Status == store.StatusDisabled || user.Email == "" {
+			logger.Println("Password reset refused for user:", user.Name)
+			continue
+		}
+		if err := sendResetEmail(user); err != nil {
+			http.Error(w, "Error sending reset email", http.StatusInternalServerError)
+			logger.Printf("Error sending reset email to user %s: %v\n", user.Name, err)
+			return
+		}
+		logger.Println("Password reset link sent to user:", user.Name)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "If the account exists, a reset link was sent to its email address"})
+}
+
+// ResetConfirmHandler sets a new password with a reset token, POST
+// /reset/confirm. The token works once, and all of the user's tokens are
+// revoked so every session has to log in with the new password.
+func ResetConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	var req ResetConfirm
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "Missing reset token", http.StatusBadRequest)
+		logger.Println("Missing reset token:", err)
+		return
+	}
+	if msg := validate.Password(req.Password); msg != "" {
+		validate.WriteErrors(w, validate.Errors{{Field: "password", Message: msg}})
+		logger.Println("Invalid new password in reset:", msg)
+		return
+	}
+
+	// Hash first so the token is only used up once everything else is ready
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		http.Error(w, "Error hashing password", http.StatusInternalServerError)
+		logger.Println("Error hashing password:", err)
+		return
+	}
+
+	// Use up the link and end the sessions in one update, so of two requests
+	// with the same link only one gets past here. The link is put back if
+	// the password cannot be saved, the sessions stay ended.
+	var record store.Token
+	err = tokens.UpdateTokens(func(authTokens map[string]store.Token) error {
+		var err error
+		record, err = store.UseOneTimeToken(authTokens, req.Token, store.PurposeResetPassword)
+		if err != nil {
+			return err
+		}
+		// Also revokes any other reset links of the user
+		store.RevokeUserTokens(authTokens, record.Username)
+		return nil
+	})
+	if err == store.ErrNotFound {
+		http.Error(w, "Invalid or expired reset link", http.StatusBadRequest)
+		logger.Println("Invalid or expired reset token")
+		return
+	} else if err != nil {
+		http.Error(w, "Error updating auth tokens", http.StatusInternalServerError)
+		logger.Println("Error using reset token:", err)
+		return
+	}
+
+	// A second factor stays set up, the link only stands in for the password
+	unlock := lockCredential(record.Username)
+	credential := store.Credential{PasswordHash: hash}
+	if old, err := users.GetCredential(record.Username); err == nil {
+		credential.TOTP = old.TOTP
+	}
+	err = users.SetCredential(record.Username, credential)
+	unlock()
+	if err != nil {
+		http.Error(w, "Error saving credentials", http.StatusInternalServerError)
+		logger.Printf("Error saving credentials for user %s: %v\n", record.Username, err)
+		err = tokens.UpdateTokens(func(authTokens map[string]store.Token) error {
+			store.RestoreOneTimeToken(authTokens, req.Token, record)
+			return nil
+		})
+		if err != nil {
+			logger.Printf("Error restoring reset token of user %s: %v\n", record.Username, err)
+		}
+		return
+	}
+
+	// The link was sent to the account's address, which verifies it
+	if user, err := users.GetUser(record.Username); err == nil && user.Status == store.StatusPending {
+		user.Status = store.StatusActive
+		user.UpdatedAt = time.Now().UTC()
+		if err := users.UpdateUser(user); err != nil {
+			logger.Printf("Error activating user %s after reset: %v\n", record.Username, err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password changed", "username": record.Username})
+	logger.Println("Password reset for user:", record.Username)
+}
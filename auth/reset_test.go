@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/m/store"
+)
+
+// testStore points the auth service's globals at a new memory store with an
+// active user ann and a discarding logger
+func testStore(t *testing.T) *store.MemoryStore {
+	t.Helper()
+	logger = log.New(io.Discard, "", 0)
+	s := store.NewMemoryStore()
+	users, tokens = s, s
+
+	now := time.Now().UTC()
+	err := users.CreateUser(store.User{Name: "ann", DisplayName: "Ann", Email: "ann@example.com",
+		Status: store.StatusActive, CreatedAt: now, UpdatedAt: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// slowCredentials takes a while to save a credential, like a busy disk, so
+// concurrent requests overlap
+type slowCredentials struct {
+	store.UserStore
+}
+
+func (s slowCredentials) SetCredential(name string, credential store.Credential) error {
+	time.Sleep(200 * time.Millisecond)
+	return s.UserStore.SetCredential(name, credential)
+}
+
+func TestResetConfirmConcurrent(t *testing.T) {
+	users = slowCredentials{testStore(t)}
+	if err := users.CreateCredential("ann", store.Credential{PasswordHash: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	var link string
+	err := tokens.UpdateTokens(func(authTokens map[string]store.Token) error {
+		var err error
+		link, err = store.IssueOneTimeToken(authTokens, "ann", store.PurposeResetPassword, time.Hour)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	passwords := []string{"First-Passw0rd!", "Second-Passw0rd!"}
+	codes := make([]int, len(passwords))
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, password := range passwords {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, _ := json.Marshal(ResetConfirm{Token: link, Password: password})
+			<-start
+			w := httptest.NewRecorder()
+			ResetConfirmHandler(w, httptest.NewRequest(http.MethodPost, "/reset/confirm", strings.NewReader(string(body))))
+			codes[i] = w.Code
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	ok, rejected := 0, 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusOK:
+			ok++
+		case http.StatusBadRequest:
+			rejected++
+		}
+	}
+	if ok != 1 || rejected != 1 {
+		t.Fatalf("status codes %v, want one 200 and one 400", codes)
+	}
+
+	// The password saved is the one of the request that was accepted
+	credential, err := users.GetCredential("ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	winner := passwords[0]
+	if codes[1] == http.StatusOK {
+		winner = passwords[1]
+	}
+	if !checkPassword(credential, winner) {
+		t.Errorf("saved password is not %q", winner)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"example.com/m/store"
+	"example.com/m/svcauth"
+	"example.com/m/token"
+)
+
+// Session is an active login as listed by /sessions
+type Session struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	ExpiresAt time.Time `json:"expires_at"`
+	UserAgent string    `json:"user_agent"`
+	ClientIP  string    `json:"client_ip"`
+	// ClientID names the OAuth client the session was granted to, if any
+	ClientID string `json:"client_id,omitempty"`
+	// Current marks the session of the token used for the request
+	Current bool `json:"current"`
+}
+
+// clientIP returns the address of the client that logged in. Requests made by
+// the webserver on behalf of a browser carry it in X-Forwarded-For, which is
+// only believed when a trusted service signed the request.
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" && svcauth.Caller(r) != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// userSessions returns the active sessions of a user, newest first
+func userSessions(authTokens map[string]store.Token, username, currentSession string) []Session {
+	now := time.Now()
+	sessions := []Session{}
+	for _, record := range authTokens {
+		if !record.IsAuth() || record.Username != username || record.RevokedAt != nil || record.Expired(now) {
+			continue
+		}
+		sessions = append(sessions, Session{
+			ID:        record.SessionID,
+			CreatedAt: record.CreatedAt,
+			LastSeen:  record.LastSeen,
+			ExpiresAt: record.ExpiresAt,
+			UserAgent: record.UserAgent,
+			ClientIP:  record.ClientIP,
+			ClientID:  record.ClientID,
+			Current:   record.SessionID == currentSession,
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
+	})
+	return sessions
+}
+
+// revokeSession revokes the active token of a user's session. It reports
+// whether the session was found.
+func revokeSession(authTokens map[string]store.Token, username, sessionID string) bool {
+	found := false
+	for id, record := range authTokens {
+		if record.IsAuth() && record.Username == username && record.SessionID == sessionID && record.RevokedAt == nil {
+			store.RevokeToken(authTokens, id)
+			found = true
+		}
+	}
+	return found
+}
+
+// authenticateSession verifies the request's auth token and marks its
+// session as seen
+func authenticateSession(w http.ResponseWriter, r *http.Request, update func(authTokens map[string]store.Token, claims *token.Claims) error) bool {
+	claims, err := parseAuthToken(r)
+	if err != nil {
+		writeTokenError(w, err)
+		logger.Println("Session request rejected:", err)
+		return false
+	}
+
+	err = tokens.UpdateTokens(func(authTokens map[string]store.Token) error {
+		if err := checkTokenRecord(authTokens, claims); err != nil {
+			return err
+		}
+		record := authTokens[claims.ID]
+		record.LastSeen = time.Now().UTC()
+		authTokens[claims.ID] = record
+		return update(authTokens, claims)
+	})
+	if err != nil {
+		if err == errSessionNotFound {
+			http.Error(w, "Session not found", http.StatusNotFound)
+		} else {
+			writeTokenError(w, err)
+		}
+		logger.Printf("Session request failed for user %s: %v\n", claims.Subject, err)
+		return false
+	}
+	return true
+}
+
+// SessionsHandler lists the caller's active sessions (GET) or revokes all of
+// them, including the current one (DELETE)
+func SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var username string
+		var sessions []Session
+		ok := authenticateSession(w, r, func(authTokens map[string]store.Token, claims *token.Claims) error {
+			username = claims.Subject
+			sessions = userSessions(authTokens, claims.Subject, claims.SessionID)
+			return nil
+		})
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sessions)
+		logger.Println("Sessions listed for user:", username)
+	case http.MethodDelete:
+		var username string
+		ok := authenticateSession(w, r, func(authTokens map[string]store.Token, claims *token.Claims) error {
+			username = claims.Subject
+			store.RevokeUserTokens(authTokens, claims.Subject)
+			return nil
+		})
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "All sessions revoked"})
+		logger.Println("All sessions revoked for user:", username)
+	default:
+		http.Error(w, "Only GET and DELETE methods are allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+	}
+}
+
+// SessionHandler revokes a single session of the caller, /sessions/{id}
+func SessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Only DELETE method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	sessionID := strings.TrimPrefix(r.URL.Path, "/sessions/")
+	if sessionID == "" || strings.Contains(sessionID, "/") {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		logger.Println("Invalid session ID in URL:", r.URL.Path)
+		return
+	}
+
+	var username string
+	ok := authenticateSession(w, r, func(authTokens map[string]store.Token, claims *token.Claims) error {
+		username = claims.Subject
+		if !revokeSession(authTokens, claims.Subject, sessionID) {
+			return errSessionNotFound
+		}
+		return nil
+	})
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Session revoked"})
+	logger.Printf("Session %s revoked for user %s\n", sessionID, username)
+}
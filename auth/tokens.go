@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"example.com/m/authz"
+	"example.com/m/store"
+	"example.com/m/token"
+)
+
+var (
+	errTokenRevoked    = errors.New("auth token revoked")
+	errSessionNotFound = errors.New("session not found")
+)
+
+// keyring signs the issued tokens
+var keyring *Keyring
+
+// issueAuthToken signs a new token in the session described by session and
+// records it. A session without an ID is a new session. The token carries
+// the user's roles; callers load the user before updating the tokens, as the
+// stores may share one database.
+func issueAuthToken(authTokens map[string]store.Token, session store.Token, roles []string) (string, store.Token, error) {
+	return issueToken(authTokens, session, token.ScopeProfile, roles, tokenTTL)
+}
+
+// issueToken signs and records a token with the given scope, roles and
+// lifetime. Tokens of sessions with a ClientID are issued to that OAuth
+// client.
+func issueToken(authTokens map[string]store.Token, session store.Token, scope string, roles []string, ttl time.Duration) (string, store.Token, error) {
+	key, err := keyring.SigningKey()
+	if err != nil {
+		return "", store.Token{}, err
+	}
+
+	now := time.Now().UTC()
+	record := session
+	if record.SessionID == "" {
+		record.SessionID = generateAuthToken()
+		record.CreatedAt = now
+	}
+	record.IssuedAt = now
+	record.ExpiresAt = now.Add(ttl)
+	record.LastSeen = now
+	record.RevokedAt = nil
+
+	claims := token.Claims{
+		Subject:   record.Username,
+		ID:        generateAuthToken(),
+		SessionID: record.SessionID,
+		IssuedAt:  record.IssuedAt.Unix(),
+		ExpiresAt: record.ExpiresAt.Unix(),
+		Scope:     scope,
+		ClientID:  record.ClientID,
+		Roles:     roles,
+	}
+	raw, err := token.Sign(claims, key)
+	if err != nil {
+		return "", store.Token{}, err
+	}
+
+	authTokens[claims.ID] = record
+	return raw, record, nil
+}
+
+// newTokenResponse builds the response returned when a token is issued
+func newTokenResponse(authToken string, record store.Token, message string) TokenResponse {
+	return TokenResponse{
+		AuthToken: authToken,
+		ExpiresAt: record.ExpiresAt,
+		ExpiresIn: int64(time.Until(record.ExpiresAt).Seconds()),
+		Message:   message,
+		Username:  record.Username,
+	}
+}
+
+// parseAuthToken verifies the signature of the token in the request and that
+// it belongs to the user named in the username header, if one is sent
+func parseAuthToken(r *http.Request) (*token.Claims, error) {
+	var claims token.Claims
+	err := token.Parse(r.Header.Get("Authorization"), keyring, &claims)
+	if err != nil && err != token.ErrExpired {
+		return nil, err
+	}
+	if username := r.Header.Get("username"); username != "" && username != claims.Subject {
+		return nil, token.ErrSignature
+	}
+	return &claims, err
+}
+
+// checkTokenRecord makes sure a token has not been revoked. Tokens issued to
+// OAuth clients are refused, they are not a login to the site.
+func checkTokenRecord(authTokens map[string]store.Token, claims *token.Claims) error {
+	record, ok := authTokens[claims.ID]
+	if !ok || !record.IsAuth() || record.RevokedAt != nil || record.Username != claims.Subject || record.ClientID != "" {
+		return errTokenRevoked
+	}
+	return nil
+}
+
+// authenticateRequest verifies the request's auth token and that it was not
+// revoked. Otherwise it writes the error response and returns nil.
+func authenticateRequest(w http.ResponseWriter, r *http.Request) *token.Claims {
+	claims, err := parseAuthToken(r)
+	if err == nil {
+		var authTokens map[string]store.Token
+		if authTokens, err = tokens.Tokens(); err == nil {
+			err = checkTokenRecord(authTokens, claims)
+		}
+	}
+	if err != nil {
+		writeTokenError(w, err)
+		logger.Println("Request rejected:", err)
+		return nil
+	}
+	return claims
+}
+
+// writeTokenError maps a token validation error to a response
+func writeTokenError(w http.ResponseWriter, err error) {
+	switch err {
+	case token.ErrExpired:
+		http.Error(w, "Auth token expired", http.StatusUnauthorized)
+	case errTokenRevoked, token.ErrMalformed, token.ErrSignature, token.ErrUnknownKey,
+		token.ErrKeyNotActive, token.ErrUnsupported:
+		http.Error(w, "Invalid authentication credentials", http.StatusUnauthorized)
+	default:
+		http.Error(w, "Error updating auth tokens", http.StatusInternalServerError)
+	}
+}
+
+// RefreshHandler rotates a valid auth token, returning a new one with a fresh
+// lifetime. The presented token is revoked.
+func RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	claims, err := parseAuthToken(r)
+	if err != nil {
+		writeTokenError(w, err)
+		logger.Println("Token refresh rejected:", err)
+		return
+	}
+	// Pick up role changes made since the token was issued
+	account, err := users.GetUser(claims.Subject)
+	if err == store.ErrNotFound {
+		writeTokenError(w, errTokenRevoked)
+		logger.Println("Token refresh rejected, user not found:", claims.Subject)
+		return
+	} else if err != nil {
+		http.Error(w, "Error loading user store", http.StatusInternalServerError)
+		logger.Println("Error loading user store:", err)
+		return
+	}
+
+	var authToken string
+	var record store.Token
+	err = tokens.UpdateTokens(func(authTokens map[string]store.Token) error {
+		if err := checkTokenRecord(authTokens, claims); err != nil {
+			return err
+		}
+		session := authTokens[claims.ID]
+		store.RevokeToken(authTokens, claims.ID)
+
+		var err error
+		authToken, record, err = issueAuthToken(authTokens, session, authz.Effective(account.Roles))
+		return err
+	})
+	if err != nil {
+		writeTokenError(w, err)
+		logger.Printf("Token refresh failed for user %s: %v\n", claims.Subject, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newTokenResponse(authToken, record, "Token refreshed"))
+	logger.Println("Token refreshed for user:", claims.Subject)
+}
+
+// LogoutHandler revokes the presented auth token
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	// An expired token may still be revoked, it only has to be genuine
+	claims, err := parseAuthToken(r)
+	if err != nil && err != token.ErrExpired {
+		writeTokenError(w, err)
+		logger.Println("Logout rejected:", err)
+		return
+	}
+
+	err = tokens.UpdateTokens(func(authTokens map[string]store.Token) error {
+		store.RevokeToken(authTokens, claims.ID)
+		return nil
+	})
+	if err != nil {
+		writeTokenError(w, err)
+		logger.Printf("Logout failed for user %s: %v\n", claims.Subject, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out"})
+	logger.Println("Auth token revoked for user:", claims.Subject)
+}
+
+// RevocationsHandler lists revoked tokens that have not expired yet, for
+// services that verify tokens locally
+func RevocationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	authTokens, err := tokens.Tokens()
+	if err != nil {
+		http.Error(w, "Error loading auth tokens", http.StatusInternalServerError)
+		logger.Println("Error loading auth tokens:", err)
+		return
+	}
+
+	now := time.Now()
+	list := token.RevocationList{Revoked: []token.Revocation{}}
+	for id, record := range authTokens {
+		if record.IsAuth() && record.RevokedAt != nil && !record.Expired(now) {
+			list.Revoked = append(list.Revoked, token.Revocation{ID: id, ExpiresAt: record.ExpiresAt.Unix()})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
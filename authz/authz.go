@@ -0,0 +1,122 @@
+// Package authz holds the user roles and the authorization checks shared by
+// the services.
+//
+// Roles are stored with each user and copied into the auth tokens the auth
+// service issues, so services check them locally without asking anyone.
+// They are ordered: an admin may do everything a user may, a user everything
+// a readonly user may. Users without roles are plain users.
+package authz
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"example.com/m/token"
+)
+
+// Roles, from most to least privileged
+const (
+	// RoleAdmin manages all accounts and the site's data
+	RoleAdmin = "admin"
+	// RoleUser manages their own account
+	RoleUser = "user"
+	// RoleReadonly can only read, including their own account
+	RoleReadonly = "readonly"
+)
+
+// rank orders the roles, higher ranks include the lower ones
+var rank = map[string]int{
+	RoleReadonly: 1,
+	RoleUser:     2,
+	RoleAdmin:    3,
+}
+
+// Valid reports whether role is one of the known roles
+func Valid(role string) bool {
+	return rank[role] > 0
+}
+
+// Effective returns the roles a user with the stored roles has: users
+// without roles are plain users
+func Effective(roles []string) []string {
+	if len(roles) == 0 {
+		return []string{RoleUser}
+	}
+	return roles
+}
+
+// HasRole reports whether roles grant role, directly or through a more
+// privileged role. Unknown roles grant nothing.
+func HasRole(roles []string, role string) bool {
+	for _, r := range Effective(roles) {
+		if rank[r] > 0 && rank[r] >= rank[role] {
+			return true
+		}
+	}
+	return false
+}
+
+// Verifier checks an auth token and returns its claims, like
+// token.RemoteKeySet
+type Verifier interface {
+	Verify(raw string) (*token.Claims, error)
+}
+
+// Authorizer checks the auth token of requests and the roles it carries
+type Authorizer struct {
+	Verifier Verifier
+	Logger   *log.Logger
+}
+
+type contextKey struct{}
+
+// Authenticate verifies the auth token in the Authorization header. When a
+// username header is sent the token must belong to that user. Tokens of
+// OAuth clients are refused, they are not a login to the site. On failure the
+// error response is written and nil is returned.
+func (a *Authorizer) Authenticate(w http.ResponseWriter, r *http.Request) *token.Claims {
+	authKey := r.Header.Get("Authorization")
+	if authKey == "" {
+		http.Error(w, "Missing auth_key in headers", http.StatusUnauthorized)
+		a.Logger.Println("Missing auth_key in headers")
+		return nil
+	}
+
+	claims, err := a.Verifier.Verify(authKey)
+	if err == token.ErrExpired {
+		http.Error(w, "Auth token expired", http.StatusUnauthorized)
+		a.Logger.Printf("Expired auth token for user: %s\n", claims.Subject)
+		return nil
+	}
+	username := r.Header.Get("username")
+	if err != nil || (username != "" && claims.Subject != username) || !claims.HasScope(token.ScopeProfile) || claims.ClientID != "" {
+		http.Error(w, "Invalid authentication credentials", http.StatusUnauthorized)
+		a.Logger.Printf("Invalid auth credentials for user %s: %v\n", username, err)
+		return nil
+	}
+	return claims
+}
+
+// Require wraps next so it is only called for requests whose auth token
+// grants role. The token's claims are available to next through Claims.
+func (a *Authorizer) Require(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims := a.Authenticate(w, r)
+		if claims == nil {
+			return
+		}
+		if !HasRole(claims.Roles, role) {
+			http.Error(w, "Role "+role+" required", http.StatusForbidden)
+			a.Logger.Printf("User %s lacks role %s for %s %s\n", claims.Subject, role, r.Method, r.URL.Path)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, claims)))
+	}
+}
+
+// Claims returns the claims of a request that passed Require, or nil
+func Claims(r *http.Request) *token.Claims {
+	claims, _ := r.Context().Value(contextKey{}).(*token.Claims)
+	return claims
+}
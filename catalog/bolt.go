@@ -0,0 +1,239 @@
+package catalog
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	productsBucket   = []byte("products")
+	categoriesBucket = []byte("categories")
+)
+
+// BoltCatalog keeps the products in an embedded bbolt database, keyed by
+// big-endian ID so they are read in ID order, and the categories by their
+// IDs. The products bucket's sequence gives out the IDs. Only productlist
+// uses the database, so unlike the user store it stays open.
+type BoltCatalog struct {
+	db *bolt.DB
+}
+
+// NewBoltCatalog opens the database at path, creating it if needed
+func NewBoltCatalog(path string) (*BoltCatalog, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{productsBucket, categoriesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltCatalog{db: db}, nil
+}
+
+// Close closes the database
+func (c *BoltCatalog) Close() error {
+	return c.db.Close()
+}
+
+func productKey(id int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+func getProduct(b *bolt.Bucket, id int) (Product, error) {
+	data := b.Get(productKey(id))
+	if data == nil {
+		return Product{}, ErrNotFound
+	}
+	var product Product
+	err := json.Unmarshal(data, &product)
+	return product, err
+}
+
+func putProduct(b *bolt.Bucket, product Product) error {
+	data, err := json.Marshal(product)
+	if err != nil {
+		return err
+	}
+	return b.Put(productKey(product.ID), data)
+}
+
+func (c *BoltCatalog) List() ([]Product, error) {
+	products := []Product{}
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(productsBucket).ForEach(func(_, data []byte) error {
+			var product Product
+			if err := json.Unmarshal(data, &product); err != nil {
+				return err
+			}
+			products = append(products, product)
+			return nil
+		})
+	})
+	return products, err
+}
+
+func (c *BoltCatalog) Get(id int) (Product, error) {
+	var product Product
+	err := c.db.View(func(tx *bolt.Tx) error {
+		var err error
+		product, err = getProduct(tx.Bucket(productsBucket), id)
+		return err
+	})
+	return product, err
+}
+
+func (c *BoltCatalog) Create(product Product) (Product, error) {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(productsBucket)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		product = created(product, int(id), time.Now().UTC())
+		return putProduct(b, product)
+	})
+	return product, err
+}
+
+func (c *BoltCatalog) Update(product Product, version int) (Product, error) {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(productsBucket)
+		current, err := getProduct(b, product.ID)
+		if err != nil {
+			return err
+		}
+		if product, err = updated(current, product, version, time.Now().UTC()); err != nil {
+			return err
+		}
+		return putProduct(b, product)
+	})
+	return product, err
+}
+
+func (c *BoltCatalog) Delete(id, version int) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(productsBucket)
+		current, err := getProduct(b, id)
+		if err != nil {
+			return err
+		}
+		if current.Version != version {
+			return ErrVersionConflict
+		}
+		return b.Delete(productKey(id))
+	})
+}
+
+func (c *BoltCatalog) Import(products []Product) (int, error) {
+	added := 0
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(productsBucket)
+		now := time.Now().UTC()
+		for _, product := range products {
+			if product.ID <= 0 || b.Get(productKey(product.ID)) != nil {
+				continue
+			}
+			if err := putProduct(b, imported(product, now)); err != nil {
+				return err
+			}
+			// Keep the sequence past imported IDs so Create does not reuse them
+			if uint64(product.ID) > b.Sequence() {
+				if err := b.SetSequence(uint64(product.ID)); err != nil {
+					return err
+				}
+			}
+			added++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return added, nil
+}
+
+// loadCategories returns the categories by ID
+func loadCategories(tx *bolt.Tx) (map[string]Category, error) {
+	categories := make(map[string]Category)
+	err := tx.Bucket(categoriesBucket).ForEach(func(id, data []byte) error {
+		var category Category
+		if err := json.Unmarshal(data, &category); err != nil {
+			return err
+		}
+		categories[string(id)] = category
+		return nil
+	})
+	return categories, err
+}
+
+func (c *BoltCatalog) Categories() ([]Category, error) {
+	categories := []Category{}
+	err := c.db.View(func(tx *bolt.Tx) error {
+		byID, err := loadCategories(tx)
+		for _, category := range byID {
+			categories = append(categories, category)
+		}
+		return err
+	})
+	sortCategories(categories)
+	return categories, err
+}
+
+func (c *BoltCatalog) SaveCategory(category Category) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		categories, err := loadCategories(tx)
+		if err != nil {
+			return err
+		}
+		if err := checkParent(category, categories); err != nil {
+			return err
+		}
+		data, err := json.Marshal(category)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(categoriesBucket).Put([]byte(category.ID), data)
+	})
+}
+
+func (c *BoltCatalog) DeleteCategory(id string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		categories, err := loadCategories(tx)
+		if err != nil {
+			return err
+		}
+		if _, ok := categories[id]; !ok {
+			return ErrCategoryNotFound
+		}
+		var products []Product
+		err = tx.Bucket(productsBucket).ForEach(func(_, data []byte) error {
+			var product Product
+			if err := json.Unmarshal(data, &product); err != nil {
+				return err
+			}
+			products = append(products, product)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := checkUnused(id, categories, products); err != nil {
+			return err
+		}
+		return tx.Bucket(categoriesBucket).Delete([]byte(id))
+	})
+}
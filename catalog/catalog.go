@@ -0,0 +1,218 @@
+// Package catalog holds the products served by the productlist service
+// behind the Catalog interface. Like the user store, the backend is chosen by
+// configuration: a JSON file or an embedded bbolt database.
+//
+// Every product carries a version that is incremented on each change.
+// Updates and deletes name the version they were based on and fail with
+// ErrVersionConflict if the product changed in the meantime, so concurrent
+// edits do not overwrite each other.
+package catalog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"example.com/m/money"
+)
+
+var (
+	// ErrNotFound is returned when a product does not exist
+	ErrNotFound = errors.New("catalog: product not found")
+	// ErrVersionConflict is returned when a product was changed since the
+	// version an update or delete was based on
+	ErrVersionConflict = errors.New("catalog: product was changed")
+)
+
+// Product is an item of the catalog. In JSON the price is price_minor and
+// currency, and price holds it formatted for display as before prices had a
+// currency, see MarshalJSON.
+type Product struct {
+	ID          int         `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Price       money.Money `json:"-"`
+	// Category is the ID of the product's category, if it has one
+	Category string `json:"category,omitempty"`
+	// Tags are free-form lower case keywords
+	Tags []string `json:"tags,omitempty"`
+	// Link is the product's path in the productlist API
+	Link string `json:"link"`
+	// Version starts at 1 and is incremented on every change
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SampleProducts are the products productlist served before it had a
+// catalog, imported by its -seed flag along with SampleCategories
+var SampleProducts = []Product{
+	{ID: 1, Name: "Product 1", Price: money.Money{Amount: 10000, Currency: "USD"}, Category: "hardware", Tags: []string{"starter"}},
+	{ID: 2, Name: "Product 2", Price: money.Money{Amount: 15000, Currency: "USD"}, Category: "hardware"},
+	{ID: 3, Name: "Product 3", Price: money.Money{Amount: 20000, Currency: "USD"}, Category: "software", Tags: []string{"starter"}},
+	{ID: 4, Name: "Product 4", Price: money.Money{Amount: 25000, Currency: "USD"}, Category: "support"},
+	{ID: 5, Name: "Product 5", Price: money.Money{Amount: 30000, Currency: "USD"}, Category: "training"},
+}
+
+// productAlias has the fields of Product without its JSON methods
+type productAlias Product
+
+// productJSON is the JSON form of a Product
+type productJSON struct {
+	productAlias
+	// Price is the display text, the only price field of older clients and
+	// of products stored before prices had a currency
+	Price      string `json:"price"`
+	PriceMinor *int64 `json:"price_minor"`
+	Currency   string `json:"currency"`
+}
+
+// MarshalJSON writes the price as price_minor and currency, and as display
+// text in price for clients that only know that field
+func (p Product) MarshalJSON() ([]byte, error) {
+	return json.Marshal(productJSON{
+		productAlias: productAlias(p),
+		Price:        p.Price.String(),
+		PriceMinor:   &p.Price.Amount,
+		Currency:     p.Price.Currency,
+	})
+}
+
+// UnmarshalJSON reads the price from price_minor and currency, or parses the
+// display text in price if they are missing
+func (p *Product) UnmarshalJSON(data []byte) error {
+	var v productJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*p = Product(v.productAlias)
+	switch {
+	case v.PriceMinor != nil && v.Currency != "":
+		price, err := money.New(*v.PriceMinor, v.Currency)
+		if err != nil {
+			return fmt.Errorf("catalog: product %d: %w", p.ID, err)
+		}
+		p.Price = price
+	case v.Price != "":
+		price, err := money.Parse(v.Price)
+		if err != nil {
+			return fmt.Errorf("catalog: product %d: %w", p.ID, err)
+		}
+		p.Price = price
+	}
+	return nil
+}
+
+// Catalog stores products by ID
+type Catalog interface {
+	// List returns all products ordered by ID
+	List() ([]Product, error)
+	Get(id int) (Product, error)
+	// Create stores a new product under the next free ID, with version 1
+	Create(product Product) (Product, error)
+	// Update replaces the product with product.ID if it is still at
+	// version, and returns it with the next version
+	Update(product Product, version int) (Product, error)
+	// Delete removes the product if it is still at version
+	Delete(id, version int) error
+	// Import stores products under their own IDs, skipping IDs that are
+	// taken, and returns how many were added
+	Import(products []Product) (int, error)
+
+	// Categories returns all categories ordered by ID
+	Categories() ([]Category, error)
+	// SaveCategory creates or replaces a category. Its parent must exist,
+	// otherwise ErrCategoryParent is returned.
+	SaveCategory(category Category) error
+	// DeleteCategory removes a category without subcategories and products,
+	// otherwise ErrCategoryInUse is returned
+	DeleteCategory(id string) error
+}
+
+// Config selects and configures the catalog backend
+type Config struct {
+	// Backend is "json" or "bolt"
+	Backend string
+	// Dir is the directory holding products.json or the database
+	Dir string
+}
+
+// ConfigFromEnv reads the configuration from CATALOG_BACKEND and CATALOG_DIR
+func ConfigFromEnv() Config {
+	cfg := Config{Backend: os.Getenv("CATALOG_BACKEND"), Dir: os.Getenv("CATALOG_DIR")}
+	if cfg.Backend == "" {
+		cfg.Backend = "json"
+	}
+	if cfg.Dir == "" {
+		cfg.Dir = "/app/catalog_data"
+	}
+	return cfg
+}
+
+// Open returns the catalog of the configured backend
+func Open(cfg Config) (Catalog, error) {
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+	switch cfg.Backend {
+	case "json":
+		return NewJSONCatalog(cfg.Dir + "/products.json")
+	case "bolt":
+		return NewBoltCatalog(cfg.Dir + "/catalog.db")
+	default:
+		return nil, fmt.Errorf("catalog: unknown backend %q", cfg.Backend)
+	}
+}
+
+// Link returns the API path of the product with id
+func Link(id int) string {
+	return "/products/" + strconv.Itoa(id)
+}
+
+// created fills in the fields of a product stored for the first time
+func created(product Product, id int, now time.Time) Product {
+	product.ID = id
+	product.Link = Link(id)
+	product.Version = 1
+	product.CreatedAt = now
+	product.UpdatedAt = now
+	return product
+}
+
+// updated returns product as the next version of current
+func updated(current, product Product, version int, now time.Time) (Product, error) {
+	if current.Version != version {
+		return Product{}, ErrVersionConflict
+	}
+	product.Link = current.Link
+	product.Version = current.Version + 1
+	product.CreatedAt = current.CreatedAt
+	product.UpdatedAt = now
+	return product, nil
+}
+
+// imported fills in the fields of a product imported under its own ID, it
+// keeps a version and creation time it already has
+func imported(product Product, now time.Time) Product {
+	product.Link = Link(product.ID)
+	if product.Version == 0 {
+		product.Version = 1
+	}
+	if product.CreatedAt.IsZero() {
+		product.CreatedAt = now
+	}
+	if product.UpdatedAt.IsZero() {
+		product.UpdatedAt = product.CreatedAt
+	}
+	return product
+}
+
+func sortByID(products []Product) {
+	sort.Slice(products, func(i, j int) bool {
+		return products[i].ID < products[j].ID
+	})
+}
@@ -0,0 +1,140 @@
+package catalog
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrCategoryNotFound is returned when a category does not exist
+	ErrCategoryNotFound = errors.New("catalog: category not found")
+	// ErrCategoryParent is returned for a category whose parent does not
+	// exist or is the category itself or one of its subcategories
+	ErrCategoryParent = errors.New("catalog: invalid parent category")
+	// ErrCategoryInUse is returned when deleting a category that still has
+	// subcategories or products
+	ErrCategoryInUse = errors.New("catalog: category has subcategories or products")
+)
+
+// Category groups products. Categories form a tree through Parent, the
+// top-level categories have none.
+type Category struct {
+	// ID is a short name used in URLs, like "hardware"
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Parent string `json:"parent,omitempty"`
+}
+
+// CategoryNode is a category with its subcategories
+type CategoryNode struct {
+	Category
+	Children []CategoryNode `json:"children"`
+}
+
+// SampleCategories are the categories imported by productlist's -seed flag,
+// the products and services the webserver's pages browse
+var SampleCategories = []Category{
+	{ID: "products", Name: "Products"},
+	{ID: "hardware", Name: "Hardware", Parent: "products"},
+	{ID: "software", Name: "Software", Parent: "products"},
+	{ID: "services", Name: "Services"},
+	{ID: "support", Name: "Support", Parent: "services"},
+	{ID: "training", Name: "Training", Parent: "services"},
+}
+
+// ValidCategoryID reports whether id can name a category: lower case
+// letters, digits and '-', starting with a letter
+func ValidCategoryID(id string) bool {
+	if id == "" || len(id) > 64 || id[0] < 'a' || id[0] > 'z' {
+		return false
+	}
+	return strings.Trim(id, "abcdefghijklmnopqrstuvwxyz0123456789-") == ""
+}
+
+// checkParent makes sure the category's parent exists and saving it does not
+// make a cycle
+func checkParent(category Category, categories map[string]Category) error {
+	for parent := category.Parent; parent != ""; parent = categories[parent].Parent {
+		if _, ok := categories[parent]; !ok || parent == category.ID {
+			return ErrCategoryParent
+		}
+	}
+	return nil
+}
+
+// checkUnused makes sure no category or product refers to the category
+func checkUnused(id string, categories map[string]Category, products []Product) error {
+	for _, category := range categories {
+		if category.Parent == id {
+			return ErrCategoryInUse
+		}
+	}
+	for _, product := range products {
+		if product.Category == id {
+			return ErrCategoryInUse
+		}
+	}
+	return nil
+}
+
+// sortCategories orders categories by ID
+func sortCategories(categories []Category) {
+	sort.Slice(categories, func(i, j int) bool {
+		return categories[i].ID < categories[j].ID
+	})
+}
+
+// Tree returns the subcategories of parent, "" for the top-level
+// categories, with their own subcategories, ordered by name
+func Tree(categories []Category, parent string) []CategoryNode {
+	nodes := []CategoryNode{}
+	for _, category := range categories {
+		if category.Parent == parent {
+			nodes = append(nodes, CategoryNode{Category: category, Children: Tree(categories, category.ID)})
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return strings.ToLower(nodes[i].Name) < strings.ToLower(nodes[j].Name)
+	})
+	return nodes
+}
+
+// Descendants returns the IDs of the category and all its subcategories
+func Descendants(categories []Category, id string) []string {
+	ids := []string{id}
+	for _, category := range categories {
+		if category.Parent == id {
+			ids = append(ids, Descendants(categories, category.ID)...)
+		}
+	}
+	return ids
+}
+
+// Path returns the category and its parents, the top-level category first
+func Path(categories []Category, id string) []Category {
+	byID := make(map[string]Category, len(categories))
+	for _, category := range categories {
+		byID[category.ID] = category
+	}
+	var path []Category
+	for category, ok := byID[id]; ok && len(path) <= len(categories); category, ok = byID[category.Parent] {
+		path = append([]Category{category}, path...)
+	}
+	return path
+}
+
+// NormalizeTags trims and lower-cases tags and drops empty and repeated
+// ones, keeping their order
+func NormalizeTags(tags []string) []string {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized
+}
@@ -0,0 +1,189 @@
+package catalog
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"example.com/m/store"
+)
+
+// JSONCatalog keeps the products in a JSON file. Every change rewrites the
+// file atomically while holding its lock.
+type JSONCatalog struct {
+	filename string
+}
+
+// catalogDocument is the contents of the file. NextID is kept so the IDs of
+// deleted products are not given out again.
+type catalogDocument struct {
+	NextID     int                 `json:"next_id"`
+	Products   map[string]Product  `json:"products"`
+	Categories map[string]Category `json:"categories,omitempty"`
+}
+
+// NewJSONCatalog returns a catalog using the file, creating an empty one if
+// it does not exist
+func NewJSONCatalog(filename string) (*JSONCatalog, error) {
+	c := &JSONCatalog{filename: filename}
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		if err := c.update(func(*catalogDocument) error { return nil }); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *JSONCatalog) read() (catalogDocument, error) {
+	var doc catalogDocument
+	err := store.ReadJSONFile(c.filename, &doc)
+	return doc, err
+}
+
+func (c *JSONCatalog) update(fn func(doc *catalogDocument) error) error {
+	var doc catalogDocument
+	return store.UpdateJSONFile(c.filename, &doc, 0644, func() error {
+		if doc.Products == nil {
+			doc.Products = make(map[string]Product)
+		}
+		if doc.Categories == nil {
+			doc.Categories = make(map[string]Category)
+		}
+		if doc.NextID == 0 {
+			doc.NextID = 1
+		}
+		return fn(&doc)
+	})
+}
+
+func (c *JSONCatalog) List() ([]Product, error) {
+	doc, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	products := make([]Product, 0, len(doc.Products))
+	for _, product := range doc.Products {
+		products = append(products, product)
+	}
+	sortByID(products)
+	return products, nil
+}
+
+func (c *JSONCatalog) Get(id int) (Product, error) {
+	doc, err := c.read()
+	if err != nil {
+		return Product{}, err
+	}
+	product, ok := doc.Products[strconv.Itoa(id)]
+	if !ok {
+		return Product{}, ErrNotFound
+	}
+	return product, nil
+}
+
+func (c *JSONCatalog) Create(product Product) (Product, error) {
+	err := c.update(func(doc *catalogDocument) error {
+		product = created(product, doc.NextID, time.Now().UTC())
+		doc.Products[strconv.Itoa(product.ID)] = product
+		doc.NextID++
+		return nil
+	})
+	return product, err
+}
+
+func (c *JSONCatalog) Update(product Product, version int) (Product, error) {
+	err := c.update(func(doc *catalogDocument) error {
+		key := strconv.Itoa(product.ID)
+		current, ok := doc.Products[key]
+		if !ok {
+			return ErrNotFound
+		}
+		var err error
+		if product, err = updated(current, product, version, time.Now().UTC()); err != nil {
+			return err
+		}
+		doc.Products[key] = product
+		return nil
+	})
+	return product, err
+}
+
+func (c *JSONCatalog) Delete(id, version int) error {
+	return c.update(func(doc *catalogDocument) error {
+		key := strconv.Itoa(id)
+		current, ok := doc.Products[key]
+		if !ok {
+			return ErrNotFound
+		}
+		if current.Version != version {
+			return ErrVersionConflict
+		}
+		delete(doc.Products, key)
+		return nil
+	})
+}
+
+func (c *JSONCatalog) Import(products []Product) (int, error) {
+	added := 0
+	err := c.update(func(doc *catalogDocument) error {
+		now := time.Now().UTC()
+		for _, product := range products {
+			key := strconv.Itoa(product.ID)
+			if _, ok := doc.Products[key]; ok || product.ID <= 0 {
+				continue
+			}
+			doc.Products[key] = imported(product, now)
+			if product.ID >= doc.NextID {
+				doc.NextID = product.ID + 1
+			}
+			added++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return added, nil
+}
+
+func (c *JSONCatalog) Categories() ([]Category, error) {
+	doc, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	categories := make([]Category, 0, len(doc.Categories))
+	for _, category := range doc.Categories {
+		categories = append(categories, category)
+	}
+	sortCategories(categories)
+	return categories, nil
+}
+
+func (c *JSONCatalog) SaveCategory(category Category) error {
+	return c.update(func(doc *catalogDocument) error {
+		if err := checkParent(category, doc.Categories); err != nil {
+			return err
+		}
+		doc.Categories[category.ID] = category
+		return nil
+	})
+}
+
+func (c *JSONCatalog) DeleteCategory(id string) error {
+	return c.update(func(doc *catalogDocument) error {
+		if _, ok := doc.Categories[id]; !ok {
+			return ErrCategoryNotFound
+		}
+		products := make([]Product, 0, len(doc.Products))
+		for _, product := range doc.Products {
+			products = append(products, product)
+		}
+		if err := checkUnused(id, doc.Categories, products); err != nil {
+			return err
+		}
+		delete(doc.Categories, id)
+		return nil
+	})
+}
@@ -0,0 +1,198 @@
+package catalog
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sort orders of Search, prefixed with "-" for descending order
+const (
+	SortID      = "id"
+	SortName    = "name"
+	SortPrice   = "price"
+	SortCreated = "created"
+)
+
+// ErrCursor is returned for a cursor that was not made by Search or was
+// made for a different sort order
+var ErrCursor = errors.New("catalog: invalid cursor")
+
+// Query selects and orders the products returned by Search
+type Query struct {
+	// Text must occur in the name or description, each word on its own,
+	// ignoring case
+	Text string
+	// Currency keeps only the products priced in it. MinPrice and MaxPrice,
+	// in minor units of Currency, bound the price if they are set.
+	Currency string
+	MinPrice *int64
+	MaxPrice *int64
+	// Categories keeps only the products in one of these categories, see
+	// Descendants
+	Categories []string
+	// Tag keeps only the products with this tag
+	Tag string
+	// Sort is one of the sort orders, SortID if empty
+	Sort string
+	// Cursor continues after the last product of a previous page
+	Cursor string
+	// Limit is the size of the page, 0 for all products
+	Limit int
+}
+
+// Page is a page of search results
+type Page struct {
+	Products []Product
+	// Total counts the products matching the query on all pages
+	Total int
+	// Next is the cursor of the next page, "" on the last page
+	Next string
+}
+
+// cursor holds the sort keys of the last product of a page, so the next page
+// starts after it even when products were added or removed meanwhile
+type cursor struct {
+	Sort      string    `json:"s"`
+	ID        int       `json:"i"`
+	Name      string    `json:"n,omitempty"`
+	Amount    int64     `json:"a,omitempty"`
+	Currency  string    `json:"c,omitempty"`
+	CreatedAt time.Time `json:"t"`
+}
+
+// ValidSort reports whether s is a sort order of Search
+func ValidSort(s string) bool {
+	switch strings.TrimPrefix(s, "-") {
+	case SortID, SortName, SortPrice, SortCreated:
+		return true
+	}
+	return false
+}
+
+// less orders products by the sort order, then by ID so the order is total
+func less(a, b Product, order string) bool {
+	desc := strings.HasPrefix(order, "-")
+	if desc {
+		a, b = b, a
+	}
+	switch strings.TrimPrefix(order, "-") {
+	case SortName:
+		if an, bn := strings.ToLower(a.Name), strings.ToLower(b.Name); an != bn {
+			return an < bn
+		}
+	case SortPrice:
+		// Amounts of different currencies cannot be compared, prices are
+		// grouped by currency
+		if a.Price.Currency != b.Price.Currency {
+			return a.Price.Currency < b.Price.Currency
+		}
+		if a.Price.Amount != b.Price.Amount {
+			return a.Price.Amount < b.Price.Amount
+		}
+	case SortCreated:
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+	}
+	return a.ID < b.ID
+}
+
+// matches reports whether the product is selected by the query's filters
+func (q Query) matches(p Product, words []string) bool {
+	text := strings.ToLower(p.Name + " " + p.Description)
+	for _, word := range words {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	if q.Currency != "" && !strings.EqualFold(p.Price.Currency, q.Currency) {
+		return false
+	}
+	if q.MinPrice != nil && p.Price.Amount < *q.MinPrice {
+		return false
+	}
+	if q.MaxPrice != nil && p.Price.Amount > *q.MaxPrice {
+		return false
+	}
+	if q.Categories != nil && !slices.Contains(q.Categories, p.Category) {
+		return false
+	}
+	if q.Tag != "" && !slices.Contains(p.Tags, strings.ToLower(q.Tag)) {
+		return false
+	}
+	return true
+}
+
+// Search filters, sorts and pages products as the query says
+func Search(products []Product, q Query) (Page, error) {
+	if q.Sort == "" {
+		q.Sort = SortID
+	}
+	if !ValidSort(q.Sort) {
+		return Page{}, errors.New("catalog: invalid sort order " + q.Sort)
+	}
+	var after *Product
+	if q.Cursor != "" {
+		last, err := decodeCursor(q.Cursor, q.Sort)
+		if err != nil {
+			return Page{}, err
+		}
+		after = &last
+	}
+
+	words := strings.Fields(strings.ToLower(q.Text))
+	matching := []Product{}
+	for _, p := range products {
+		if q.matches(p, words) {
+			matching = append(matching, p)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		return less(matching[i], matching[j], q.Sort)
+	})
+
+	page := Page{Products: matching, Total: len(matching)}
+	if after != nil {
+		start := sort.Search(len(matching), func(i int) bool {
+			return less(*after, matching[i], q.Sort)
+		})
+		page.Products = matching[start:]
+	}
+	if q.Limit > 0 && len(page.Products) > q.Limit {
+		page.Products = page.Products[:q.Limit]
+		page.Next = encodeCursor(page.Products[q.Limit-1], q.Sort)
+	}
+	return page, nil
+}
+
+func encodeCursor(p Product, order string) string {
+	data, _ := json.Marshal(cursor{
+		Sort:      order,
+		ID:        p.ID,
+		Name:      p.Name,
+		Amount:    p.Price.Amount,
+		Currency:  p.Price.Currency,
+		CreatedAt: p.CreatedAt,
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor returns a product with the sort keys saved in the cursor
+func decodeCursor(value, order string) (Product, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return Product{}, ErrCursor
+	}
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil || c.Sort != order {
+		return Product{}, ErrCursor
+	}
+	p := Product{ID: c.ID, Name: c.Name, CreatedAt: c.CreatedAt}
+	p.Price.Amount, p.Price.Currency = c.Amount, c.Currency
+	return p, nil
+}
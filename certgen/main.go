@@ -0,0 +1,157 @@
+// Command certgen makes a certificate authority and a certificate signed by
+// it for running the services with HTTPS during development.
+//
+//	go run ./certgen -out certs
+//
+// writes ca.pem and ca-key.pem, reused when they exist, and cert.pem and
+// key.pem for the given hosts. Point TLS_CERT_FILE and TLS_KEY_FILE of the
+// services at cert.pem and key.pem and TLS_CA_FILE at ca.pem, and add ca.pem to
+// the browser's trusted authorities to open the webserver without warnings.
+// The keys are meant for local use only.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func main() {
+	out := flag.String("out", "certs", "directory to write the files to")
+	hosts := flag.String("hosts", "localhost,127.0.0.1,auth,userinfo,productlist,webserver", "comma separated host names and IP addresses of the certificate")
+	days := flag.Int("days", 365, "days the certificate is valid")
+	flag.Parse()
+
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		log.Fatalln("Error creating output directory:", err)
+	}
+	caCert, caKey, err := loadOrCreateCA(*out)
+	if err != nil {
+		log.Fatalln("Error preparing CA:", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatalln("Error generating key:", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{Organization: []string{"Development"}, CommonName: "Development server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(0, 0, *days),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range strings.Split(*hosts, ",") {
+		if host = strings.TrimSpace(host); host == "" {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		log.Fatalln("Error creating certificate:", err)
+	}
+	if err := writeCert(filepath.Join(*out, "cert.pem"), der); err != nil {
+		log.Fatalln("Error writing certificate:", err)
+	}
+	if err := writeKey(filepath.Join(*out, "key.pem"), key); err != nil {
+		log.Fatalln("Error writing key:", err)
+	}
+	fmt.Printf("Wrote %s for %s, valid for %d days\n", filepath.Join(*out, "cert.pem"), *hosts, *days)
+}
+
+// loadOrCreateCA reuses the CA in dir, so certificates made before stay
+// trusted, or creates one valid for ten years
+func loadOrCreateCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	certPEM, certErr := os.ReadFile(certFile)
+	keyPEM, keyErr := os.ReadFile(keyFile)
+	if certErr == nil && keyErr == nil {
+		certBlock, _ := pem.Decode(certPEM)
+		keyBlock, _ := pem.Decode(keyPEM)
+		if certBlock == nil || keyBlock == nil {
+			return nil, nil, errors.New("invalid PEM in " + dir)
+		}
+		cert, err := x509.ParseCertificate(certBlock.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cert, key, nil
+	}
+	if !os.IsNotExist(certErr) && certErr != nil {
+		return nil, nil, certErr
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{Organization: []string{"Development"}, CommonName: "Development CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeCert(certFile, der); err != nil {
+		return nil, nil, err
+	}
+	if err := writeKey(keyFile, key); err != nil {
+		return nil, nil, err
+	}
+	fmt.Println("Created CA", certFile)
+	return cert, key, nil
+}
+
+func serialNumber() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		log.Fatalln("Error generating serial number:", err)
+	}
+	return serial
+}
+
+func writeCert(name string, der []byte) error {
+	return os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func writeKey(name string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
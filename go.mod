@@ -1,3 +1,11 @@
 module example.com/m
 
 go 1.22.2
+
+require (
+	go.etcd.io/bbolt v1.3.10
+	golang.org/x/crypto v0.31.0
+	rsc.io/qr v0.2.0
+)
+
+require golang.org/x/sys v0.28.0 // indirect
@@ -0,0 +1,142 @@
+// Package mailer sends the emails of the services, such as the verification
+// link of a new account. The Mailer is chosen by configuration: printed to
+// stdout or appended to a file for local use, or sent through an SMTP server.
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends messages
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// WriterMailer writes each message to W in mbox-like text form. It is meant
+// for local use, the messages can be read in the service's output or a file.
+type WriterMailer struct {
+	From string
+	W    io.Writer
+
+	mu sync.Mutex
+}
+
+func (m *WriterMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := m.W.Write(append(format(m.From, msg, time.Now()), '\n'))
+	return err
+}
+
+// FileMailer appends each message to a file
+type FileMailer struct {
+	From     string
+	Filename string
+
+	mu sync.Mutex
+}
+
+func (m *FileMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, err := os.OpenFile(m.Filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(format(m.From, msg, time.Now()), '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// SMTPMailer sends messages through an SMTP server. The server's TLS
+// certificate is verified if it offers STARTTLS. Without Username no
+// authentication is attempted, which suits a local relay or test server.
+type SMTPMailer struct {
+	// Addr is the server's host:port
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		// PlainAuth refuses to send the password without TLS, except to
+		// localhost
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	return smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, format(m.From, msg, time.Now()))
+}
+
+// format renders the message with its headers, lines end in CRLF as SMTP
+// requires
+func format(from string, msg Message, date time.Time) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
+
+// FromEnv returns the mailer selected by MAILER: "stdout" (default), "file"
+// writing to MAILER_FILE, or "smtp" using SMTP_ADDR, SMTP_USERNAME and
+// SMTP_PASSWORD. MAILER_FROM sets the sender.
+func FromEnv() (Mailer, error) {
+	from := os.Getenv("MAILER_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+
+	switch kind := os.Getenv("MAILER"); kind {
+	case "", "stdout":
+		return &WriterMailer{From: from, W: os.Stdout}, nil
+	case "file":
+		filename := os.Getenv("MAILER_FILE")
+		if filename == "" {
+			filename = "/logs/mail.log"
+		}
+		return &FileMailer{From: from, Filename: filename}, nil
+	case "smtp":
+		addr := os.Getenv("SMTP_ADDR")
+		if addr == "" {
+			return nil, fmt.Errorf("mailer: SMTP_ADDR is required for MAILER=smtp")
+		}
+		return &SMTPMailer{
+			Addr:     addr,
+			From:     from,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("mailer: unknown mailer %q", kind)
+	}
+}
@@ -0,0 +1,170 @@
+package mailer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormat(t *testing.T) {
+	date := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	got := string(format("no-reply@localhost", Message{
+		To:      "ann@example.com",
+		Subject: "Confirm your email address",
+		Body:    "Hello ann,\n\nplease confirm.\r\nBye\n",
+	}, date))
+	want := "From: no-reply@localhost\r\n" +
+		"To: ann@example.com\r\n" +
+		"Subject: Confirm your email address\r\n" +
+		"Date: Fri, 01 Mar 2024 12:30:00 +0000\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"Hello ann,\r\n\r\nplease confirm.\r\nBye\r\n\r\n"
+	if got != want {
+		t.Errorf("format() =\n%q\nwant\n%q", got, want)
+	}
+}
+
+// smtpSession is what the fake SMTP server received
+type smtpSession struct {
+	auth string
+	from string
+	to   []string
+	data string
+	err  error
+}
+
+// fakeSMTP accepts one SMTP session on a local port, offering AUTH PLAIN but
+// no STARTTLS, and sends what it received on the returned channel
+func fakeSMTP(t *testing.T) (string, <-chan smtpSession) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	done := make(chan smtpSession, 1)
+	go func() {
+		var s smtpSession
+		defer func() { done <- s }()
+
+		conn, err := ln.Accept()
+		if err != nil {
+			s.err = err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+		reply("220 localhost ESMTP fake")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				s.err = err
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch {
+			case verb == "EHLO":
+				reply("250-localhost")
+				reply("250 AUTH PLAIN")
+			case strings.HasPrefix(line, "AUTH PLAIN "):
+				s.auth = strings.TrimPrefix(line, "AUTH PLAIN ")
+				reply("235 2.7.0 Authentication successful")
+			case strings.HasPrefix(line, "MAIL FROM:"):
+				s.from = strings.TrimPrefix(line, "MAIL FROM:")
+				reply("250 OK")
+			case strings.HasPrefix(line, "RCPT TO:"):
+				s.to = append(s.to, strings.TrimPrefix(line, "RCPT TO:"))
+				reply("250 OK")
+			case verb == "DATA":
+				reply("354 End data with <CR><LF>.<CR><LF>")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						s.err = err
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					// Undo the dot-stuffing of lines starting with '.'
+					data.WriteString(strings.TrimPrefix(line, "."))
+				}
+				s.data = data.String()
+				reply("250 OK queued")
+			case verb == "QUIT":
+				reply("221 Bye")
+				return
+			default:
+				reply("502 Command not implemented")
+			}
+		}
+	}()
+	return ln.Addr().String(), done
+}
+
+func TestSMTPMailer(t *testing.T) {
+	addr, sessions := fakeSMTP(t)
+	m := &SMTPMailer{Addr: addr, From: "no-reply@example.com", Username: "mailer", Password: "secret"}
+	err := m.Send(Message{
+		To:      "ann@example.com",
+		Subject: "Reset your password",
+		Body:    "Hello ann,\n.hidden line\nBye",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := <-sessions
+	if s.err != nil {
+		t.Fatal(s.err)
+	}
+	if want := base64.StdEncoding.EncodeToString([]byte("\x00mailer\x00secret")); s.auth != want {
+		t.Errorf("auth = %q, want %q", s.auth, want)
+	}
+	if s.from != "<no-reply@example.com>" {
+		t.Errorf("MAIL FROM = %q", s.from)
+	}
+	if len(s.to) != 1 || s.to[0] != "<ann@example.com>" {
+		t.Errorf("RCPT TO = %q", s.to)
+	}
+
+	headers, body, ok := strings.Cut(s.data, "\r\n\r\n")
+	if !ok {
+		t.Fatalf("no blank line after the headers in %q", s.data)
+	}
+	lines := strings.Split(headers, "\r\n")
+	wantHeaders := []string{
+		"From: no-reply@example.com",
+		"To: ann@example.com",
+		"Subject: Reset your password",
+		"", // Date, checked below
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+	}
+	if len(lines) != len(wantHeaders) {
+		t.Fatalf("headers = %q, want %d lines", lines, len(wantHeaders))
+	}
+	for i, want := range wantHeaders {
+		if want != "" && lines[i] != want {
+			t.Errorf("header %d = %q, want %q", i, lines[i], want)
+		}
+	}
+	date, ok := strings.CutPrefix(lines[3], "Date: ")
+	if _, err := time.Parse(time.RFC1123Z, date); !ok || err != nil {
+		t.Errorf("Date header = %q", lines[3])
+	}
+	if want := "Hello ann,\r\n.hidden line\r\nBye\r\n"; body != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+}
@@ -0,0 +1,154 @@
+// Package money holds amounts of money as whole minor units (cents for USD)
+// of an ISO 4217 currency, so prices can be compared, summed and sorted
+// without rounding. Amounts are only turned into text for display.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrCurrency is returned for currencies that are not supported
+	ErrCurrency = errors.New("money: unsupported currency")
+	// ErrAmount is returned for text that is not an amount of the currency
+	ErrAmount = errors.New("money: invalid amount")
+)
+
+// Currency describes how amounts of an ISO 4217 currency are written
+type Currency struct {
+	Code string
+	// Digits is the number of minor unit digits, 2 for cents
+	Digits int
+	// Symbol is written before the amount, the code is used if it is empty
+	Symbol string
+}
+
+// Currencies are the supported currencies by code
+var Currencies = map[string]Currency{
+	"USD": {Code: "USD", Digits: 2, Symbol: "$"},
+	"EUR": {Code: "EUR", Digits: 2, Symbol: "€"},
+	"GBP": {Code: "GBP", Digits: 2, Symbol: "£"},
+	"JPY": {Code: "JPY", Digits: 0, Symbol: "¥"},
+	"INR": {Code: "INR", Digits: 2, Symbol: "₹"},
+	"CHF": {Code: "CHF", Digits: 2},
+	"CAD": {Code: "CAD", Digits: 2},
+	"AUD": {Code: "AUD", Digits: 2},
+}
+
+// Money is an amount in minor units of a currency
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+// New returns amount minor units of currency
+func New(amount int64, currency string) (Money, error) {
+	currency = strings.ToUpper(currency)
+	if _, ok := Currencies[currency]; !ok {
+		return Money{}, ErrCurrency
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+// IsZero reports whether m is the zero value, which has no currency
+func (m Money) IsZero() bool {
+	return m == Money{}
+}
+
+// String formats m for display, like "$1,234.50" or "CHF 12.00". The zero
+// value is "".
+func (m Money) String() string {
+	if m.IsZero() {
+		return ""
+	}
+	c, ok := Currencies[m.Currency]
+	if !ok {
+		return strconv.FormatInt(m.Amount, 10) + " " + m.Currency
+	}
+
+	amount, sign := m.Amount, ""
+	if amount < 0 {
+		amount, sign = -amount, "-"
+	}
+	digits := strconv.FormatInt(amount, 10)
+	if len(digits) <= c.Digits {
+		digits = strings.Repeat("0", c.Digits-len(digits)+1) + digits
+	}
+	major, minor := digits[:len(digits)-c.Digits], digits[len(digits)-c.Digits:]
+	for i := len(major) - 3; i > 0; i -= 3 {
+		major = major[:i] + "," + major[i:]
+	}
+	text := major
+	if minor != "" {
+		text += "." + minor
+	}
+	if c.Symbol == "" {
+		return sign + c.Code + " " + text
+	}
+	return sign + c.Symbol + text
+}
+
+// ParseAmount reads an amount of currency in major units, like "1234.5" or
+// "1,234.50", and returns it in minor units. More decimals than the currency
+// has are refused rather than rounded.
+func ParseAmount(text, currency string) (Money, error) {
+	c, ok := Currencies[strings.ToUpper(currency)]
+	if !ok {
+		return Money{}, ErrCurrency
+	}
+	text = strings.ReplaceAll(strings.TrimSpace(text), ",", "")
+	negative := strings.HasPrefix(text, "-")
+	text = strings.TrimPrefix(text, "-")
+
+	major, minor, _ := strings.Cut(text, ".")
+	if major == "" || len(minor) > c.Digits || strings.Trim(major+minor, "0123456789") != "" {
+		return Money{}, ErrAmount
+	}
+	minor += strings.Repeat("0", c.Digits-len(minor))
+	amount, err := strconv.ParseInt(major+minor, 10, 64)
+	if err != nil {
+		return Money{}, ErrAmount
+	}
+	if negative {
+		amount = -amount
+	}
+	return Money{Amount: amount, Currency: c.Code}, nil
+}
+
+// Parse reads an amount written with a currency symbol or code, like "$100",
+// "€12.50", "CHF 20", "20.00 EUR" or "-$5.00", as String writes them and as
+// prices were stored before they had a currency.
+func Parse(text string) (Money, error) {
+	text = strings.TrimSpace(text)
+	unsigned, negative := strings.CutPrefix(text, "-")
+	m, err := parseUnsigned(strings.TrimSpace(unsigned))
+	if err != nil {
+		return Money{}, err
+	}
+	if negative {
+		// "-$-5" has two signs
+		if m.Amount < 0 {
+			return Money{}, ErrAmount
+		}
+		m.Amount = -m.Amount
+	}
+	return m, nil
+}
+
+// parseUnsigned is Parse without the leading sign
+func parseUnsigned(text string) (Money, error) {
+	for code, c := range Currencies {
+		for _, prefix := range []string{c.Symbol, code} {
+			if prefix != "" && len(text) >= len(prefix) && strings.EqualFold(text[:len(prefix)], prefix) {
+				return ParseAmount(text[len(prefix):], code)
+			}
+		}
+		if len(text) >= len(code) && strings.EqualFold(text[len(text)-len(code):], code) {
+			return ParseAmount(text[:len(text)-len(code)], code)
+		}
+	}
+	return Money{}, fmt.Errorf("%w: %q has no currency", ErrAmount, text)
+}
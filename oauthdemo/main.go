@@ -0,0 +1,282 @@
+// Command oauthdemo is a small OAuth client for trying the auth service's
+// OAuth2/OpenID Connect provider locally. It logs the user in with the
+// authorization code flow and PKCE, checks the id token and shows what the
+// userinfo endpoint returns.
+//
+// Register it as a client first (see auth/Readme.md), then run it with
+// OAUTH_CLIENT_ID and OAUTH_CLIENT_SECRET and open http://localhost:8084.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"example.com/m/tlsutil"
+	"example.com/m/token"
+)
+
+// Discovery is the part of the OpenID Connect discovery document the demo
+// uses
+type Discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// TokenGrant is the token endpoint's response
+type TokenGrant struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope"`
+	IDToken     string `json:"id_token"`
+}
+
+// IDClaims are the checked claims of an id token
+type IDClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	AuthTime  int64  `json:"auth_time"`
+	Nonce     string `json:"nonce"`
+}
+
+// Expiry returns the expiry time of the id token
+func (c IDClaims) Expiry() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+// ResultPage is what the demo shows after a login
+type ResultPage struct {
+	IDToken  string
+	UserInfo string
+	Scope    string
+	Verified string
+	Error    string
+}
+
+var (
+	clientID     = os.Getenv("OAUTH_CLIENT_ID")
+	clientSecret = os.Getenv("OAUTH_CLIENT_SECRET")
+	redirectURL  = getenv("OAUTH_REDIRECT_URL", "http://localhost:8084/callback")
+	scope        = getenv("OAUTH_SCOPE", "openid profile email")
+
+	discovery Discovery
+	keys      *token.RemoteKeySet
+)
+
+var page = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head><title>OAuth demo client</title></head>
+<body>
+<h1>OAuth demo client</h1>
+{{with .Error}}<p style="color: #b00020">{{.}}</p>{{end}}
+{{if .IDToken}}
+<h2>ID token ({{.Verified}})</h2>
+<pre>{{.IDToken}}</pre>
+<h2>Userinfo (scope {{.Scope}})</h2>
+<pre>{{.UserInfo}}</pre>
+{{end}}
+<p><a href="/login">Log in with My Website</a></p>
+</body>
+</html>
+`))
+
+func getenv(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// randomString returns a random URL safe string
+func randomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// setTempCookie keeps a value of the login in progress
+func setTempCookie(w http.ResponseWriter, name, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{Name: name, Value: value, Path: "/", HttpOnly: true, MaxAge: maxAge, SameSite: http.SameSiteLaxMode})
+}
+
+// LoginHandler starts the authorization code flow
+func LoginHandler(w http.ResponseWriter, r *http.Request) {
+	state, nonce, verifier := randomString(), randomString(), randomString()
+	for name, value := range map[string]string{"demo_state": state, "demo_nonce": nonce, "demo_verifier": verifier} {
+		setTempCookie(w, name, value, 600)
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientID},
+		"redirect_uri":          {redirectURL},
+		"scope":                 {scope},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, discovery.AuthorizationEndpoint+"?"+params.Encode(), http.StatusFound)
+}
+
+// CallbackHandler finishes the flow: it exchanges the code, checks the id
+// token and fetches the userinfo
+func CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	cookie := func(name string) string {
+		c, err := r.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		setTempCookie(w, name, "", -1)
+		return c.Value
+	}
+	state, nonce, verifier := cookie("demo_state"), cookie("demo_nonce"), cookie("demo_verifier")
+
+	query := r.URL.Query()
+	result := ResultPage{}
+	switch {
+	case query.Get("error") != "":
+		result.Error = fmt.Sprintf("Login failed: %s %s", query.Get("error"), query.Get("error_description"))
+	case state == "" || query.Get("state") != state:
+		result.Error = "The state does not match, start the login again"
+	default:
+		if err := finishLogin(query.Get("code"), nonce, verifier, &result); err != nil {
+			result.Error = err.Error()
+		}
+	}
+	if result.Error != "" {
+		log.Println("Login failed:", result.Error)
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	page.Execute(w, result)
+}
+
+func finishLogin(code, nonce, verifier string, result *ResultPage) error {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"code_verifier": {verifier},
+	}
+	// Public clients only name themselves
+	if clientSecret == "" {
+		form.Set("client_id", clientID)
+	}
+	req, _ := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if clientSecret != "" {
+		req.SetBasicAuth(clientID, clientSecret)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var oauthErr struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		json.NewDecoder(resp.Body).Decode(&oauthErr)
+		return fmt.Errorf("token request failed: %d %s %s", resp.StatusCode, oauthErr.Error, oauthErr.Description)
+	}
+	var grant TokenGrant
+	if err := json.NewDecoder(resp.Body).Decode(&grant); err != nil {
+		return fmt.Errorf("invalid token response: %v", err)
+	}
+
+	claims, verified, err := checkIDToken(grant.IDToken, nonce)
+	if err != nil {
+		return err
+	}
+	idJson, _ := json.MarshalIndent(claims, "", "  ")
+	result.IDToken = string(idJson)
+	result.Verified = verified
+	result.Scope = grant.Scope
+
+	req, _ = http.NewRequest("GET", discovery.UserinfoEndpoint, nil)
+	req.Header.Set("Authorization", "Bearer "+grant.AccessToken)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("userinfo request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var info map[string]interface{}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&info) != nil {
+		return fmt.Errorf("userinfo request failed: %d", resp.StatusCode)
+	}
+	infoJson, _ := json.MarshalIndent(info, "", "  ")
+	result.UserInfo = string(infoJson)
+	log.Printf("Logged in user %s\n", claims.Subject)
+	return nil
+}
+
+// checkIDToken checks the id token's signature against the id token keys
+// published in /keys, and its issuer, audience, expiry and nonce
+func checkIDToken(raw, nonce string) (IDClaims, string, error) {
+	var claims IDClaims
+	verified := "signature checked"
+	err := token.Parse(raw, keys, &claims)
+	switch {
+	case err != nil:
+		return claims, "", fmt.Errorf("invalid id token: %v", err)
+	case claims.Issuer != discovery.Issuer:
+		return claims, "", fmt.Errorf("id token from issuer %q, expected %q", claims.Issuer, discovery.Issuer)
+	case claims.Audience != clientID:
+		return claims, "", errors.New("id token issued to another client")
+	case claims.Nonce != nonce:
+		return claims, "", errors.New("id token nonce does not match")
+	}
+	return claims, verified, nil
+}
+
+func main() {
+	issuer := strings.TrimSuffix(getenv("OAUTH_ISSUER", "http://localhost:8082"), "/")
+	addr := getenv("OAUTH_DEMO_ADDR", ":8084")
+	if clientID == "" {
+		log.Fatalln("OAUTH_CLIENT_ID is required, register the demo as a client first")
+	}
+
+	if err := tlsutil.TrustCAFromEnv(); err != nil {
+		log.Fatalln("Error loading TLS_CA_FILE:", err)
+	}
+	resp, err := http.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		log.Fatalln("Error fetching discovery document:", err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&discovery)
+	resp.Body.Close()
+	if err != nil {
+		log.Fatalln("Error parsing discovery document:", err)
+	}
+	keys = token.NewRemoteKeySet(strings.TrimSuffix(discovery.Issuer, "/"), nil)
+	keys.Use = token.UseIDToken
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		page.Execute(w, ResultPage{})
+	})
+	http.HandleFunc("/login", LoginHandler)
+	http.HandleFunc("/callback", CallbackHandler)
+
+	log.Printf("OAuth demo client for %s at http://localhost%s\n", discovery.Issuer, addr)
+	log.Fatal(http.ListenAndServe(addr, nil))
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"example.com/m/authz"
+	"example.com/m/catalog"
+	"example.com/m/validate"
+)
+
+// CategoryDetails is a category with the categories above it, top-level
+// first, and its subcategories
+type CategoryDetails struct {
+	catalog.CategoryNode
+	Path []catalog.Category `json:"path"`
+}
+
+// CategoryInput is the body of PUT /categories/{id}
+type CategoryInput struct {
+	Name   string `json:"name"`
+	Parent string `json:"parent"`
+}
+
+// loadCategories returns all categories. Otherwise it writes the error
+// response and returns false.
+func loadCategories(w http.ResponseWriter) ([]catalog.Category, bool) {
+	categories, err := products.Categories()
+	if err != nil {
+		http.Error(w, "Error loading product catalog", http.StatusInternalServerError)
+		logger.Println("Error loading product catalog:", err)
+		return nil, false
+	}
+	return categories, true
+}
+
+// CategoriesHandler responds with the tree of all categories, GET /categories
+func CategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	categories, ok := loadCategories(w)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(catalog.Tree(categories, ""))
+	logger.Println("Category tree served")
+}
+
+// CategoryHandler responds with a category and its subcategories,
+// GET /categories/{id}, or with the products in it and its subcategories,
+// GET /categories/{id}/products, which takes the parameters of
+// GET /products
+func CategoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/categories/"), "/")
+	switch rest {
+	case "":
+	case "products":
+		query, ok := productQuery(w, r, id)
+		if !ok || !writeProductPage(w, r, query) {
+			return
+		}
+		logger.Println("Products list served for category:", id)
+		return
+	default:
+		http.NotFound(w, r)
+		logger.Println("Unknown category URL:", r.URL.Path)
+		return
+	}
+
+	categories, ok := loadCategories(w)
+	if !ok {
+		return
+	}
+	path := catalog.Path(categories, id)
+	if len(path) == 0 {
+		http.Error(w, "Category not found", http.StatusNotFound)
+		logger.Println("Category not found:", id)
+		return
+	}
+	details := CategoryDetails{
+		CategoryNode: catalog.CategoryNode{Category: path[len(path)-1], Children: catalog.Tree(categories, id)},
+		Path:         path,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(details)
+	logger.Println("Category served:", id)
+}
+
+// CategoryWriteHandler creates or replaces (PUT) or deletes (DELETE) a
+// category, /categories/{id}. Admins only. Categories with subcategories or
+// products cannot be deleted.
+func CategoryWriteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		http.Error(w, "Only GET, PUT and DELETE methods are allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/categories/")
+	if !catalog.ValidCategoryID(id) {
+		http.Error(w, "Invalid category ID, use lower case letters, digits and '-', starting with a letter", http.StatusBadRequest)
+		logger.Println("Invalid category ID in URL:", r.URL.Path)
+		return
+	}
+	admin := authz.Claims(r).Subject
+
+	if r.Method == http.MethodDelete {
+		switch err := products.DeleteCategory(id); err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+			logger.Printf("Category %s deleted by admin %s\n", id, admin)
+		case catalog.ErrCategoryNotFound:
+			http.Error(w, "Category not found", http.StatusNotFound)
+			logger.Println("Category not found:", id)
+		case catalog.ErrCategoryInUse:
+			http.Error(w, "Category has subcategories or products, move them first", http.StatusConflict)
+			logger.Println("Category in use:", id)
+		default:
+			http.Error(w, "Error updating product catalog", http.StatusInternalServerError)
+			logger.Println("Error updating product catalog:", err)
+		}
+		return
+	}
+
+	var input CategoryInput
+	if err := validate.DecodeJSON(r.Body, &input); err != nil {
+		if errs, ok := err.(validate.Errors); ok {
+			validate.WriteErrors(w, errs)
+		} else {
+			http.Error(w, "Error parsing JSON data", http.StatusBadRequest)
+		}
+		logger.Println("Error parsing JSON data:", err)
+		return
+	}
+	category := catalog.Category{ID: id, Name: strings.TrimSpace(input.Name), Parent: input.Parent}
+	var errs validate.Errors
+	switch {
+	case category.Name == "":
+		errs.Add("name", "Name is required")
+	case utf8.RuneCountInString(category.Name) > maxNameLength:
+		errs.Add("name", "Name must be at most "+strconv.Itoa(maxNameLength)+" characters long")
+	}
+	if len(errs) > 0 {
+		validate.WriteErrors(w, errs)
+		logger.Println("Invalid category:", errs)
+		return
+	}
+
+	switch err := products.SaveCategory(category); err {
+	case nil:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(category)
+		logger.Printf("Category %s saved by admin %s\n", id, admin)
+	case catalog.ErrCategoryParent:
+		validate.WriteErrors(w, validate.Errors{{Field: "parent", Message: "Parent must be an existing category other than this one and its subcategories"}})
+		logger.Println("Invalid category parent:", category.Parent)
+	default:
+		http.Error(w, "Error updating product catalog", http.StatusInternalServerError)
+		logger.Println("Error updating product catalog:", err)
+	}
+}
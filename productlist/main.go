@@ -2,35 +2,37 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"strings"
-)
+	"path/filepath"
+	"time"
 
-// Product represents the structure for a product item
-type Product struct {
-	ID    int    `json:"id"`
-	Name  string `json:"name"`
-	Price string `json:"price"`
-	Link  string `json:"link"`
-}
+	"example.com/m/authz"
+	"example.com/m/catalog"
+	"example.com/m/svcauth"
+	"example.com/m/tlsutil"
+	"example.com/m/token"
+)
 
-// Sample products data
-var products = []Product{
-	{ID: 1, Name: "Product 1", Price: "$100", Link: "/products/1"},
-	{ID: 2, Name: "Product 2", Price: "$150", Link: "/products/2"},
-	{ID: 3, Name: "Product 3", Price: "$200", Link: "/products/3"},
-	{ID: 4, Name: "Product 4", Price: "$250", Link: "/products/4"},
-	{ID: 5, Name: "Product 5", Price: "$300", Link: "/products/5"},
-}
+// products is the product catalog
+var products catalog.Catalog
 
 var (
 	// Logger for writing to the console and log file
 	logger *log.Logger
 	logFile *os.File
 )
+
+// authorizer checks the auth tokens of requests changing products, which
+// need the admin role
+var authorizer *authz.Authorizer
+
+// services authenticates the webserver's calls
+var services *svcauth.Service
+
 func HealthHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
@@ -45,7 +47,8 @@ func HealthHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 	logger.Println("Health check requested.")
 }
-// ProductsHandler handles requests to /products and responds with a list of all products
+// ProductsHandler handles requests to /products and responds with a page of
+// the products matching the search, see productQuery
 func ProductsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
@@ -53,11 +56,8 @@ func ProductsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	err := json.NewEncoder(w).Encode(products)
-	if err != nil {
-		http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
-		logger.Println("Error encoding JSON:", err)
+	query, ok := productQuery(w, r, r.URL.Query().Get("category"))
+	if !ok || !writeProductPage(w, r, query) {
 		return
 	}
 
@@ -73,34 +73,71 @@ func ProductDetailsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Extract the product ID from the URL
-	pathParts := strings.Split(r.URL.Path, "/")
-	if len(pathParts) < 3 {
+	id, ok := productID(r)
+	if !ok {
 		http.Error(w, "Invalid product ID", http.StatusBadRequest)
 		logger.Println("Invalid product ID in URL:", r.URL.Path)
 		return
 	}
 
-	// Find the product based on the ID
-	id := pathParts[2]
-	for _, product := range products {
-		if fmt.Sprintf("%d", product.ID) == id {
-			err := json.NewEncoder(w).Encode(product)
-			if err != nil {
-				http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
-				logger.Println("Error encoding JSON:", err)
-				return
-			}
-			logger.Printf("Product details served for ID: %s\n", id)
-			return
+	product, err := products.Get(id)
+	if err == catalog.ErrNotFound {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		logger.Printf("Product not found for ID: %d\n", id)
+		return
+	} else if err != nil {
+		http.Error(w, "Error loading product catalog", http.StatusInternalServerError)
+		logger.Println("Error loading product catalog:", err)
+		return
+	}
+
+	// Clients that have the current version already need not fetch it again
+	if r.Header.Get("If-None-Match") == etag(product) {
+		w.Header().Set("ETag", etag(product))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeProduct(w, http.StatusOK, product)
+	logger.Printf("Product details served for ID: %d\n", id)
+}
+
+// seedCatalog imports the sample categories and products, keeping the ones
+// that exist already
+func seedCatalog() error {
+	categories, err := products.Categories()
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for _, category := range categories {
+		existing[category.ID] = true
+	}
+	addedCategories := 0
+	for _, category := range catalog.SampleCategories {
+		if existing[category.ID] {
+			continue
 		}
+		if err := products.SaveCategory(category); err != nil {
+			return err
+		}
+		addedCategories++
 	}
 
-	// If product is not found, return a 404 error
-	http.Error(w, "Product not found", http.StatusNotFound)
-	logger.Printf("Product not found for ID: %s\n", id)
+	added, err := products.Import(catalog.SampleProducts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d of %d sample categories and %d of %d sample products\n",
+		addedCategories, len(catalog.SampleCategories), added, len(catalog.SampleProducts))
+	logger.Printf("Imported %d of %d sample categories and %d of %d sample products\n",
+		addedCategories, len(catalog.SampleCategories), added, len(catalog.SampleProducts))
+	return nil
 }
 
 func main() {
+	seed := flag.Bool("seed", false, "import the sample categories and products into the catalog, then exit")
+	flag.Parse()
+
 	// Open log file
 	var err error
 	logFile, err = os.OpenFile("/logs/productlist.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
@@ -112,11 +149,60 @@ func main() {
 
 	// Set up logger
 	logger = log.New(logFile, "", log.Ldate|log.Ltime|log.Lshortfile)
+
+	cfg := catalog.ConfigFromEnv()
+	products, err = catalog.Open(cfg)
+	if err != nil {
+		logger.Fatalln("Error opening product catalog:", err)
+	}
+	if *seed {
+		if err := seedCatalog(); err != nil {
+			logger.Fatalln("Error importing sample products:", err)
+		}
+		return
+	}
+	// Import the sample products on the first start with an empty catalog.
+	// The marker keeps a catalog the admins emptied later from being refilled.
+	marker := filepath.Join(cfg.Dir, "seeded")
+	if list, err := products.List(); err != nil {
+		logger.Fatalln("Error loading product catalog:", err)
+	} else if _, err := os.Stat(marker); os.IsNotExist(err) {
+		if len(list) == 0 {
+			if err := seedCatalog(); err != nil {
+				logger.Fatalln("Error importing sample products:", err)
+			}
+		}
+		if err := os.WriteFile(marker, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0644); err != nil {
+			logger.Println("Error writing seed marker:", err)
+		}
+	} else if len(list) == 0 {
+		logger.Println("Product catalog is empty, run productlist -seed to import the sample products")
+	}
+
+	if err := tlsutil.TrustCAFromEnv(); err != nil {
+		logger.Fatalln("Error loading TLS_CA_FILE:", err)
+	}
+	services, err = svcauth.FromEnv()
+	if err != nil {
+		logger.Fatalln("Error setting up service authentication:", err)
+	}
+	services.Logger = logger
+
+	authURL := os.Getenv("AUTH_URL")
+	if authURL == "" {
+		authURL = "http://auth:8082"
+	}
+	keys := token.NewRemoteKeySet(authURL, []byte(os.Getenv("TOKEN_HMAC_SECRET")))
+	keys.Client.Transport = &svcauth.Transport{Service: services}
+	authorizer = &authz.Authorizer{Verifier: keys, Logger: logger}
+
 	http.HandleFunc("/health", HealthHandler)
-	http.HandleFunc("/products", ProductsHandler)
-	http.HandleFunc("/products/", ProductDetailsHandler)
+	http.HandleFunc("/products", adminWrites(ProductsHandler, CreateProductHandler))
+	http.HandleFunc("/products/", adminWrites(ProductDetailsHandler, ProductWriteHandler))
+	http.HandleFunc("/categories", CategoriesHandler)
+	http.HandleFunc("/categories/", adminWrites(CategoryHandler, CategoryWriteHandler))
 
 	fmt.Println("API server running on http://productlist:8081")
 	logger.Println("API server running on http://productlist:8081")
-	log.Fatal(http.ListenAndServe(":8081", nil))
+	log.Fatal(tlsutil.ListenAndServe(":8081", services.Middleware(http.DefaultServeMux, "/health", "/products", "/products/", "/categories", "/categories/"), logger))
 }
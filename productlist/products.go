@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"example.com/m/authz"
+	"example.com/m/catalog"
+	"example.com/m/money"
+	"example.com/m/validate"
+)
+
+const (
+	// maxNameLength and maxDescriptionLength are the longest product name
+	// and description accepted
+	maxNameLength        = 100
+	maxDescriptionLength = 2000
+	// maxTags and maxTagLength limit the tags of a product
+	maxTags      = 20
+	maxTagLength = 32
+
+	// defaultLimit and maxLimit are the default and largest page sizes of
+	// GET /products
+	defaultLimit = 20
+	maxLimit     = 100
+)
+
+// ProductInput is the body of POST /products and PUT /products/{id}. The
+// price is given as price_minor and currency, or as text in price like
+// "$100" or "20.00 EUR". Version is the version a PUT is based on, if it is
+// not sent in If-Match.
+type ProductInput struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Price       string   `json:"price"`
+	PriceMinor  *int64   `json:"price_minor"`
+	Currency    string   `json:"currency"`
+	Category    string   `json:"category"`
+	Tags        []string `json:"tags"`
+	Version     int      `json:"version,omitempty"`
+}
+
+// adminWrites serves GET requests with read. Every other method changes the
+// catalog and is passed to write only if the token carries the admin role.
+func adminWrites(read, write http.HandlerFunc) http.HandlerFunc {
+	write = authorizer.Require(authz.RoleAdmin, write)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			read(w, r)
+			return
+		}
+		write(w, r)
+	}
+}
+
+// productID returns the ID of a /products/{id} URL
+func productID(r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/products/"))
+	return id, err == nil && id > 0
+}
+
+// etag returns the entity tag of a product's current version
+func etag(product catalog.Product) string {
+	return `"` + strconv.Itoa(product.Version) + `"`
+}
+
+// writeProduct responds with the product and its ETag
+func writeProduct(w http.ResponseWriter, status int, product catalog.Product) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(product))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(product)
+}
+
+// checkProduct validates the fields of a new or replaced product and returns
+// it. The category must be one of categories.
+func checkProduct(input ProductInput, categories []catalog.Category) (catalog.Product, validate.Errors) {
+	var errs validate.Errors
+	product := catalog.Product{
+		Name:        strings.TrimSpace(input.Name),
+		Description: strings.TrimSpace(input.Description),
+		Category:    input.Category,
+		Tags:        catalog.NormalizeTags(input.Tags),
+	}
+	switch {
+	case product.Name == "":
+		errs.Add("name", "Name is required")
+	case utf8.RuneCountInString(product.Name) > maxNameLength:
+		errs.Add("name", "Name must be at most "+strconv.Itoa(maxNameLength)+" characters long")
+	}
+	if utf8.RuneCountInString(product.Description) > maxDescriptionLength {
+		errs.Add("description", "Description must be at most "+strconv.Itoa(maxDescriptionLength)+" characters long")
+	}
+
+	var err error
+	switch {
+	case input.PriceMinor != nil:
+		if product.Price, err = money.New(*input.PriceMinor, input.Currency); err != nil {
+			errs.Add("currency", "Currency must be one of "+currencyCodes())
+		}
+	case strings.TrimSpace(input.Price) != "":
+		if product.Price, err = money.Parse(input.Price); err != nil {
+			errs.Add("price", "Price must be an amount with a currency, like $100 or 20.00 EUR")
+		}
+	default:
+		errs.Add("price_minor", "Price is required")
+	}
+	if err == nil && product.Price.Amount < 0 {
+		errs.Add("price_minor", "Price cannot be negative")
+	}
+
+	if product.Category != "" && len(catalog.Path(categories, product.Category)) == 0 {
+		errs.Add("category", "Unknown category")
+	}
+	if len(product.Tags) > maxTags {
+		errs.Add("tags", "At most "+strconv.Itoa(maxTags)+" tags are allowed")
+	}
+	for _, tag := range product.Tags {
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			errs.Add("tags", "Tags must be at most "+strconv.Itoa(maxTagLength)+" characters long")
+			break
+		}
+	}
+	return product, errs
+}
+
+// currencyCodes lists the supported currencies for error messages
+func currencyCodes() string {
+	codes := make([]string, 0, len(money.Currencies))
+	for code := range money.Currencies {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return strings.Join(codes, ", ")
+}
+
+// decodeProduct reads and validates the request body. Otherwise it writes the
+// error response and returns false.
+func decodeProduct(w http.ResponseWriter, r *http.Request) (catalog.Product, int, bool) {
+	var input ProductInput
+	if err := validate.DecodeJSON(r.Body, &input); err != nil {
+		if errs, ok := err.(validate.Errors); ok {
+			validate.WriteErrors(w, errs)
+		} else {
+			http.Error(w, "Error parsing JSON data", http.StatusBadRequest)
+		}
+		logger.Println("Error parsing JSON data:", err)
+		return catalog.Product{}, 0, false
+	}
+	categories, err := products.Categories()
+	if err != nil {
+		http.Error(w, "Error loading product catalog", http.StatusInternalServerError)
+		logger.Println("Error loading product catalog:", err)
+		return catalog.Product{}, 0, false
+	}
+	product, errs := checkProduct(input, categories)
+	if len(errs) > 0 {
+		validate.WriteErrors(w, errs)
+		logger.Println("Invalid product:", errs)
+		return catalog.Product{}, 0, false
+	}
+	return product, input.Version, true
+}
+
+// baseVersion returns the version a change is based on, from If-Match or
+// else from the body. Otherwise it writes the error response and returns
+// false: 428 if there is none, so blind overwrites are not possible, and 412
+// for an If-Match that is not a version of this API.
+func baseVersion(w http.ResponseWriter, r *http.Request, bodyVersion int) (int, bool) {
+	if match := r.Header.Get("If-Match"); match != "" {
+		version, err := strconv.Atoi(strings.Trim(match, `"`))
+		if err != nil {
+			http.Error(w, "Product was changed, fetch it again", http.StatusPreconditionFailed)
+			logger.Println("Invalid If-Match:", match)
+			return 0, false
+		}
+		return version, true
+	}
+	if bodyVersion > 0 {
+		return bodyVersion, true
+	}
+	http.Error(w, "If-Match header or version is required", http.StatusPreconditionRequired)
+	logger.Println("Change without a version rejected:", r.Method, r.URL.Path)
+	return 0, false
+}
+
+// writeCatalogError responds to a failed catalog change
+func writeCatalogError(w http.ResponseWriter, err error, id int) {
+	switch err {
+	case catalog.ErrNotFound:
+		http.Error(w, "Product not found", http.StatusNotFound)
+		logger.Printf("Product not found for ID: %d\n", id)
+	case catalog.ErrVersionConflict:
+		// The client fetches the product again and retries on top of it
+		if current, err := products.Get(id); err == nil {
+			w.Header().Set("ETag", etag(current))
+		}
+		http.Error(w, "Product was changed, fetch it again", http.StatusPreconditionFailed)
+		logger.Printf("Version conflict for product ID: %d\n", id)
+	default:
+		http.Error(w, "Error updating product catalog", http.StatusInternalServerError)
+		logger.Println("Error updating product catalog:", err)
+	}
+}
+
+// CreateProductHandler adds a product to the catalog, POST /products. Admins
+// only.
+func CreateProductHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	product, _, ok := decodeProduct(w, r)
+	if !ok {
+		return
+	}
+	product, err := products.Create(product)
+	if err != nil {
+		writeCatalogError(w, err, 0)
+		return
+	}
+
+	w.Header().Set("Location", product.Link)
+	writeProduct(w, http.StatusCreated, product)
+	logger.Printf("Product %d created by admin %s\n", product.ID, authz.Claims(r).Subject)
+}
+
+// ProductWriteHandler replaces (PUT) or deletes (DELETE) a product,
+// /products/{id}. Admins only. The version the change is based on is sent
+// in If-Match, as returned in the ETag of the product, or in the body's
+// version; a product changed since gets 412.
+func ProductWriteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		http.Error(w, "Only GET, PUT and DELETE methods are allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	id, ok := productID(r)
+	if !ok {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		logger.Println("Invalid product ID in URL:", r.URL.Path)
+		return
+	}
+	admin := authz.Claims(r).Subject
+
+	if r.Method == http.MethodDelete {
+		version, ok := baseVersion(w, r, 0)
+		if !ok {
+			return
+		}
+		if err := products.Delete(id, version); err != nil {
+			writeCatalogError(w, err, id)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		logger.Printf("Product %d deleted by admin %s\n", id, admin)
+		return
+	}
+
+	product, bodyVersion, ok := decodeProduct(w, r)
+	if !ok {
+		return
+	}
+	version, ok := baseVersion(w, r, bodyVersion)
+	if !ok {
+		return
+	}
+	product.ID = id
+	product, err := products.Update(product, version)
+	if err != nil {
+		writeCatalogError(w, err, id)
+		return
+	}
+
+	writeProduct(w, http.StatusOK, product)
+	logger.Printf("Product %d updated to version %d by admin %s\n", id, product.Version, admin)
+}
+
+// productQuery reads the search, filter, sort and page parameters of
+// GET /products, keeping only the products in category and its
+// subcategories if it is set. Otherwise it writes the error response and
+// returns false.
+func productQuery(w http.ResponseWriter, r *http.Request, category string) (catalog.Query, bool) {
+	params := r.URL.Query()
+	q := catalog.Query{
+		Text:     params.Get("q"),
+		Tag:      params.Get("tag"),
+		Currency: strings.ToUpper(params.Get("currency")),
+		Sort:     params.Get("sort"),
+		Cursor:   params.Get("cursor"),
+		Limit:    defaultLimit,
+	}
+	fail := func(message string) (catalog.Query, bool) {
+		http.Error(w, message, http.StatusBadRequest)
+		logger.Println("Invalid product query:", message)
+		return q, false
+	}
+
+	if q.Sort != "" && !catalog.ValidSort(q.Sort) {
+		return fail("Invalid sort, must be id, name, price or created, with - for descending order")
+	}
+	if limit := params.Get("limit"); limit != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 1 || q.Limit > maxLimit {
+			return fail("Invalid limit, must be between 1 and " + strconv.Itoa(maxLimit))
+		}
+	}
+
+	// Price bounds are in major units of the currency, USD if none is given
+	for name, bound := range map[string]**int64{"min_price": &q.MinPrice, "max_price": &q.MaxPrice} {
+		value := params.Get(name)
+		if value == "" {
+			continue
+		}
+		if q.Currency == "" {
+			q.Currency = "USD"
+		}
+		price, err := money.ParseAmount(value, q.Currency)
+		if err == money.ErrCurrency {
+			return fail("Invalid currency, must be one of " + currencyCodes())
+		} else if err != nil {
+			return fail("Invalid " + name + ", must be an amount like 100 or 99.50")
+		}
+		*bound = &price.Amount
+	}
+	if _, ok := money.Currencies[q.Currency]; q.Currency != "" && !ok {
+		return fail("Invalid currency, must be one of " + currencyCodes())
+	}
+
+	if category != "" {
+		categories, err := products.Categories()
+		if err != nil {
+			http.Error(w, "Error loading product catalog", http.StatusInternalServerError)
+			logger.Println("Error loading product catalog:", err)
+			return q, false
+		}
+		if len(catalog.Path(categories, category)) == 0 {
+			http.Error(w, "Category not found", http.StatusNotFound)
+			logger.Println("Category not found:", category)
+			return q, false
+		}
+		q.Categories = catalog.Descendants(categories, category)
+	}
+	return q, true
+}
+
+// writeProductPage responds with the page of products selected by the query
+// and reports whether it did
+func writeProductPage(w http.ResponseWriter, r *http.Request, query catalog.Query) bool {
+	list, err := products.List()
+	if err != nil {
+		http.Error(w, "Error loading product catalog", http.StatusInternalServerError)
+		logger.Println("Error loading product catalog:", err)
+		return false
+	}
+	page, err := catalog.Search(list, query)
+	if err != nil {
+		http.Error(w, "Invalid cursor, start again from the first page", http.StatusBadRequest)
+		logger.Println("Invalid product query:", err)
+		return false
+	}
+
+	setPageLinks(w, r, page)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page.Products); err != nil {
+		http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
+		logger.Println("Error encoding JSON:", err)
+		return false
+	}
+	return true
+}
+
+// setPageLinks sets the Link header with the first and next page of a
+// product listing, keeping the other query parameters
+func setPageLinks(w http.ResponseWriter, r *http.Request, page catalog.Page) {
+	link := func(cursor, rel string) string {
+		params := r.URL.Query()
+		params.Del("cursor")
+		if cursor != "" {
+			params.Set("cursor", cursor)
+		}
+		target := r.URL.Path
+		if len(params) > 0 {
+			target += "?" + params.Encode()
+		}
+		return "<" + target + `>; rel="` + rel + `"`
+	}
+
+	links := []string{link("", "first")}
+	if page.Next != "" {
+		links = append(links, link(page.Next, "next"))
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+}
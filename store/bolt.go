@@ -0,0 +1,333 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	usersBucket       = []byte("users")
+	credentialsBucket = []byte("credentials")
+	tokensBucket      = []byte("tokens")
+	metaBucket        = []byte("meta")
+
+	// usersVersionKey holds the schema version of the user records in the
+	// meta bucket, databases without it hold version 1 records
+	usersVersionKey = []byte("users_schema_version")
+)
+
+// BoltStore keeps users, credentials and tokens in an embedded bbolt
+// database, one bucket each with JSON encoded values.
+//
+// bbolt allows only one process to have a database open, and the auth and
+// userinfo services share it, so the database is opened for each operation
+// and waits for the other service to close it. Every operation therefore
+// pays for opening and mapping the file, and may wait up to boltTimeout
+// while the other service is busy. That suits the small user base of this
+// app; the json backend, which caches the decoded files, does better under
+// load.
+type BoltStore struct {
+	path string
+}
+
+// boltTimeout is how long an operation waits for the other service
+const boltTimeout = 5 * time.Second
+
+// NewBoltStore returns a store using the database at path, creating it and
+// its buckets if needed
+func NewBoltStore(path string) (*BoltStore, error) {
+	s := &BoltStore{path: path}
+	err := s.update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{usersBucket, credentialsBucket, tokensBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		// A new database starts in the current version
+		if tx.Bucket(metaBucket).Get(usersVersionKey) == nil && tx.Bucket(usersBucket).Stats().KeyN == 0 {
+			return setUsersVersion(tx, UserSchemaVersion)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *BoltStore) open() (*bolt.DB, error) {
+	return bolt.Open(s.path, 0600, &bolt.Options{Timeout: boltTimeout})
+}
+
+func (s *BoltStore) view(fn func(tx *bolt.Tx) error) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+func (s *BoltStore) update(fn func(tx *bolt.Tx) error) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+// get decodes the value stored under key in bucket into v
+func get(tx *bolt.Tx, bucket []byte, key string, v interface{}) error {
+	data := tx.Bucket(bucket).Get([]byte(key))
+	if data == nil {
+		return ErrNotFound
+	}
+	return json.Unmarshal(data, v)
+}
+
+// put stores v encoded as JSON under key in bucket
+func put(tx *bolt.Tx, bucket []byte, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucket).Put([]byte(key), data)
+}
+
+func (s *BoltStore) GetUser(name string) (User, error) {
+	var user User
+	err := s.view(func(tx *bolt.Tx) error {
+		data := tx.Bucket(usersBucket).Get([]byte(name))
+		if data == nil {
+			return ErrNotFound
+		}
+		var err error
+		user, err = decodeUser(data, usersVersion(tx), time.Now().UTC())
+		return err
+	})
+	return user, err
+}
+
+func (s *BoltStore) ListUsers() ([]User, error) {
+	users := []User{}
+	err := s.view(func(tx *bolt.Tx) error {
+		version := usersVersion(tx)
+		now := time.Now().UTC()
+		// Keys are sorted, so the list comes out ordered by name
+		return tx.Bucket(usersBucket).ForEach(func(_, data []byte) error {
+			user, err := decodeUser(data, version, now)
+			if err != nil {
+				return err
+			}
+			users = append(users, user)
+			return nil
+		})
+	})
+	return users, err
+}
+
+func (s *BoltStore) CreateUser(user User) error {
+	return s.update(func(tx *bolt.Tx) error {
+		if _, err := migrateUsers(tx); err != nil {
+			return err
+		}
+		if tx.Bucket(usersBucket).Get([]byte(user.Name)) != nil {
+			return ErrExists
+		}
+		return put(tx, usersBucket, user.Name, user)
+	})
+}
+
+func (s *BoltStore) UpdateUser(user User) error {
+	return s.update(func(tx *bolt.Tx) error {
+		if _, err := migrateUsers(tx); err != nil {
+			return err
+		}
+		if tx.Bucket(usersBucket).Get([]byte(user.Name)) == nil {
+			return ErrNotFound
+		}
+		return put(tx, usersBucket, user.Name, user)
+	})
+}
+
+func (s *BoltStore) DeleteUser(name string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		if tx.Bucket(usersBucket).Get([]byte(name)) == nil {
+			return ErrNotFound
+		}
+		if err := tx.Bucket(usersBucket).Delete([]byte(name)); err != nil {
+			return err
+		}
+		return tx.Bucket(credentialsBucket).Delete([]byte(name))
+	})
+}
+
+func (s *BoltStore) GetCredential(name string) (Credential, error) {
+	var credential Credential
+	err := s.view(func(tx *bolt.Tx) error {
+		return get(tx, credentialsBucket, name, &credential)
+	})
+	return credential, err
+}
+
+func (s *BoltStore) CreateCredential(name string, credential Credential) error {
+	return s.update(func(tx *bolt.Tx) error {
+		if tx.Bucket(credentialsBucket).Get([]byte(name)) != nil {
+			return ErrExists
+		}
+		return put(tx, credentialsBucket, name, credential)
+	})
+}
+
+func (s *BoltStore) SetCredential(name string, credential Credential) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return put(tx, credentialsBucket, name, credential)
+	})
+}
+
+func (s *BoltStore) Tokens() (map[string]Token, error) {
+	var tokens map[string]Token
+	err := s.view(func(tx *bolt.Tx) error {
+		var err error
+		tokens, err = loadTokens(tx)
+		return err
+	})
+	return tokens, err
+}
+
+func (s *BoltStore) UpdateTokens(update func(tokens map[string]Token) error) error {
+	return s.update(func(tx *bolt.Tx) error {
+		tokens, err := loadTokens(tx)
+		if err != nil {
+			return err
+		}
+		if err := update(tokens); err != nil {
+			return err
+		}
+		pruneTokens(tokens, time.Now())
+
+		// Only write the records that changed and delete the dropped ones,
+		// a login adds a single record
+		b := tx.Bucket(tokensBucket)
+		for id, t := range tokens {
+			data, err := json.Marshal(t)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(b.Get([]byte(id)), data) {
+				if err := b.Put([]byte(id), data); err != nil {
+					return err
+				}
+			}
+		}
+		var dropped [][]byte
+		err = b.ForEach(func(id, _ []byte) error {
+			if _, ok := tokens[string(id)]; !ok {
+				dropped = append(dropped, append([]byte(nil), id...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range dropped {
+			if err := b.Delete(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MigrateUsers upgrades all user records in one transaction
+func (s *BoltStore) MigrateUsers(dryRun bool) (Migration, error) {
+	var m Migration
+	fn := func(tx *bolt.Tx) error {
+		var err error
+		m, err = migrateUsers(tx)
+		return err
+	}
+	if dryRun {
+		// Changes made in a read-only transaction fail, so roll back instead
+		err := s.update(func(tx *bolt.Tx) error {
+			if err := fn(tx); err != nil {
+				return err
+			}
+			return errDryRun
+		})
+		if err != errDryRun {
+			return m, err
+		}
+		return m, nil
+	}
+	return m, s.update(fn)
+}
+
+// errDryRun rolls back the transaction of a dry run
+var errDryRun = errors.New("store: dry run")
+
+// migrateUsers rewrites the user records in the current version if they are
+// older. Writes do this first so the bucket never mixes versions.
+func migrateUsers(tx *bolt.Tx) (Migration, error) {
+	version := usersVersion(tx)
+	m := Migration{FromVersion: version, ToVersion: UserSchemaVersion, Users: []string{}}
+	if !m.Needed() {
+		return m, nil
+	}
+
+	users := make(map[string]User)
+	now := time.Now().UTC()
+	err := tx.Bucket(usersBucket).ForEach(func(name, data []byte) error {
+		user, err := decodeUser(data, version, now)
+		if err != nil {
+			return err
+		}
+		users[string(name)] = user
+		return nil
+	})
+	if err != nil {
+		return m, err
+	}
+	for name, user := range users {
+		if err := put(tx, usersBucket, name, user); err != nil {
+			return m, err
+		}
+	}
+	m.Users = sortedNames(users)
+	return m, setUsersVersion(tx, UserSchemaVersion)
+}
+
+func usersVersion(tx *bolt.Tx) int {
+	version, err := strconv.Atoi(string(tx.Bucket(metaBucket).Get(usersVersionKey)))
+	if err != nil {
+		return 1
+	}
+	return version
+}
+
+func setUsersVersion(tx *bolt.Tx, version int) error {
+	return tx.Bucket(metaBucket).Put(usersVersionKey, []byte(strconv.Itoa(version)))
+}
+
+func loadTokens(tx *bolt.Tx) (map[string]Token, error) {
+	tokens := make(map[string]Token)
+	err := tx.Bucket(tokensBucket).ForEach(func(id, data []byte) error {
+		var t Token
+		if err := json.Unmarshal(data, &t); err != nil {
+			return err
+		}
+		tokens[string(id)] = t
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	pruneTokens(tokens, time.Now())
+	return tokens, nil
+}
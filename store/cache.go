@@ -0,0 +1,124 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"maps"
+	"os"
+	"sync"
+)
+
+// fileCache holds the decoded contents of a JSON file holding an object, so
+// reads do not decode the file on every request. Each access stats the file
+// and decodes it again only when it was replaced or modified, which picks up
+// writes from the other service. Writes are atomic renames, so a new file
+// shows up as a different inode even within the mtime resolution.
+//
+// The cached map is shared and must not be modified, get returns it as is
+// and update works on a copy.
+type fileCache[V any] struct {
+	filename string
+	perm     os.FileMode
+	// decode and encode convert between the file contents and the map, by
+	// default the file holds the map as a JSON object
+	decode func(data []byte) (map[string]V, error)
+	encode func(value map[string]V) ([]byte, error)
+
+	mu    sync.Mutex
+	info  os.FileInfo
+	value map[string]V
+}
+
+func newFileCache[V any](filename string, perm os.FileMode) *fileCache[V] {
+	return &fileCache[V]{
+		filename: filename,
+		perm:     perm,
+		decode: func(data []byte) (map[string]V, error) {
+			value := make(map[string]V)
+			if len(bytes.TrimSpace(data)) == 0 {
+				return value, nil
+			}
+			err := json.Unmarshal(data, &value)
+			return value, err
+		},
+		encode: func(value map[string]V) ([]byte, error) {
+			return json.Marshal(value)
+		},
+	}
+}
+
+// get returns the current contents of the file
+func (c *fileCache[V]) get() (map[string]V, error) {
+	info, err := os.Stat(c.filename)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.info != nil && sameVersion(c.info, info) {
+		return c.value, nil
+	}
+	// The file is stat'ed before it is read, so if it is replaced in between
+	// the newer contents are cached under the older version and simply
+	// decoded again on the next access
+	data, err := os.ReadFile(c.filename)
+	if err != nil {
+		return nil, err
+	}
+	value, err := c.decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		value = make(map[string]V)
+	}
+	c.info, c.value = info, value
+	return value, nil
+}
+
+// update applies fn to a copy of the contents and writes the result, holding
+// the file's lock throughout. Nothing is written if fn fails.
+func (c *fileCache[V]) update(fn func(value map[string]V) error) error {
+	unlock, err := lockPath(c.filename)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := c.get()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	value := maps.Clone(current)
+	if value == nil {
+		value = make(map[string]V)
+	}
+	if err := fn(value); err != nil {
+		return err
+	}
+
+	data, err := c.encode(value)
+	if err != nil {
+		return err
+	}
+	if err := WriteFileAtomic(c.filename, append(data, '\n'), c.perm); err != nil {
+		return err
+	}
+
+	// No other writer can get in before the stat while the lock is held
+	info, err := os.Stat(c.filename)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.info, c.value = info, value
+	c.mu.Unlock()
+	return nil
+}
+
+// sameVersion reports whether two stats of a file show the same contents
+func sameVersion(a, b os.FileInfo) bool {
+	return os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
@@ -0,0 +1,96 @@
+package store
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileMutexes serialises the read-modify-write cycles on each file within the
+// process, the file lock does the same between processes
+var fileMutexes sync.Map
+
+// lockPath locks filename against concurrent updates from this and other
+// processes. The returned function releases the lock.
+func lockPath(filename string) (func(), error) {
+	m, _ := fileMutexes.LoadOrStore(filename, &sync.Mutex{})
+	mu := m.(*sync.Mutex)
+	mu.Lock()
+
+	unlock, err := lockFile(filename + ".lock")
+	if err != nil {
+		mu.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		mu.Unlock()
+	}, nil
+}
+
+// WriteFileAtomic writes data to a temporary file next to filename and renames
+// it into place, so readers see either the old or the new contents and never
+// a partly written file
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// ReadJSONFile decodes a JSON file into v, an empty file leaves v unchanged
+func ReadJSONFile(filename string, v interface{}) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := json.NewDecoder(file).Decode(v); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// UpdateJSONFile reads filename into v, calls update and writes v back, all
+// while holding the file's lock. Nothing is written if update fails.
+func UpdateJSONFile(filename string, v interface{}, perm os.FileMode, update func() error) error {
+	unlock, err := lockPath(filename)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := ReadJSONFile(filename, v); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := update(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(filename, append(data, '\n'), perm)
+}
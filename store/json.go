@@ -0,0 +1,187 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// JSONStore keeps users, credentials and tokens in JSON files in a directory,
+// the layout the services have always shared through /app/shared_data.
+// The decoded files are cached and only read again after they change on disk.
+type JSONStore struct {
+	users       *fileCache[User]
+	credentials *fileCache[Credential]
+	tokens      *fileCache[Token]
+}
+
+// NewJSONStore returns a store using the JSON files in dir, creating empty
+// files where they do not exist yet
+func NewJSONStore(dir string) (*JSONStore, error) {
+	s := &JSONStore{
+		users: newFileCache[User](filepath.Join(dir, "users.json"), 0666),
+		// Password hashes are only readable by the owner
+		credentials: newFileCache[Credential](filepath.Join(dir, "credentials.json"), 0600),
+		tokens:      newFileCache[Token](filepath.Join(dir, "authtokens.json"), 0666),
+	}
+	// users.json carries a schema version, older files are upgraded as they
+	// are read and written in the current version
+	s.users.decode = func(data []byte) (map[string]User, error) {
+		users, _, err := decodeUsersDocument(data, time.Now().UTC())
+		return users, err
+	}
+	s.users.encode = encodeUsersDocument
+
+	emptyUsers, err := encodeUsersDocument(map[string]User{})
+	if err != nil {
+		return nil, err
+	}
+	if err := createIfMissing(s.users.filename, emptyUsers, s.users.perm); err != nil {
+		return nil, err
+	}
+	if err := createIfMissing(s.credentials.filename, []byte("{}"), s.credentials.perm); err != nil {
+		return nil, err
+	}
+	if err := createIfMissing(s.tokens.filename, []byte("{}"), s.tokens.perm); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *JSONStore) GetUser(name string) (User, error) {
+	users, err := s.users.get()
+	if err != nil {
+		return User{}, err
+	}
+	user, ok := users[name]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+func (s *JSONStore) ListUsers() ([]User, error) {
+	users, err := s.users.get()
+	if err != nil {
+		return nil, err
+	}
+	return sortedUsers(users), nil
+}
+
+func (s *JSONStore) CreateUser(user User) error {
+	return s.users.update(func(users map[string]User) error {
+		if _, exists := users[user.Name]; exists {
+			return ErrExists
+		}
+		users[user.Name] = user
+		return nil
+	})
+}
+
+func (s *JSONStore) UpdateUser(user User) error {
+	return s.users.update(func(users map[string]User) error {
+		if _, exists := users[user.Name]; !exists {
+			return ErrNotFound
+		}
+		users[user.Name] = user
+		return nil
+	})
+}
+
+func (s *JSONStore) DeleteUser(name string) error {
+	err := s.users.update(func(users map[string]User) error {
+		if _, exists := users[name]; !exists {
+			return ErrNotFound
+		}
+		delete(users, name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.credentials.update(func(credentials map[string]Credential) error {
+		delete(credentials, name)
+		return nil
+	})
+}
+
+func (s *JSONStore) GetCredential(name string) (Credential, error) {
+	credentials, err := s.credentials.get()
+	if err != nil {
+		return Credential{}, err
+	}
+	credential, ok := credentials[name]
+	if !ok {
+		return Credential{}, ErrNotFound
+	}
+	return credential, nil
+}
+
+func (s *JSONStore) CreateCredential(name string, credential Credential) error {
+	return s.credentials.update(func(credentials map[string]Credential) error {
+		if _, exists := credentials[name]; exists {
+			return ErrExists
+		}
+		credentials[name] = credential
+		return nil
+	})
+}
+
+func (s *JSONStore) SetCredential(name string, credential Credential) error {
+	return s.credentials.update(func(credentials map[string]Credential) error {
+		credentials[name] = credential
+		return nil
+	})
+}
+
+func (s *JSONStore) Tokens() (map[string]Token, error) {
+	cached, err := s.tokens.get()
+	if err != nil {
+		return nil, err
+	}
+	tokens := copyTokens(cached)
+	pruneTokens(tokens, time.Now())
+	return tokens, nil
+}
+
+func (s *JSONStore) UpdateTokens(update func(tokens map[string]Token) error) error {
+	return s.tokens.update(func(tokens map[string]Token) error {
+		pruneTokens(tokens, time.Now())
+		if err := update(tokens); err != nil {
+			return err
+		}
+		pruneTokens(tokens, time.Now())
+		return nil
+	})
+}
+
+// MigrateUsers rewrites users.json in the current schema version
+func (s *JSONStore) MigrateUsers(dryRun bool) (Migration, error) {
+	data, err := os.ReadFile(s.users.filename)
+	if err != nil {
+		return Migration{}, err
+	}
+	users, version, err := decodeUsersDocument(data, time.Now().UTC())
+	if err != nil {
+		return Migration{}, err
+	}
+
+	m := Migration{FromVersion: version, ToVersion: UserSchemaVersion, Users: []string{}}
+	if !m.Needed() {
+		return m, nil
+	}
+	m.Users = sortedNames(users)
+	if dryRun {
+		return m, nil
+	}
+	// Writing the file back stores it in the current version
+	return m, s.users.update(func(map[string]User) error { return nil })
+}
+
+// createIfMissing creates a file with the given initial contents
+func createIfMissing(filename string, data []byte, perm os.FileMode) error {
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return os.WriteFile(filename, data, perm)
+	}
+	return nil
+}
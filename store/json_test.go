@@ -0,0 +1,86 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestJSONStoreConcurrentWrites hammers the store the way /useradd and /auth
+// do at the same time, through two stores on the same directory like the
+// userinfo and auth services, and checks that no write is lost
+func TestJSONStoreConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	userinfo, err := NewJSONStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewJSONStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 50
+	now := time.Now().UTC()
+	var wg sync.WaitGroup
+	errs := make(chan error, 3*n)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("user%02d", i)
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			errs <- userinfo.CreateUser(User{Name: name, Email: name + "@example.com", Status: StatusActive, CreatedAt: now, UpdatedAt: now})
+		}()
+		go func() {
+			defer wg.Done()
+			errs <- auth.CreateCredential(name, Credential{PasswordHash: "hash-" + name})
+		}()
+		go func() {
+			defer wg.Done()
+			errs <- auth.UpdateTokens(func(tokens map[string]Token) error {
+				tokens["token-"+name] = Token{Username: name, SessionID: "session-" + name, IssuedAt: now, ExpiresAt: now.Add(time.Hour)}
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A fresh store reads everything from disk, not from a cache
+	s, err := NewJSONStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := s.ListUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != n {
+		t.Errorf("got %d users, want %d", len(users), n)
+	}
+	tokens, err := s.Tokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != n {
+		t.Errorf("got %d tokens, want %d", len(tokens), n)
+	}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("user%02d", i)
+		if _, err := s.GetUser(name); err != nil {
+			t.Errorf("user %s: %v", name, err)
+		}
+		if c, err := s.GetCredential(name); err != nil || c.PasswordHash != "hash-"+name {
+			t.Errorf("credential of %s: %+v, %v", name, c, err)
+		}
+		if tok, ok := tokens["token-"+name]; !ok || tok.Username != name {
+			t.Errorf("token of %s: %+v", name, tok)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package store
+
+// lockFile is a no-op where flock is not available, updates are then only
+// serialised within the process
+func lockFile(lockname string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,151 @@
+package store
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps users and tokens in memory. It is meant for tests and
+// local experiments, nothing is shared between processes or persisted.
+type MemoryStore struct {
+	mu          sync.Mutex
+	users       map[string]User
+	credentials map[string]Credential
+	tokens      map[string]Token
+}
+
+// NewMemoryStore returns an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:       make(map[string]User),
+		credentials: make(map[string]Credential),
+		tokens:      make(map[string]Token),
+	}
+}
+
+func (s *MemoryStore) GetUser(name string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[name]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+func (s *MemoryStore) ListUsers() ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return sortedUsers(s.users), nil
+}
+
+func (s *MemoryStore) CreateUser(user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.users[user.Name]; exists {
+		return ErrExists
+	}
+	s.users[user.Name] = user
+	return nil
+}
+
+func (s *MemoryStore) UpdateUser(user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.users[user.Name]; !exists {
+		return ErrNotFound
+	}
+	s.users[user.Name] = user
+	return nil
+}
+
+func (s *MemoryStore) DeleteUser(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.users[name]; !exists {
+		return ErrNotFound
+	}
+	delete(s.users, name)
+	delete(s.credentials, name)
+	return nil
+}
+
+func (s *MemoryStore) GetCredential(name string) (Credential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	credential, ok := s.credentials[name]
+	if !ok {
+		return Credential{}, ErrNotFound
+	}
+	return credential, nil
+}
+
+func (s *MemoryStore) CreateCredential(name string, credential Credential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.credentials[name]; exists {
+		return ErrExists
+	}
+	s.credentials[name] = credential
+	return nil
+}
+
+func (s *MemoryStore) SetCredential(name string, credential Credential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.credentials[name] = credential
+	return nil
+}
+
+func (s *MemoryStore) Tokens() (map[string]Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return copyTokens(s.tokens), nil
+}
+
+func (s *MemoryStore) UpdateTokens(update func(tokens map[string]Token) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens := copyTokens(s.tokens)
+	if err := update(tokens); err != nil {
+		return err
+	}
+	pruneTokens(tokens, time.Now())
+	s.tokens = tokens
+	return nil
+}
+
+// MigrateUsers has nothing to do, the records only exist in the current
+// version
+func (s *MemoryStore) MigrateUsers(dryRun bool) (Migration, error) {
+	return Migration{FromVersion: UserSchemaVersion, ToVersion: UserSchemaVersion, Users: []string{}}, nil
+}
+
+func copyTokens(tokens map[string]Token) map[string]Token {
+	c := make(map[string]Token, len(tokens))
+	for id, t := range tokens {
+		c[id] = t
+	}
+	return c
+}
+
+// sortedUsers returns the users ordered by name
+func sortedUsers(users map[string]User) []User {
+	list := make([]User, 0, len(users))
+	for _, user := range users {
+		list = append(list, user)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
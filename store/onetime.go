@@ -0,0 +1,73 @@
+package store
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// Purposes of one-time tokens
+const (
+	// PurposeVerifyEmail confirms the email address of a new account
+	PurposeVerifyEmail = "verify_email"
+	// PurposeResetPassword allows setting a new password without the old one
+	PurposeResetPassword = "reset_password"
+	// PurposeMFALogin finishes a login whose password was checked once the
+	// second factor is given
+	PurposeMFALogin = "mfa_login"
+)
+
+// IssueOneTimeToken adds a single-use token for the user and returns the
+// secret to send them. The record is keyed by a hash of the secret, so the
+// stored records cannot be used to redeem a token. Older unused tokens of the
+// user with the same purpose stay valid until they expire.
+func IssueOneTimeToken(tokens map[string]Token, username, purpose string, ttl time.Duration) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	value := hex.EncodeToString(secret)
+
+	now := time.Now().UTC()
+	tokens[oneTimeTokenID(value)] = Token{
+		Username:  username,
+		Purpose:   purpose,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(ttl),
+	}
+	return value, nil
+}
+
+// UseOneTimeToken redeems a token issued for purpose and returns its record.
+// The record is removed, so the token works only once. It returns
+// ErrNotFound for unknown, used, revoked and expired tokens.
+func UseOneTimeToken(tokens map[string]Token, value, purpose string) (Token, error) {
+	t, err := FindOneTimeToken(tokens, value, purpose)
+	if err != nil {
+		return Token{}, err
+	}
+	delete(tokens, oneTimeTokenID(value))
+	return t, nil
+}
+
+// RestoreOneTimeToken puts back a token redeemed with UseOneTimeToken, for
+// callers whose work after redeeming it failed
+func RestoreOneTimeToken(tokens map[string]Token, value string, t Token) {
+	tokens[oneTimeTokenID(value)] = t
+}
+
+// FindOneTimeToken returns the record of a token issued for purpose without
+// using it up. It returns ErrNotFound like UseOneTimeToken.
+func FindOneTimeToken(tokens map[string]Token, value, purpose string) (Token, error) {
+	t, ok := tokens[oneTimeTokenID(value)]
+	if !ok || t.Purpose != purpose || t.RevokedAt != nil || t.Expired(time.Now()) {
+		return Token{}, ErrNotFound
+	}
+	return t, nil
+}
+
+func oneTimeTokenID(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UserSchemaVersion is the version of the user records this code writes.
+//
+//  1. name, email and age as a free-form string, no version marker
+//  2. the typed profile of User
+const UserSchemaVersion = 2
+
+// Migration describes the upgrade of the stored user records
+type Migration struct {
+	FromVersion int `json:"from_version"`
+	ToVersion   int `json:"to_version"`
+	// Users lists the names of the upgraded users
+	Users []string `json:"users"`
+}
+
+// Needed reports whether the stored records are older than the current version
+func (m Migration) Needed() bool {
+	return m.FromVersion < m.ToVersion
+}
+
+// userV1 is a user record of schema version 1
+type userV1 struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Age   string `json:"age"`
+}
+
+// upgrade converts the record to the current version. Ages that are not a
+// number are dropped, and as the creation time was never recorded the time
+// of the upgrade is used.
+func (u userV1) upgrade(now time.Time) User {
+	age, _ := strconv.Atoi(strings.TrimSpace(u.Age))
+	if age < 0 {
+		age = 0
+	}
+	return User{
+		Name:      u.Name,
+		Email:     u.Email,
+		Age:       age,
+		Status:    StatusActive,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+// decodeUser decodes a user record stored with the given schema version
+func decodeUser(data []byte, version int, now time.Time) (User, error) {
+	switch version {
+	case 1:
+		var old userV1
+		if err := json.Unmarshal(data, &old); err != nil {
+			return User{}, err
+		}
+		return old.upgrade(now), nil
+	case UserSchemaVersion:
+		var user User
+		err := json.Unmarshal(data, &user)
+		return user, err
+	default:
+		return User{}, fmt.Errorf("store: unsupported user schema version %d", version)
+	}
+}
+
+// usersDocument is the layout of users.json since schema version 2. Version 1
+// files hold the users object alone.
+type usersDocument struct {
+	SchemaVersion int                        `json:"schema_version"`
+	Users         map[string]json.RawMessage `json:"users"`
+}
+
+// decodeUsersDocument decodes users.json of any schema version and returns
+// the users upgraded to the current version along with the file's version
+func decodeUsersDocument(data []byte, now time.Time) (map[string]User, int, error) {
+	users := make(map[string]User)
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return users, UserSchemaVersion, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, 0, err
+	}
+
+	// A version 1 file maps names to user objects, so a number under
+	// schema_version can only be the version marker
+	version := 1
+	records := fields
+	if raw, ok := fields["schema_version"]; ok && json.Unmarshal(raw, &version) == nil {
+		var doc usersDocument
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, 0, err
+		}
+		records = doc.Users
+	} else {
+		version = 1
+	}
+
+	for name, raw := range records {
+		user, err := decodeUser(raw, version, now)
+		if err != nil {
+			return nil, 0, fmt.Errorf("store: user %q: %w", name, err)
+		}
+		users[name] = user
+	}
+	return users, version, nil
+}
+
+// encodeUsersDocument encodes users in the current users.json layout
+func encodeUsersDocument(users map[string]User) ([]byte, error) {
+	return json.Marshal(struct {
+		SchemaVersion int             `json:"schema_version"`
+		Users         map[string]User `json:"users"`
+	}{UserSchemaVersion, users})
+}
+
+// sortedNames returns the keys of users in order
+func sortedNames(users map[string]User) []string {
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
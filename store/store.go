@@ -0,0 +1,234 @@
+// Package store holds the user and token data shared by the auth and userinfo
+// services behind the UserStore and TokenStore interfaces. The backend is
+// chosen by configuration: JSON files in the shared data directory (the
+// original layout), an in-memory store for tests, or an embedded bbolt
+// database.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when a user or credential does not exist
+	ErrNotFound = errors.New("store: not found")
+	// ErrExists is returned when creating something that already exists
+	ErrExists = errors.New("store: already exists")
+)
+
+// Account statuses
+const (
+	StatusActive   = "active"
+	StatusDisabled = "disabled"
+	// StatusPending accounts have not verified their email address yet
+	StatusPending = "pending"
+)
+
+// User represents the structure for user details, the profile of schema
+// version UserSchemaVersion
+type User struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name,omitempty"`
+	Email       string `json:"email"`
+	// Age in years, 0 if unknown. It is ignored when BirthDate is set.
+	Age int `json:"age,omitempty"`
+	// BirthDate is formatted as YYYY-MM-DD
+	BirthDate string    `json:"birth_date,omitempty"`
+	Roles     []string  `json:"roles,omitempty"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CurrentAge returns the age computed from the birth date, or the stored
+// age if there is no valid birth date
+func (u User) CurrentAge(now time.Time) int {
+	birth, err := time.Parse("2006-01-02", u.BirthDate)
+	if err != nil {
+		return u.Age
+	}
+	age := now.Year() - birth.Year()
+	if now.Month() < birth.Month() || (now.Month() == birth.Month() && now.Day() < birth.Day()) {
+		age--
+	}
+	return age
+}
+
+// Credential holds the stored password hash for a single user
+type Credential struct {
+	PasswordHash string `json:"password_hash"`
+	// Legacy marks hashes created by the migration of users that never had a
+	// password, where the password is still the username.
+	Legacy bool `json:"legacy,omitempty"`
+	// TOTP is the user's second factor, nil if none was set up
+	TOTP *TOTP `json:"totp,omitempty"`
+}
+
+// TOTP is an authenticator app second factor. The secret is kept from the
+// start of the enrollment, but the second factor is only asked for once a
+// code was confirmed and Enabled is set.
+type TOTP struct {
+	// Secret is base32 encoded, as shown to authenticator apps
+	Secret  string `json:"secret"`
+	Enabled bool   `json:"enabled"`
+	// LastStep is the time step of the last accepted code, so a code cannot
+	// be used twice
+	LastStep int64 `json:"last_step,omitempty"`
+	// RecoveryCodes are SHA-256 hashes of the unused recovery codes
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+// Token is the record of an issued auth token, keyed by the token ID.
+//
+// Every login starts a session, refreshing a token issues a new token in the
+// same session, so a session is the one active record carrying its ID.
+type Token struct {
+	Username string `json:"username"`
+	// Purpose is empty for auth tokens, see the Purpose constants for the
+	// one-time tokens
+	Purpose   string     `json:"purpose,omitempty"`
+	SessionID string     `json:"session_id"`
+	IssuedAt  time.Time  `json:"issued_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+
+	// Session details, carried over when the token is refreshed
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+	// ClientID is the OAuth client the token was issued to, empty for logins
+	// to the site itself
+	ClientID string `json:"client_id,omitempty"`
+}
+
+// UnmarshalJSON also accepts the bare token strings written before tokens had
+// a lifetime. Those decode as an empty record and are dropped.
+func (t *Token) UnmarshalJSON(data []byte) error {
+	var legacy string
+	if err := json.Unmarshal(data, &legacy); err == nil {
+		*t = Token{}
+		return nil
+	}
+
+	type token Token
+	return json.Unmarshal(data, (*token)(t))
+}
+
+// IsAuth reports whether the record is of an auth token, as opposed to a
+// one-time token
+func (t Token) IsAuth() bool {
+	return t.Purpose == ""
+}
+
+// Expired reports whether the token is no longer valid at the given time
+func (t Token) Expired(now time.Time) bool {
+	return !now.Before(t.ExpiresAt)
+}
+
+// RevokeToken marks the token with the given ID as revoked
+func RevokeToken(tokens map[string]Token, id string) {
+	if t, ok := tokens[id]; ok && t.RevokedAt == nil {
+		now := time.Now().UTC()
+		t.RevokedAt = &now
+		tokens[id] = t
+	}
+}
+
+// RevokeUserTokens revokes every active token of the user
+func RevokeUserTokens(tokens map[string]Token, username string) {
+	for id, t := range tokens {
+		if t.Username == username {
+			RevokeToken(tokens, id)
+		}
+	}
+}
+
+// UserStore stores user details and their password credentials
+type UserStore interface {
+	GetUser(name string) (User, error)
+	ListUsers() ([]User, error)
+	// CreateUser returns ErrExists if a user with the name exists
+	CreateUser(user User) error
+	// UpdateUser returns ErrNotFound if the user does not exist
+	UpdateUser(user User) error
+	// DeleteUser removes the user and their credential
+	DeleteUser(name string) error
+
+	GetCredential(name string) (Credential, error)
+	// CreateCredential returns ErrExists if the user already has one
+	CreateCredential(name string, credential Credential) error
+	SetCredential(name string, credential Credential) error
+
+	// MigrateUsers upgrades the stored user records to UserSchemaVersion.
+	// With dryRun nothing is written and the result shows what would change.
+	MigrateUsers(dryRun bool) (Migration, error)
+}
+
+// TokenStore stores the records of issued auth tokens
+type TokenStore interface {
+	// Tokens returns all token records keyed by token ID
+	Tokens() (map[string]Token, error)
+	// UpdateTokens applies update to the token records as one change. The
+	// change is discarded if update returns an error. Expired records are
+	// dropped, a revoked token needs no record once it has expired.
+	UpdateTokens(update func(tokens map[string]Token) error) error
+}
+
+// Config selects and configures the storage backend
+type Config struct {
+	// Backend is one of "json", "memory" or "bolt"
+	Backend string
+	// Dir is the directory holding the JSON files or the database
+	Dir string
+}
+
+// ConfigFromEnv reads the configuration from STORE_BACKEND and STORE_DIR
+func ConfigFromEnv() Config {
+	cfg := Config{Backend: os.Getenv("STORE_BACKEND"), Dir: os.Getenv("STORE_DIR")}
+	if cfg.Backend == "" {
+		cfg.Backend = "json"
+	}
+	if cfg.Dir == "" {
+		cfg.Dir = "/app/shared_data"
+	}
+	return cfg
+}
+
+// Open returns the user and token stores of the configured backend
+func Open(cfg Config) (UserStore, TokenStore, error) {
+	switch cfg.Backend {
+	case "json":
+		s, err := NewJSONStore(cfg.Dir)
+		return s, s, err
+	case "memory":
+		s := NewMemoryStore()
+		return s, s, nil
+	case "bolt":
+		s, err := NewBoltStore(cfg.Dir + "/store.db")
+		return s, s, err
+	default:
+		return nil, nil, fmt.Errorf("store: unknown backend %q", cfg.Backend)
+	}
+}
+
+// pruneTokens drops records of expired tokens and records that carry no user,
+// and gives tokens issued before sessions existed a session of their own
+func pruneTokens(tokens map[string]Token, now time.Time) {
+	for id, t := range tokens {
+		if t.Username == "" || t.Expired(now) {
+			delete(tokens, id)
+			continue
+		}
+		if t.SessionID == "" && t.IsAuth() {
+			t.SessionID = id
+			t.CreatedAt = t.IssuedAt
+			t.LastSeen = t.IssuedAt
+			tokens[id] = t
+		}
+	}
+}
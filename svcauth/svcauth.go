@@ -0,0 +1,311 @@
+// Package svcauth authenticates the services to each other with signed
+// service tokens.
+//
+// Every service has a name and a secret key. Requests between services carry
+// an X-Service-Auth header with the caller's name, a timestamp, a random nonce
+// and an HMAC-SHA256 signature of those, the method, request URI and body and
+// the headers in SignedHeaders. The called service checks it against its list
+// of trusted services and signs its response the same way, binding it to the
+// request's signature, so the caller knows it talked to a trusted service too.
+// The response body and other headers are not signed.
+//
+// Signatures are valid for MaxSkew around their timestamp, so the clocks of
+// the services have to roughly agree. Within that time a service accepts
+// each nonce once, so a captured request cannot be sent again. Nonces are
+// remembered per process: a service run as several replicas would accept a
+// request replayed to another replica.
+package svcauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header carries the service token of requests and responses
+const Header = "X-Service-Auth"
+
+// MaxSkew is how far a signature's timestamp may be from the current time
+const MaxSkew = time.Minute
+
+// SignedHeaders are the request headers covered by the signature, those the
+// services act on: the user's auth token and name, and the client address
+// the webserver passes on
+var SignedHeaders = []string{"Authorization", "Username", "X-Forwarded-For"}
+
+// minKeyLength is the shortest accepted service key, in bytes
+const minKeyLength = 16
+
+// maxBody limits how much of a request body is read to check its signature
+const maxBody = 1 << 20
+
+var (
+	ErrMissing   = errors.New("svcauth: missing service token")
+	ErrMalformed = errors.New("svcauth: malformed service token")
+	ErrUnknown   = errors.New("svcauth: unknown service")
+	ErrExpired   = errors.New("svcauth: service token too old or from the future")
+	ErrSignature = errors.New("svcauth: invalid signature")
+	ErrReplayed  = errors.New("svcauth: service token already used")
+)
+
+// Service is this service's identity and the services it trusts
+type Service struct {
+	Name string
+	Key  []byte
+	// Trusted maps the names of the services allowed to call this one, and
+	// to answer its calls, to their keys
+	Trusted map[string][]byte
+	Logger  *log.Logger
+
+	// nonces are those of the requests accepted within MaxSkew, with the
+	// time they can be forgotten
+	mu        sync.Mutex
+	nonces    map[string]time.Time
+	nextPrune time.Time
+}
+
+// FromEnv reads SERVICE_NAME, SERVICE_KEY and TRUSTED_SERVICES, a comma
+// separated list of name=key pairs
+func FromEnv() (*Service, error) {
+	s := &Service{Name: os.Getenv("SERVICE_NAME"), Key: []byte(os.Getenv("SERVICE_KEY")), Logger: log.Default()}
+	if s.Name == "" || len(s.Key) < minKeyLength {
+		return nil, fmt.Errorf("svcauth: SERVICE_NAME and a SERVICE_KEY of at least %d bytes are required", minKeyLength)
+	}
+	trusted, err := ParseTrusted(os.Getenv("TRUSTED_SERVICES"))
+	if err != nil {
+		return nil, err
+	}
+	s.Trusted = trusted
+	return s, nil
+}
+
+// ParseTrusted parses a list of trusted services like
+// "webserver=key1,userinfo=key2"
+func ParseTrusted(list string) (map[string][]byte, error) {
+	trusted := make(map[string][]byte)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, key, ok := strings.Cut(entry, "=")
+		if !ok || name == "" || len(key) < minKeyLength {
+			return nil, fmt.Errorf("svcauth: invalid trusted service %q, expected name=key with a key of at least %d bytes", name, minKeyLength)
+		}
+		trusted[name] = []byte(key)
+	}
+	return trusted, nil
+}
+
+// sign returns the service token of payload, signed with this service's key
+func (s *Service) sign(ts int64, nonce, payload string) string {
+	return fmt.Sprintf("%s:%d:%s:%s", s.Name, ts, nonce, mac(s.Key, payload))
+}
+
+// newNonce returns a random value for a service token
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// check parses a service token and verifies it was signed by a trusted
+// service within MaxSkew. payload builds the signed text from the caller
+// name, timestamp and nonce.
+func (s *Service) check(value string, payload func(name string, ts int64, nonce string) string) (name, nonce, sig string, err error) {
+	if value == "" {
+		return "", "", "", ErrMissing
+	}
+	parts := strings.Split(value, ":")
+	if len(parts) != 4 || parts[2] == "" {
+		return "", "", "", ErrMalformed
+	}
+	name, nonce, sig = parts[0], parts[2], parts[3]
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", "", "", ErrMalformed
+	}
+	key, ok := s.Trusted[name]
+	if !ok {
+		return name, "", "", ErrUnknown
+	}
+	if age := time.Since(time.Unix(ts, 0)); age > MaxSkew || age < -MaxSkew {
+		return name, "", "", ErrExpired
+	}
+	if !hmac.Equal([]byte(sig), []byte(mac(key, payload(name, ts, nonce)))) {
+		return name, "", "", ErrSignature
+	}
+	return name, nonce, sig, nil
+}
+
+// useNonce records the nonce of a request signed at ts by the named service.
+// It returns false if the nonce was used before.
+func (s *Service) useNonce(name, nonce string, ts int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.nonces == nil {
+		s.nonces = make(map[string]time.Time)
+	}
+	if now.After(s.nextPrune) {
+		for key, until := range s.nonces {
+			if now.After(until) {
+				delete(s.nonces, key)
+			}
+		}
+		s.nextPrune = now.Add(MaxSkew / 4)
+	}
+
+	key := name + ":" + nonce
+	if _, used := s.nonces[key]; used {
+		return false
+	}
+	// Past MaxSkew after its timestamp the token is refused as expired
+	s.nonces[key] = time.Unix(ts, 0).Add(MaxSkew + time.Second)
+	return true
+}
+
+func mac(key []byte, payload string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func requestPayload(name string, ts int64, nonce, method, uri string, header http.Header, body []byte) string {
+	sum := sha256.Sum256(body)
+	fields := []string{"request", name, strconv.FormatInt(ts, 10), nonce, method, uri, hex.EncodeToString(sum[:])}
+	for _, key := range SignedHeaders {
+		fields = append(fields, strconv.Quote(strings.Join(header.Values(key), ",")))
+	}
+	return strings.Join(fields, "\n")
+}
+
+func responsePayload(name string, ts int64, nonce, requestSig string) string {
+	return strings.Join([]string{"response", name, strconv.FormatInt(ts, 10), nonce, requestSig}, "\n")
+}
+
+// Client returns an HTTP client that signs its requests as this service and
+// only accepts responses signed by a trusted service
+func (s *Service) Client() *http.Client {
+	return &http.Client{Transport: &Transport{Service: s}, Timeout: 30 * time.Second}
+}
+
+// Transport signs requests as Service and checks the responses. Base sends
+// the requests, http.DefaultTransport if nil.
+type Transport struct {
+	Service *Service
+	Base    http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	signed := req.Clone(req.Context())
+	signed.Body = http.NoBody
+	if len(body) > 0 {
+		signed.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	signed.ContentLength = int64(len(body))
+	ts, nonce := time.Now().Unix(), newNonce()
+	token := t.Service.sign(ts, nonce, requestPayload(t.Service.Name, ts, nonce, req.Method, req.URL.RequestURI(), signed.Header, body))
+	signed.Header.Set(Header, token)
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(signed)
+	if err != nil {
+		return nil, err
+	}
+	requestSig := token[strings.LastIndex(token, ":")+1:]
+	name, _, _, err := t.Service.check(resp.Header.Get(Header), func(name string, ts int64, nonce string) string {
+		return responsePayload(name, ts, nonce, requestSig)
+	})
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("response of %s %s not from a trusted service (%q): %w", req.Method, req.URL.Host, name, err)
+	}
+	return resp, nil
+}
+
+type contextKey struct{}
+
+// Middleware lets only requests signed by trusted services through to next
+// and signs the responses. Requests for the public paths may come without a
+// service token; a path ending in "/" covers everything below it.
+func (s *Service) Middleware(next http.Handler, public ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get(Header)
+		if value == "" && isPublic(r.URL.Path, public) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "Error reading request body", http.StatusBadRequest)
+			s.Logger.Println("Error reading request body:", err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var ts int64
+		name, nonce, sig, err := s.check(value, func(name string, signedAt int64, nonce string) string {
+			ts = signedAt
+			return requestPayload(name, signedAt, nonce, r.Method, r.URL.RequestURI(), r.Header, body)
+		})
+		if err == nil && !s.useNonce(name, nonce, ts) {
+			err = ErrReplayed
+		}
+		if err != nil {
+			http.Error(w, "Unknown or invalid calling service", http.StatusUnauthorized)
+			s.Logger.Printf("Rejected %s %s from service %q at %s: %v\n", r.Method, r.URL.Path, name, r.RemoteAddr, err)
+			return
+		}
+
+		now, responseNonce := time.Now().Unix(), newNonce()
+		w.Header().Set(Header, s.sign(now, responseNonce, responsePayload(s.Name, now, responseNonce, sig)))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, name)))
+	})
+}
+
+// Caller returns the name of the service that signed the request, or "" if
+// it came unsigned to a public path
+func Caller(r *http.Request) string {
+	name, _ := r.Context().Value(contextKey{}).(string)
+	return name
+}
+
+func isPublic(path string, public []string) bool {
+	for _, p := range public {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
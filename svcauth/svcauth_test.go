@@ -0,0 +1,115 @@
+package svcauth
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// recorder keeps the last request it sends, as someone listening on the
+// network between the services would
+type recorder struct {
+	header http.Header
+	body   string
+}
+
+func (rec *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec.header = req.Header.Clone()
+	body, _ := io.ReadAll(req.Body)
+	rec.body = string(body)
+	req.Body = io.NopCloser(strings.NewReader(rec.body))
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestMiddlewareRejectsReplayedAndChangedRequests(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	called := &Service{Name: "userinfo", Key: []byte("userinfo-service-test-key"), Logger: logger}
+	caller := &Service{Name: "webserver", Key: []byte("webserver-service-test-key"), Logger: logger,
+		Trusted: map[string][]byte{"userinfo": called.Key}}
+	called.Trusted = map[string][]byte{"webserver": caller.Key}
+	server := httptest.NewServer(called.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, Caller(r))
+	})))
+	defer server.Close()
+
+	rec := &recorder{}
+	client := &http.Client{Transport: &Transport{Service: caller, Base: rec}}
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/users/ann", strings.NewReader(`{"email":"ann@example.com"}`))
+	req.Header.Set("Authorization", "ann-token")
+	req.Header.Set("Username", "ann")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("signed request: status %d", resp.StatusCode)
+	}
+
+	// Someone resends what they saw, unchanged or altered
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		change func(h http.Header)
+	}{
+		{"replayed", "/users/ann", rec.body, nil},
+		{"other path", "/users/boss", rec.body, nil},
+		{"other body", "/users/ann", `{"email":"eve@example.com"}`, nil},
+		{"other auth token", "/users/ann", rec.body, func(h http.Header) { h.Set("Authorization", "eve-token") }},
+		{"other username", "/users/ann", rec.body, func(h http.Header) { h.Set("Username", "boss") }},
+		{"other client address", "/users/ann", rec.body, func(h http.Header) { h.Set("X-Forwarded-For", "10.0.0.1") }},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+tt.path, strings.NewReader(tt.body))
+		req.Header = rec.header.Clone()
+		if tt.change != nil {
+			tt.change(req.Header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, http.StatusUnauthorized)
+		}
+	}
+
+	// A new request signs a new nonce and goes through
+	resp, err = client.Get(server.URL + "/users/ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("second signed request: status %d", resp.StatusCode)
+	}
+}
+
+func TestMiddlewareRejectsUnknownService(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	called := &Service{Name: "userinfo", Key: []byte("userinfo-service-test-key"), Logger: logger,
+		Trusted: map[string][]byte{"webserver": []byte("webserver-service-test-key")}}
+	caller := &Service{Name: "productlist", Key: []byte("productlist-service-test-key"), Logger: logger,
+		Trusted: map[string][]byte{"userinfo": called.Key}}
+	server := httptest.NewServer(called.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	defer server.Close()
+
+	// The unsigned 401 is refused by the caller's transport
+	if resp, err := caller.Client().Get(server.URL + "/users"); err == nil {
+		resp.Body.Close()
+		t.Fatal("response of a service that refused the call accepted")
+	}
+	resp, err := http.Get(server.URL + "/users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unsigned request: status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
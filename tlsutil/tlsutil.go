@@ -0,0 +1,164 @@
+// Package tlsutil lets the services serve HTTPS and trust the certificates
+// of the other services.
+//
+// A service serves HTTPS when TLS_CERT_FILE and TLS_KEY_FILE are set, plain
+// HTTP otherwise. The files are checked for changes every ReloadInterval and
+// loaded again, so renewed certificates are picked up without a restart.
+// TLS_CA_FILE adds a CA, such as the one made by the certgen command, to the
+// certificates trusted when calling other services.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ReloadInterval is how often the certificate files are checked for changes
+var ReloadInterval = 30 * time.Second
+
+// CertReloader serves a certificate and key loaded from files, loading them
+// again when either file changes
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewCertReloader loads the certificate and key files
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// modified returns the newest modification time of the two files
+func (c *CertReloader) modified() (time.Time, error) {
+	var newest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// Reload loads the files again if they changed since they were last loaded
+// and reports whether they did. On error the current certificate is kept.
+func (c *CertReloader) Reload() (bool, error) {
+	modTime, err := c.modified()
+	if err != nil {
+		return false, err
+	}
+	c.mu.RLock()
+	unchanged := c.cert != nil && modTime.Equal(c.modTime)
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.mu.Unlock()
+	return true, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// Run reloads the certificate when the files change until the process exits
+func (c *CertReloader) Run(interval time.Duration, logger *log.Logger) {
+	for range time.Tick(interval) {
+		reloaded, err := c.Reload()
+		if err != nil {
+			// A renewal may be writing the files right now, try again later
+			logger.Println("Error reloading TLS certificate:", err)
+		} else if reloaded {
+			logger.Println("Reloaded TLS certificate from", c.certFile)
+		}
+	}
+}
+
+// Enabled reports whether TLS_CERT_FILE is set, so the service serves HTTPS
+func Enabled() bool {
+	return os.Getenv("TLS_CERT_FILE") != ""
+}
+
+// ListenAndServe serves handler on addr, with HTTPS using TLS_CERT_FILE and
+// TLS_KEY_FILE if they are set and plain HTTP otherwise
+func ListenAndServe(addr string, handler http.Handler, logger *log.Logger) error {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile == "" && keyFile == "" {
+		return http.ListenAndServe(addr, handler)
+	}
+	if certFile == "" || keyFile == "" {
+		return errors.New("tlsutil: TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	certs, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("tlsutil: loading certificate: %w", err)
+	}
+	go certs.Run(ReloadInterval, logger)
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		},
+	}
+	logger.Println("Serving HTTPS with certificate", certFile)
+	return server.ListenAndServeTLS("", "")
+}
+
+// TrustCAFromEnv adds the CA certificates in TLS_CA_FILE to the roots
+// trusted by http.DefaultTransport, which the services use to call each
+// other. Nothing changes if it is not set.
+func TrustCAFromEnv() error {
+	caFile := os.Getenv("TLS_CA_FILE")
+	if caFile == "" {
+		return nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("tlsutil: no certificates found in %s", caFile)
+	}
+	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    roots,
+	}
+	return nil
+}
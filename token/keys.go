@@ -0,0 +1,119 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"time"
+)
+
+// UseIDToken marks the keys that only sign the id tokens of OAuth clients.
+// They are always Ed25519 keys, so clients can check id tokens against the
+// published keys, and they are never accepted for auth tokens.
+const UseIDToken = "id_token"
+
+// Key is a signing or verification key. Tokens signed with a key are accepted
+// from NotBefore until NotAfter.
+type Key struct {
+	ID        string
+	Alg       string
+	NotBefore time.Time
+	NotAfter  time.Time
+	// Use is UseIDToken for id token keys, empty for auth token keys
+	Use string
+
+	// Secret is the HMAC key for HS256
+	Secret []byte
+	// PrivateKey is only set on the issuer, PublicKey everywhere for EdDSA
+	PrivateKey ed25519.PrivateKey
+	PublicKey  ed25519.PublicKey
+}
+
+// DeriveHMACKey derives the HS256 key for a key ID from the shared secret.
+// Every service holding the secret can verify tokens of any key ID, so HMAC
+// keys can be rotated without distributing key material.
+func DeriveHMACKey(secret []byte, kid string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("token-key:" + kid))
+	return mac.Sum(nil)
+}
+
+// JWK is a JSON Web Key as published on the auth service's /keys endpoint.
+// HMAC keys are published without their secret, verifiers derive it.
+type JWK struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Nbf int64  `json:"nbf"`
+	Exp int64  `json:"exp"`
+	// TokenUse is the Use of the key, omitted for auth token keys
+	TokenUse string `json:"token_use,omitempty"`
+}
+
+// JWKSet is the document served by /keys
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK returns the public representation of the key
+func (k *Key) JWK() JWK {
+	jwk := JWK{
+		Kid:      k.ID,
+		Alg:      k.Alg,
+		Use:      "sig",
+		Nbf:      k.NotBefore.Unix(),
+		Exp:      k.NotAfter.Unix(),
+		TokenUse: k.Use,
+	}
+	switch k.Alg {
+	case AlgHS256:
+		jwk.Kty = "oct"
+	case AlgEdDSA:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = encoding.EncodeToString(k.PublicKey)
+	}
+	return jwk
+}
+
+// KeyFromJWK builds a verification key from a published JWK. hmacSecret is
+// the shared secret used to derive HS256 keys.
+func KeyFromJWK(jwk JWK, hmacSecret []byte) (*Key, error) {
+	key := &Key{
+		ID:        jwk.Kid,
+		Alg:       jwk.Alg,
+		NotBefore: time.Unix(jwk.Nbf, 0),
+		NotAfter:  time.Unix(jwk.Exp, 0),
+		Use:       jwk.TokenUse,
+	}
+	switch jwk.Alg {
+	case AlgHS256:
+		if len(hmacSecret) == 0 {
+			return nil, ErrUnknownKey
+		}
+		key.Secret = DeriveHMACKey(hmacSecret, jwk.Kid)
+	case AlgEdDSA:
+		pub, err := encoding.DecodeString(jwk.X)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return nil, ErrMalformed
+		}
+		key.PublicKey = ed25519.PublicKey(pub)
+	default:
+		return nil, ErrUnsupported
+	}
+	return key, nil
+}
+
+// KeySet is a fixed set of keys indexed by key ID
+type KeySet map[string]*Key
+
+// Key returns the key with the given ID
+func (s KeySet) Key(kid string) (*Key, error) {
+	if key, ok := s[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
@@ -0,0 +1,201 @@
+package token
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Revocation is a revoked token that has not expired yet
+type Revocation struct {
+	ID        string `json:"jti"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// RevocationList is the document served by the auth service's /revocations
+type RevocationList struct {
+	Revoked []Revocation `json:"revoked"`
+}
+
+// RemoteKeySet verifies tokens locally using the keys and revocations
+// published by the auth service. Both are cached and fetched again once
+// RefreshInterval has passed, or straight away when a token names an unknown
+// key, which happens right after the auth service rotates its keys.
+//
+// Documents older than RefreshInterval are fetched again in the background
+// while the cached ones stay in use, so a slow auth service does not hold up
+// verification. Documents older than twice RefreshInterval are fetched
+// before verifying, and if that fails verification fails too: while the auth
+// service cannot be reached for longer, tokens are refused rather than checked
+// against an old revocation list. A revoked token is accepted for at most
+// twice RefreshInterval after it was revoked.
+type RemoteKeySet struct {
+	KeysURL         string
+	RevocationsURL  string
+	HMACSecret      []byte
+	Client          *http.Client
+	RefreshInterval time.Duration
+	// Use selects the keys to verify with: by default those of auth tokens,
+	// UseIDToken for OAuth clients checking id tokens
+	Use string
+
+	// fetchMu is held while fetching, mu only while reading or swapping the
+	// cached documents. lastFetch is the time of the last successful fetch,
+	// lastAttempt and lastErr those of the last failed one.
+	fetchMu     sync.Mutex
+	mu          sync.Mutex
+	keys        KeySet
+	revoked     map[string]int64
+	lastFetch   time.Time
+	lastAttempt time.Time
+	lastErr     error
+	refreshing  bool
+}
+
+// NewRemoteKeySet returns a key set for the auth service at authURL
+func NewRemoteKeySet(authURL string, hmacSecret []byte) *RemoteKeySet {
+	return &RemoteKeySet{
+		KeysURL:         authURL + "/keys",
+		RevocationsURL:  authURL + "/revocations",
+		HMACSecret:      hmacSecret,
+		Client:          &http.Client{Timeout: 5 * time.Second},
+		RefreshInterval: 5 * time.Second,
+	}
+}
+
+// minRefetch limits how often an unknown key ID or a failed fetch triggers a
+// fetch
+const minRefetch = 5 * time.Second
+
+// Key returns the verification key with the given ID
+func (s *RemoteKeySet) Key(kid string) (*Key, error) {
+	s.mu.Lock()
+	keys, lastFetch := s.keys, s.lastFetch
+	age := time.Since(lastFetch)
+	expired := keys == nil || age >= 2*s.RefreshInterval
+	background := !expired && age >= s.RefreshInterval && !s.refreshing
+	if background {
+		s.refreshing = true
+	}
+	s.mu.Unlock()
+
+	if expired {
+		if err := s.refresh(lastFetch); err != nil {
+			return nil, err
+		}
+		keys, lastFetch = s.cached()
+	} else if background {
+		go s.refresh(lastFetch)
+	}
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(lastFetch) >= minRefetch {
+		if err := s.refresh(lastFetch); err != nil {
+			return nil, err
+		}
+		keys, _ = s.cached()
+	}
+	return keys.Key(kid)
+}
+
+// Verify checks the token signature, expiry and revocation and returns its
+// claims
+func (s *RemoteKeySet) Verify(raw string) (*Claims, error) {
+	var claims Claims
+	if err := Parse(raw, s, &claims); err != nil {
+		return &claims, err
+	}
+
+	s.mu.Lock()
+	_, revoked := s.revoked[claims.ID]
+	s.mu.Unlock()
+	if revoked {
+		return &claims, ErrRevoked
+	}
+	return &claims, nil
+}
+
+func (s *RemoteKeySet) cached() (KeySet, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys, s.lastFetch
+}
+
+// refresh fetches the keys and revocations unless they were fetched since
+// the caller last looked, at since, while it waited for another fetch. After
+// a failed fetch it returns that error for minRefetch without trying again,
+// so an unreachable auth service is not asked on every request.
+func (s *RemoteKeySet) refresh(since time.Time) error {
+	s.fetchMu.Lock()
+	defer s.fetchMu.Unlock()
+
+	s.mu.Lock()
+	var err error
+	done := s.lastFetch.After(since) && s.keys != nil
+	if !done && s.lastErr != nil && time.Since(s.lastAttempt) < minRefetch {
+		done, err = true, s.lastErr
+	}
+	if done {
+		s.refreshing = false
+	}
+	s.mu.Unlock()
+	if done {
+		return err
+	}
+
+	keys, revoked, err := s.fetchAll()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshing = false
+	if err != nil {
+		s.lastAttempt, s.lastErr = time.Now(), err
+		return err
+	}
+	s.lastFetch, s.lastErr = time.Now(), nil
+	s.keys = keys
+	s.revoked = revoked
+	return nil
+}
+
+// fetchAll fetches and decodes both documents, without holding any lock
+func (s *RemoteKeySet) fetchAll() (KeySet, map[string]int64, error) {
+	var set JWKSet
+	if err := s.fetch(s.KeysURL, &set); err != nil {
+		return nil, nil, err
+	}
+	var list RevocationList
+	if err := s.fetch(s.RevocationsURL, &list); err != nil {
+		return nil, nil, err
+	}
+
+	keys := make(KeySet)
+	for _, jwk := range set.Keys {
+		key, err := KeyFromJWK(jwk, s.HMACSecret)
+		if err != nil || key.Use != s.Use {
+			continue
+		}
+		keys[key.ID] = key
+	}
+	revoked := make(map[string]int64)
+	for _, r := range list.Revoked {
+		revoked[r.ID] = r.ExpiresAt
+	}
+	return keys, revoked, nil
+}
+
+func (s *RemoteKeySet) fetch(url string, v interface{}) error {
+	resp, err := s.Client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token: unexpected status code %d from %s", resp.StatusCode, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,92 @@
+package token
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAuth serves /keys and /revocations like the auth service, and fails
+// with 503 while down is set
+type fakeAuth struct {
+	mu       sync.Mutex
+	keys     JWKSet
+	revoked  RevocationList
+	down     bool
+	requests int
+}
+
+func (f *fakeAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	if f.down {
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	switch r.URL.Path {
+	case "/keys":
+		json.NewEncoder(w).Encode(f.keys)
+	case "/revocations":
+		json.NewEncoder(w).Encode(f.revoked)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeAuth) set(change func(f *fakeAuth)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	change(f)
+}
+
+func TestRemoteKeySetFailsClosed(t *testing.T) {
+	secret := []byte("test-hmac-secret")
+	now := time.Now()
+	key := &Key{ID: "k1", Alg: AlgHS256, NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour),
+		Secret: DeriveHMACKey(secret, "k1")}
+	auth := &fakeAuth{keys: JWKSet{Keys: []JWK{key.JWK()}}, revoked: RevocationList{Revoked: []Revocation{}}}
+	server := httptest.NewServer(auth)
+	defer server.Close()
+
+	raw, err := Sign(Claims{Subject: "ann", ID: "t1", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix(), Scope: ScopeProfile}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := NewRemoteKeySet(server.URL, secret)
+	keys.RefreshInterval = 50 * time.Millisecond
+	if _, err := keys.Verify(raw); err != nil {
+		t.Fatalf("valid token: %v", err)
+	}
+
+	// The token is revoked while the auth service cannot be reached
+	auth.set(func(f *fakeAuth) {
+		f.revoked.Revoked = append(f.revoked.Revoked, Revocation{ID: "t1", ExpiresAt: now.Add(time.Hour).Unix()})
+		f.down = true
+		f.requests = 0
+	})
+	time.Sleep(2 * keys.RefreshInterval)
+	for i := 0; i < 5; i++ {
+		if _, err := keys.Verify(raw); err == nil {
+			t.Fatal("token accepted with keys older than twice RefreshInterval while the auth service is down")
+		}
+	}
+	auth.set(func(f *fakeAuth) {
+		// One failed fetch, and none again until minRefetch passed
+		if f.requests != 1 {
+			t.Errorf("%d requests to the auth service, want 1", f.requests)
+		}
+		f.down = false
+	})
+
+	// Once the auth service is back the revocation is picked up
+	keys.mu.Lock()
+	keys.lastAttempt = time.Time{}
+	keys.mu.Unlock()
+	if _, err := keys.Verify(raw); err != ErrRevoked {
+		t.Errorf("revoked token: %v, want %v", err, ErrRevoked)
+	}
+}
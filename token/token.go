@@ -0,0 +1,178 @@
+// Package token implements the signed auth tokens issued by the auth service.
+//
+// Tokens use the JWT compact form: base64url(header).base64url(claims).
+// base64url(signature). They are signed with HMAC-SHA256 (HS256) or Ed25519
+// (EdDSA) and carry the key ID in the header so verifiers can pick the right
+// key while keys are being rotated.
+package token
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	// AlgHS256 signs tokens with HMAC-SHA256
+	AlgHS256 = "HS256"
+	// AlgEdDSA signs tokens with Ed25519
+	AlgEdDSA = "EdDSA"
+)
+
+// ScopeProfile allows reading the token owner's user details
+const ScopeProfile = "profile"
+
+var (
+	ErrMalformed    = errors.New("token: malformed token")
+	ErrSignature    = errors.New("token: invalid signature")
+	ErrUnknownKey   = errors.New("token: unknown signing key")
+	ErrExpired      = errors.New("token: token expired")
+	ErrRevoked      = errors.New("token: token revoked")
+	ErrUnsupported  = errors.New("token: unsupported algorithm")
+	ErrKeyNotActive = errors.New("token: signing key not valid at this time")
+)
+
+// Claims is the payload carried by a token
+type Claims struct {
+	Subject   string `json:"sub"`
+	ID        string `json:"jti"`
+	SessionID string `json:"sid,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	// Scope is a space separated list of scopes, as in OAuth2
+	Scope string `json:"scope,omitempty"`
+	// ClientID is set on tokens issued to OAuth clients. Those only work
+	// with the auth service's OAuth endpoints, not as a login to the site.
+	ClientID string `json:"client_id,omitempty"`
+	// Roles are the user's roles when the token was issued, see package
+	// authz
+	Roles []string `json:"roles,omitempty"`
+}
+
+// HasScope reports whether the claims grant the given scope
+func (c Claims) HasScope(scope string) bool {
+	for _, s := range strings.Fields(c.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expiry returns the expiry time of the token
+func (c Claims) Expiry() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// KeySource looks up verification keys by key ID
+type KeySource interface {
+	Key(kid string) (*Key, error)
+}
+
+var encoding = base64.RawURLEncoding
+
+// Sign encodes the claims and signs them with key
+func Sign(claims interface{}, key *Key) (string, error) {
+	h, err := json.Marshal(header{Alg: key.Alg, Typ: "JWT", Kid: key.ID})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encoding.EncodeToString(h) + "." + encoding.EncodeToString(c)
+	var sig []byte
+	switch key.Alg {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, key.Secret)
+		mac.Write([]byte(signingInput))
+		sig = mac.Sum(nil)
+	case AlgEdDSA:
+		if key.PrivateKey == nil {
+			return "", ErrUnknownKey
+		}
+		sig = ed25519.Sign(key.PrivateKey, []byte(signingInput))
+	default:
+		return "", ErrUnsupported
+	}
+
+	return signingInput + "." + encoding.EncodeToString(sig), nil
+}
+
+// Parse verifies the token signature against keys and decodes its claims into
+// claims. An expired token still has its claims decoded and returns
+// ErrExpired, so callers that accept expired tokens can use them.
+func Parse(raw string, keys KeySource, claims interface{ Expiry() time.Time }) error {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return ErrMalformed
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return ErrMalformed
+	}
+	sig, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrMalformed
+	}
+
+	key, err := keys.Key(h.Kid)
+	if err != nil {
+		return err
+	}
+	// The algorithm always comes from the key, never from the token
+	if key.Alg != h.Alg {
+		return ErrSignature
+	}
+
+	now := time.Now()
+	if now.Before(key.NotBefore.Add(-time.Minute)) || !now.Before(key.NotAfter) {
+		return ErrKeyNotActive
+	}
+
+	signingInput := parts[0] + "." + parts[1]
+	switch key.Alg {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, key.Secret)
+		mac.Write([]byte(signingInput))
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return ErrSignature
+		}
+	case AlgEdDSA:
+		if !ed25519.Verify(key.PublicKey, []byte(signingInput), sig) {
+			return ErrSignature
+		}
+	default:
+		return ErrUnsupported
+	}
+
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return ErrMalformed
+	}
+	if !now.Before(claims.Expiry()) {
+		return ErrExpired
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := encoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -2,21 +2,51 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"example.com/m/authz"
+	"example.com/m/mailer"
+	"example.com/m/store"
+	"example.com/m/svcauth"
+	"example.com/m/tlsutil"
+	"example.com/m/token"
+	"example.com/m/validate"
 )
 
 // UserDetails represents the structure for user details
-type UserDetails struct {
-	Name  string `json:"name"`
-	Email string `json:"email"`
-	Age   string `json:"age"`
+type UserDetails = store.User
+
+// NewUser is the body of a /register or /useradd request. Only admins
+// adding users with /useradd may set roles, status is set by admins later.
+type NewUser struct {
+	Name        string   `json:"name"`
+	DisplayName string   `json:"display_name"`
+	Email       string   `json:"email"`
+	Age         int      `json:"age"`
+	BirthDate   string   `json:"birth_date"`
+	Roles       []string `json:"roles,omitempty"`
 }
 
-// AuthTokens represents the structure for authentication tokens
-var AuthTokens = make(map[string]string)
+// users holds the shared user data, tokens the auth token records
+var (
+	users  store.UserStore
+	tokens store.TokenStore
+)
+
+// authorizer checks auth tokens against the keys published by the auth
+// service and the roles they carry
+var authorizer *authz.Authorizer
+
+// services authenticates the calls of the other services and signs userinfo's
+// own calls to the auth service
+var services *svcauth.Service
 
 var (
 	// Logger for writing to the console and log file
@@ -37,6 +67,38 @@ func HealthHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 	logger.Println("Health check requested.")
 }
+// authenticate checks the username and Authorization headers. The auth key
+// must be a token issued to that user, verified locally. On failure the error
+// response is written and ok is false.
+func authenticate(w http.ResponseWriter, r *http.Request) (claims *token.Claims, ok bool) {
+	if r.Header.Get("username") == "" || r.Header.Get("Authorization") == "" {
+		http.Error(w, "Missing username or auth_key in headers", http.StatusBadRequest)
+		logger.Println("Missing username or auth_key in headers")
+		return nil, false
+	}
+	claims = authorizer.Authenticate(w, r)
+	return claims, claims != nil
+}
+
+// isAdmin reports whether the token carries the admin role
+func isAdmin(claims *token.Claims) bool {
+	return authz.HasRole(claims.Roles, authz.RoleAdmin)
+}
+
+// authenticateDetails is authenticate for /userdetails, which also backs the
+// auth service's /oauth/userinfo. Requests signed by the auth service may
+// carry the access token of an OAuth client with the openid scope, which the
+// auth service checked was not revoked.
+func authenticateDetails(w http.ResponseWriter, r *http.Request) (*token.Claims, bool) {
+	if svcauth.Caller(r) == "auth" {
+		claims, err := authorizer.Verifier.Verify(r.Header.Get("Authorization"))
+		if err == nil && claims.ClientID != "" && claims.HasScope("openid") && claims.Subject == r.Header.Get("username") {
+			return claims, true
+		}
+	}
+	return authenticate(w, r)
+}
+
 // UserDetailsHandler handles GET requests for user details
 func UserDetailsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -45,51 +107,87 @@ func UserDetailsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Fetch headers
-	username := r.Header.Get("username")
-	authKey := r.Header.Get("Authorization")
+	claims, ok := authenticateDetails(w, r)
+	if !ok {
+		return
+	}
+	username := claims.Subject
 
-	// Validate headers
-	if username == "" || authKey == "" {
-		http.Error(w, "Missing username or auth_key in headers", http.StatusBadRequest)
-		logger.Println("Missing username or auth_key in headers")
+	// Fetch user details
+	userDetails, err := users.GetUser(username)
+	if err == store.ErrNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		logger.Printf("User not found: %s\n", username)
+		return
+	} else if err != nil {
+		http.Error(w, "Error loading user store", http.StatusInternalServerError)
+		logger.Println("Error loading user store:", err)
 		return
 	}
 
-	// Load auth tokens
-	if err := loadAuthTokens("/app/shared_data/authtokens.json"); err != nil {
-		http.Error(w, "Error loading auth tokens", http.StatusInternalServerError)
-		logger.Println("Error loading auth tokens:", err)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(userDetails)
+	logger.Printf("User details fetched for user: %s\n", username)
+}
+
+// RegisterHandler handles POST requests of people signing up for an account,
+// and DELETE /register?name=... undoing a signup whose password could not be
+// stored
+func RegisterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		cancelSignup(w, r.URL.Query().Get("name"))
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST and DELETE methods are allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
 		return
 	}
 
-	// Validate auth key
-	if expectedAuthKey, ok := AuthTokens[username]; !ok || expectedAuthKey != authKey {
-		http.Error(w, "Invalid authentication credentials", http.StatusUnauthorized)
-		logger.Printf("Invalid auth credentials for user: %s\n", username)
+	var newUser NewUser
+	if err := validate.DecodeJSON(r.Body, &newUser); err != nil {
+		writeInputError(w, err)
 		return
 	}
+	if len(newUser.Roles) > 0 {
+		http.Error(w, "Admin access required to set roles", http.StatusForbidden)
+		logger.Printf("Signup of user %s tried to set roles %v\n", newUser.Name, newUser.Roles)
+		return
+	}
+	addUser(w, newUser, "signup")
+}
 
-	// Load user details
-	userStore, err := loadUserStore("/app/shared_data/users.json")
+// cancelSignup removes a pending account that has no password, so the
+// name is not left taken by an account nobody can log in to. Accounts that
+// were verified or have a password are left alone.
+func cancelSignup(w http.ResponseWriter, name string) {
+	user, err := users.GetUser(name)
 	if err != nil {
-		http.Error(w, "Error loading user store", http.StatusInternalServerError)
-		logger.Println("Error loading user store:", err)
+		writeStoreError(w, name, err)
+		return
+	}
+	if _, err := users.GetCredential(name); err != store.ErrNotFound || user.Status != store.StatusPending {
+		if err != nil && err != store.ErrNotFound {
+			writeStoreError(w, name, err)
+			return
+		}
+		http.Error(w, "Only pending accounts without a password can be removed", http.StatusConflict)
+		logger.Printf("Refused to cancel signup of user %s\n", name)
 		return
 	}
 
-	// Fetch user details
-	if userDetails, ok := userStore[username]; ok {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(userDetails)
-		logger.Printf("User details fetched for user: %s\n", username)
-	} else {
-		http.Error(w, "User not found", http.StatusNotFound)
-		logger.Printf("User not found: %s\n", username)
+	if err := users.DeleteUser(name); err != nil {
+		writeStoreError(w, name, err)
+		return
 	}
+	revokeAllTokens(name)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Signup cancelled"))
+	logger.Printf("Signup of user %s cancelled\n", name)
 }
 
-// UserAddHandler handles POST requests to add a new user
+// UserAddHandler handles POST requests of admins adding a user, optionally
+// with roles. It is wrapped in the admin role check.
 func UserAddHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
@@ -97,136 +195,196 @@ func UserAddHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var userDetails UserDetails
+	var newUser NewUser
 	// Parse JSON data from the request body
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&userDetails); err != nil {
-		http.Error(w, "Error parsing JSON data", http.StatusBadRequest)
-		logger.Println("Error parsing JSON data:", err)
+	if err := validate.DecodeJSON(r.Body, &newUser); err != nil {
+		writeInputError(w, err)
 		return
 	}
+	addUser(w, newUser, "admin "+authz.Claims(r).Subject)
+}
 
+// addUser validates and creates a pending account and sends the verification
+// email
+func addUser(w http.ResponseWriter, newUser NewUser, addedBy string) {
 	// Validate form input
-	if userDetails.Name == "" || userDetails.Email == "" || userDetails.Age == "" {
-		http.Error(w, "Missing user details in form submission", http.StatusBadRequest)
-		logger.Println("Missing user details in form submission", userDetails.Name, userDetails.Email, userDetails.Age)
+	errs := validate.User(newUser.Name, newUser.DisplayName, newUser.Email, newUser.Age, newUser.BirthDate)
+	errs.Add("roles", checkRoles(newUser.Roles))
+	if len(errs) > 0 {
+		validate.WriteErrors(w, errs)
+		logger.Printf("Invalid user details for user %s: %v\n", newUser.Name, errs)
 		return
 	}
 
-	// Load user store
-	userStore, err := loadUserStore("/app/shared_data/users.json")
-	if err != nil {
-		http.Error(w, "Error loading user store", http.StatusInternalServerError)
-		logger.Println("Error loading user store:", err)
-		return
+	// New accounts are pending until the link in the verification email is
+	// opened
+	now := time.Now().UTC()
+	userDetails := UserDetails{
+		Name:        newUser.Name,
+		DisplayName: newUser.DisplayName,
+		Email:       newUser.Email,
+		Age:         newUser.Age,
+		BirthDate:   newUser.BirthDate,
+		Roles:       newUser.Roles,
+		Status:      store.StatusPending,
+		CreatedAt:   now,
+		UpdatedAt:   now,
 	}
 
-	// Check if user already exists
-	if _, exists := userStore[userDetails.Name]; exists {
+	// Add new user unless it already exists
+	err := users.CreateUser(userDetails)
+	if err == store.ErrExists {
 		http.Error(w, "User already exists", http.StatusConflict)
 		logger.Printf("Attempted to add an existing user: %s\n", userDetails.Name)
 		return
-	}
-
-	// Add new user
-	userStore[userDetails.Name] = userDetails
-
-	if err := saveUserStore("/app/shared_data/users.json", userStore); err != nil {
+	} else if err != nil {
 		http.Error(w, "Error saving user store", http.StatusInternalServerError)
 		logger.Println("Error saving user store:", err)
 		return
 	}
 
+	if err := sendVerificationEmail(userDetails); err != nil {
+		// Remove the account again so the signup can be retried
+		logger.Printf("Error sending verification email to user %s: %v\n", userDetails.Name, err)
+		if err := users.DeleteUser(userDetails.Name); err != nil {
+			logger.Printf("Error removing unverifiable user %s: %v\n", userDetails.Name, err)
+		}
+		http.Error(w, "Error sending verification email", http.StatusInternalServerError)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("User added successfully"))
-	logger.Printf("User added successfully: %s\n", userDetails.Name)
+	logger.Printf("User added successfully by %s, verification email sent: %s\n", addedBy, userDetails.Name)
 }
 
-// loadAuthTokens loads authentication tokens from a JSON file
-func loadAuthTokens(filename string) error {
-	file, err := os.Open(filename)
-	if err != nil {
-		return err
+// checkRoles returns a validation message unless all roles are known
+func checkRoles(roles []string) string {
+	for _, role := range roles {
+		if !authz.Valid(role) {
+			return "Roles must be admin, user or readonly"
+		}
 	}
-	defer file.Close()
+	return ""
+}
 
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&AuthTokens); err != nil && err.Error() != "EOF" {
-		return err
+// grantAdmins gives the admin role to the named users that exist, so a new
+// deployment has someone to manage roles
+func grantAdmins(names []string) {
+	for _, name := range names {
+		user, err := users.GetUser(name)
+		if err != nil {
+			logger.Printf("Cannot make %s an admin: %v\n", name, err)
+			continue
+		}
+		if slices.Contains(user.Roles, authz.RoleAdmin) {
+			continue
+		}
+		user.Roles = append(user.Roles, authz.RoleAdmin)
+		user.UpdatedAt = time.Now().UTC()
+		if err := users.UpdateUser(user); err != nil {
+			logger.Printf("Error making %s an admin: %v\n", name, err)
+			continue
+		}
+		logger.Println("Granted admin role from ADMIN_USERS to user:", name)
 	}
+}
 
-	return nil
+// writeInputError responds to a request body that could not be decoded,
+// with field errors as JSON where there are some
+func writeInputError(w http.ResponseWriter, err error) {
+	if errs, ok := err.(validate.Errors); ok {
+		validate.WriteErrors(w, errs)
+	} else {
+		http.Error(w, "Error parsing JSON data", http.StatusBadRequest)
+	}
+	logger.Println("Error parsing JSON data:", err)
 }
 
-// loadUserStore loads user details from a JSON file
-func loadUserStore(filename string) (map[string]UserDetails, error) {
-	file, err := os.Open(filename)
+func main() {
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "show the user schema migration without writing it, then exit")
+	flag.Parse()
+
+	// Open log file
+	var err error
+	logFile, err = os.OpenFile("/logs/userinfo.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
 	if err != nil {
-		return nil, err
+		fmt.Println("Error opening log file:", err)
+		os.Exit(1)
 	}
-	defer file.Close()
+	defer logFile.Close()
+	// Set up logger
+	logger = log.New(logFile, "", log.Ldate|log.Ltime|log.Lshortfile)
 
-	var userStore map[string]UserDetails
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&userStore); err != nil && err.Error() != "EOF" {
-		return nil, err
+	users, tokens, err = store.Open(store.ConfigFromEnv())
+	if err != nil {
+		logger.Fatalln("Error opening store:", err)
 	}
 
-	return userStore, nil
-}
+	// Upgrade user records written by older versions before serving
+	migration, err := users.MigrateUsers(*migrateDryRun)
+	if err != nil {
+		logger.Fatalln("Error migrating users:", err)
+	}
+	if *migrateDryRun {
+		fmt.Printf("User schema version %d, current version %d\n", migration.FromVersion, migration.ToVersion)
+		if migration.Needed() {
+			fmt.Printf("Would upgrade %d users: %s\n", len(migration.Users), strings.Join(migration.Users, ", "))
+		}
+		return
+	}
+	if migration.Needed() {
+		logger.Printf("Upgraded %d users from schema version %d to %d\n", len(migration.Users), migration.FromVersion, migration.ToVersion)
+	}
 
-// saveUserStore saves user details to a JSON file
-func saveUserStore(filename string, userStore map[string]UserDetails) error {
-	file, err := os.Create(filename)
+	if err := tlsutil.TrustCAFromEnv(); err != nil {
+		logger.Fatalln("Error loading TLS_CA_FILE:", err)
+	}
+	services, err = svcauth.FromEnv()
 	if err != nil {
-		return err
+		logger.Fatalln("Error setting up service authentication:", err)
 	}
-	defer file.Close()
+	services.Logger = logger
 
-	encoder := json.NewEncoder(file)
-	if err := encoder.Encode(userStore); err != nil {
-		return err
+	authURL := os.Getenv("AUTH_URL")
+	if authURL == "" {
+		authURL = "http://auth:8082"
 	}
+	keys := token.NewRemoteKeySet(authURL, []byte(os.Getenv("TOKEN_HMAC_SECRET")))
+	keys.Client.Transport = &svcauth.Transport{Service: services}
+	authorizer = &authz.Authorizer{Verifier: keys, Logger: logger}
 
-	return nil
-}
-func CheckAndCreateFile(filename string) error {
-	// Check if the file exists
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		// File does not exist, create it
-		file, err := os.Create(filename)
-		if err != nil {
-			return fmt.Errorf("error creating file: %w", err)
-		}
-		defer file.Close()
+	mail, err = mailer.FromEnv()
+	if err != nil {
+		logger.Fatalln("Error setting up mailer:", err)
+	}
+	publicURL = strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+	if publicURL == "" {
+		publicURL = "http://localhost:8080"
+	}
 
-		// Write '{}' to the file
-		_, err = file.Write([]byte("{}"))
-		if err != nil {
-			return fmt.Errorf("error writing to file: %w", err)
+	// Comma separated usernames, e.g. ADMIN_USERS=alice,bob
+	var adminUsers []string
+	for _, name := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			adminUsers = append(adminUsers, name)
 		}
 	}
+	grantAdmins(adminUsers)
 
-	return nil
-}
-func main() {
-	// Open log file
-	var err error
-	logFile, err = os.OpenFile("/logs/userinfo.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
-	if err != nil {
-		fmt.Println("Error opening log file:", err)
-		os.Exit(1)
-	}
-	defer logFile.Close()
-	CheckAndCreateFile("/app/shared_data/users.json")
-	CheckAndCreateFile("/app/shared_data/authtokens.json")
-	// Set up logger
-	logger = log.New(logFile, "", log.Ldate|log.Ltime|log.Lshortfile)
 	http.HandleFunc("/health", HealthHandler)
 	http.HandleFunc("/userdetails", UserDetailsHandler)
-	http.HandleFunc("/useradd", UserAddHandler)
+	http.HandleFunc("/register", RegisterHandler)
+	http.HandleFunc("/useradd", authorizer.Require(authz.RoleAdmin, UserAddHandler))
+	http.HandleFunc("/users", UsersHandler)
+	http.HandleFunc("/users/", UserHandler)
+	http.HandleFunc("/verify", VerifyHandler)
+
+	// Signups and verifications come through the webserver, the user
+	// endpoints check the caller's auth token and role themselves
+	handler := services.Middleware(http.DefaultServeMux, "/health", "/useradd", "/users", "/users/")
 
 	fmt.Println("User server started at http://userinfo:8083")
 	logger.Println("User server started at http://userinfo:8083")
-	log.Fatal(http.ListenAndServe(":8083", nil))
+	log.Fatal(tlsutil.ListenAndServe(":8083", handler, logger))
 }
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/m/authz"
+	"example.com/m/mailer"
+	"example.com/m/store"
+	"example.com/m/svcauth"
+)
+
+// captureMailer keeps the sent messages
+type captureMailer struct {
+	mu       sync.Mutex
+	messages []mailer.Message
+}
+
+func (m *captureMailer) Send(msg mailer.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// verifyToken returns the token of the verification link sent to the address
+func (m *captureMailer) verifyToken(t *testing.T, to string) string {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, msg := range m.messages {
+		if msg.To != to {
+			continue
+		}
+		_, link, ok := strings.Cut(msg.Body, publicURL+"/verify?")
+		if !ok {
+			break
+		}
+		query, _ := url.ParseQuery(strings.Fields(link)[0])
+		return query.Get("token")
+	}
+	t.Fatalf("no verification link sent to %s", to)
+	return ""
+}
+
+// TestUserAddConcurrent sends parallel /useradd requests while the auth
+// service, through its own store on the same directory, sets passwords and
+// logs users in, and checks that every account ends up complete
+func TestUserAddConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	userinfo, err := store.NewJSONStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := store.NewJSONStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupTest(t, userinfo, userinfo)
+	captured := &captureMailer{}
+	mail, publicURL = captured, "http://localhost:8080"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/useradd", authorizer.Require(authz.RoleAdmin, UserAddHandler))
+	mux.HandleFunc("/verify", VerifyHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	post := func(path, authKey string, body interface{}) (int, string) {
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest(http.MethodPost, server.URL+path, bytes.NewReader(data))
+		if authKey != "" {
+			req.Header.Set("Authorization", authKey)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer resp.Body.Close()
+		var text bytes.Buffer
+		text.ReadFrom(resp.Body)
+		return resp.StatusCode, text.String()
+	}
+
+	const n = 20
+	now := time.Now().UTC()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("user%02d", i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			status, text := post("/useradd", "admin-token", NewUser{Name: name, Email: name + "@example.com", Age: 30})
+			if status != http.StatusOK {
+				t.Errorf("/useradd %s: status %d: %s", name, status, text)
+			}
+		}()
+		// The auth service records logins of other users meanwhile
+		go func() {
+			defer wg.Done()
+			err := auth.UpdateTokens(func(authTokens map[string]store.Token) error {
+				authTokens["login-"+name] = store.Token{Username: "boss", SessionID: "session-" + name, IssuedAt: now, ExpiresAt: now.Add(time.Hour)}
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every user can set a password and verify the address
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("user%02d", i)
+		link := captured.verifyToken(t, name+"@example.com")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := auth.CreateCredential(name, store.Credential{PasswordHash: "hash-" + name}); err != nil {
+				t.Errorf("credential of %s: %v", name, err)
+			}
+			status, text := post("/verify", "", VerifyRequest{Token: link})
+			if status != http.StatusOK {
+				t.Errorf("/verify %s: status %d: %s", name, status, text)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// A fresh store reads everything from disk
+	s, err := store.NewJSONStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authTokens, err := s.Tokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("user%02d", i)
+		if user, err := s.GetUser(name); err != nil || user.Status != store.StatusActive {
+			t.Errorf("user %s: %+v, %v", name, user, err)
+		}
+		if c, err := s.GetCredential(name); err != nil || c.PasswordHash != "hash-"+name {
+			t.Errorf("credential of %s: %+v, %v", name, c, err)
+		}
+		if _, ok := authTokens["login-"+name]; !ok {
+			t.Errorf("login token recorded with %s lost", name)
+		}
+	}
+}
+
+// TestUserDetailsForwardedToken checks that the access token of an OAuth
+// client is only accepted when the auth service forwards it
+func TestUserDetailsForwardedToken(t *testing.T) {
+	s := store.NewMemoryStore()
+	setupTest(t, s, s)
+	now := time.Now().UTC()
+	if err := s.CreateUser(store.User{Name: "ann", Email: "ann@example.com", Status: store.StatusActive, CreatedAt: now, UpdatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string][]byte{
+		"auth":      []byte("auth-service-test-key"),
+		"webserver": []byte("webserver-service-test-key"),
+		"userinfo":  []byte("userinfo-service-test-key"),
+	}
+	services = &svcauth.Service{Name: "userinfo", Key: keys["userinfo"], Logger: logger,
+		Trusted: map[string][]byte{"auth": keys["auth"], "webserver": keys["webserver"]}}
+	server := httptest.NewServer(services.Middleware(http.HandlerFunc(UserDetailsHandler)))
+	defer server.Close()
+
+	tests := []struct {
+		caller, authKey string
+		want            int
+	}{
+		{"auth", "ann-client", http.StatusOK},
+		{"webserver", "ann-client", http.StatusUnauthorized},
+		{"webserver", "ann-token", http.StatusOK},
+		{"auth", "ann-token", http.StatusOK},
+	}
+	for _, tt := range tests {
+		caller := &svcauth.Service{Name: tt.caller, Key: keys[tt.caller], Logger: logger,
+			Trusted: map[string][]byte{"userinfo": keys["userinfo"]}}
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/userdetails", nil)
+		req.Header.Set("Authorization", tt.authKey)
+		req.Header.Set("username", "ann")
+		resp, err := caller.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s with %s: status %d, want %d", tt.caller, tt.authKey, resp.StatusCode, tt.want)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/m/authz"
+	"example.com/m/store"
+	"example.com/m/token"
+	"example.com/m/validate"
+)
+
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+)
+
+// UserList is one page of the admin user listing
+type UserList struct {
+	Users   []UserDetails `json:"users"`
+	Page    int           `json:"page"`
+	PerPage int           `json:"per_page"`
+	Total   int           `json:"total"`
+}
+
+// UserPatch holds the fields of a PUT or PATCH request. PATCH keeps the
+// fields left out, PUT clears them, except roles and status which only
+// admins can change.
+type UserPatch struct {
+	Name        *string   `json:"name"`
+	DisplayName *string   `json:"display_name"`
+	Email       *string   `json:"email"`
+	Age         *int      `json:"age"`
+	BirthDate   *string   `json:"birth_date"`
+	Roles       *[]string `json:"roles"`
+	Status      *string   `json:"status"`
+}
+
+// UsersHandler lists all users for admins, GET /users. The list is ordered by
+// name and paged with page and per_page, email_domain keeps only the users
+// with an email address in that domain.
+func UsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	claims, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	username := claims.Subject
+	if !isAdmin(claims) {
+		http.Error(w, "Admin access required", http.StatusForbidden)
+		logger.Printf("User %s is not allowed to list users\n", username)
+		return
+	}
+
+	query := r.URL.Query()
+	page, err := queryInt(query.Get("page"), 1)
+	if err != nil || page < 1 {
+		http.Error(w, "Invalid page", http.StatusBadRequest)
+		logger.Println("Invalid page:", query.Get("page"))
+		return
+	}
+	perPage, err := queryInt(query.Get("per_page"), defaultPerPage)
+	if err != nil || perPage < 1 || perPage > maxPerPage {
+		http.Error(w, "Invalid per_page, must be between 1 and 100", http.StatusBadRequest)
+		logger.Println("Invalid per_page:", query.Get("per_page"))
+		return
+	}
+
+	all, err := users.ListUsers()
+	if err != nil {
+		http.Error(w, "Error loading user store", http.StatusInternalServerError)
+		logger.Println("Error loading user store:", err)
+		return
+	}
+
+	list := all
+	if domain := query.Get("email_domain"); domain != "" {
+		list = []UserDetails{}
+		for _, user := range all {
+			if emailDomain(user.Email) == strings.ToLower(domain) {
+				list = append(list, user)
+			}
+		}
+	}
+
+	result := UserList{Users: []UserDetails{}, Page: page, PerPage: perPage, Total: len(list)}
+	if start := (page - 1) * perPage; start < len(list) {
+		end := start + perPage
+		if end > len(list) {
+			end = len(list)
+		}
+		result.Users = list[start:end]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+	logger.Printf("User list page %d fetched by admin %s\n", page, username)
+}
+
+// UserHandler reads (GET), replaces (PUT), updates (PATCH) or deletes (DELETE)
+// a single user, /users/{name}. Users may manage their own account, admins
+// any account. Readonly users can only read their own.
+func UserHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/users/")
+	if name == "" || strings.Contains(name, "/") {
+		http.Error(w, "Invalid username", http.StatusBadRequest)
+		logger.Println("Invalid username in URL:", r.URL.Path)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		http.Error(w, "Only GET, PUT, PATCH and DELETE methods are allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	claims, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	username := claims.Subject
+	if username != name && !isAdmin(claims) {
+		http.Error(w, "Not allowed to access this user", http.StatusForbidden)
+		logger.Printf("User %s is not allowed to access user %s\n", username, name)
+		return
+	}
+	if r.Method != http.MethodGet && !authz.HasRole(claims.Roles, authz.RoleUser) {
+		http.Error(w, "Read-only accounts cannot be changed", http.StatusForbidden)
+		logger.Printf("Readonly user %s is not allowed to %s user %s\n", username, r.Method, name)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		getUser(w, name)
+	case http.MethodPut, http.MethodPatch:
+		updateUser(w, r, name, claims)
+	case http.MethodDelete:
+		deleteUser(w, name, username)
+	}
+}
+
+func getUser(w http.ResponseWriter, name string) {
+	userDetails, err := users.GetUser(name)
+	if err != nil {
+		writeStoreError(w, name, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(userDetails)
+	logger.Printf("User details fetched for user: %s\n", name)
+}
+
+// userLocks holds a mutex per user, see lockUser
+var userLocks sync.Map
+
+// lockUser serialises the read-modify-write of a user's record, so two
+// updates of different fields do not overwrite each other. The returned
+// function releases the lock.
+func lockUser(name string) func() {
+	m, _ := userLocks.LoadOrStore(name, &sync.Mutex{})
+	mu := m.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// updateUser changes the profile with PUT or PATCH, see UserPatch. The name
+// cannot be changed. Invalid values are reported per field like in
+// UserAddHandler. Disabling an account or changing its roles revokes its
+// auth tokens, so the new roles apply from the next login. A new email
+// address puts the account back to pending until the address is verified.
+func updateUser(w http.ResponseWriter, r *http.Request, name string, claims *token.Claims) {
+	updatedBy := claims.Subject
+	var patch UserPatch
+	if err := validate.DecodeJSON(r.Body, &patch); err != nil {
+		writeInputError(w, err)
+		return
+	}
+
+	if (patch.Roles != nil || patch.Status != nil) && !isAdmin(claims) {
+		http.Error(w, "Admin access required to change roles or status", http.StatusForbidden)
+		logger.Printf("User %s is not allowed to change roles or status of %s\n", updatedBy, name)
+		return
+	}
+
+	defer lockUser(name)()
+	userDetails, err := users.GetUser(name)
+	if err != nil {
+		writeStoreError(w, name, err)
+		return
+	}
+	previous := userDetails
+	wasDisabled := userDetails.Status == store.StatusDisabled
+	oldRoles := userDetails.Roles
+
+	put := r.Method == http.MethodPut
+	if put || patch.DisplayName != nil {
+		userDetails.DisplayName = deref(patch.DisplayName)
+	}
+	if put || patch.Email != nil {
+		userDetails.Email = deref(patch.Email)
+	}
+	if put || patch.Age != nil {
+		userDetails.Age = 0
+		if patch.Age != nil {
+			userDetails.Age = *patch.Age
+		}
+	}
+	if put || patch.BirthDate != nil {
+		userDetails.BirthDate = deref(patch.BirthDate)
+	}
+	if patch.Roles != nil {
+		userDetails.Roles = *patch.Roles
+	}
+	if patch.Status != nil {
+		userDetails.Status = *patch.Status
+	}
+
+	// Only check what the request changes, so records migrated without a
+	// valid age can still be edited
+	var errs validate.Errors
+	if patch.Name != nil && *patch.Name != name {
+		errs.Add("name", "Username cannot be changed")
+	}
+	if put || patch.DisplayName != nil {
+		errs.Add("display_name", validate.DisplayName(userDetails.DisplayName))
+	}
+	if put || patch.Email != nil {
+		errs.Add("email", validate.Email(userDetails.Email))
+	}
+	if put || patch.Age != nil || patch.BirthDate != nil {
+		errs.Add(validate.AgeOrBirthDate(userDetails.Age, userDetails.BirthDate))
+	}
+	if patch.Roles != nil {
+		errs.Add("roles", checkRoles(userDetails.Roles))
+	}
+	switch userDetails.Status {
+	case store.StatusActive, store.StatusDisabled, store.StatusPending:
+	default:
+		errs.Add("status", "Status must be active, disabled or pending")
+	}
+	if len(errs) > 0 {
+		validate.WriteErrors(w, errs)
+		logger.Printf("Invalid update of user %s: %v\n", name, errs)
+		return
+	}
+
+	// The new address has to be verified like at signup, unless an admin
+	// sets the status along with it
+	reverify := !strings.EqualFold(userDetails.Email, previous.Email) && patch.Status == nil &&
+		userDetails.Status == store.StatusActive
+	if reverify {
+		userDetails.Status = store.StatusPending
+	}
+
+	userDetails.UpdatedAt = time.Now().UTC()
+	if err := users.UpdateUser(userDetails); err != nil {
+		writeStoreError(w, name, err)
+		return
+	}
+	if reverify {
+		// Log the account out first, revoking also drops one-time tokens
+		revokeAllTokens(name)
+		if err := sendVerificationEmail(userDetails); err != nil {
+			// Keep the old, verified address so the change can be retried,
+			// and only undo the change of address
+			logger.Printf("Error sending verification email to user %s: %v\n", name, err)
+			current, err := users.GetUser(name)
+			if err == nil {
+				current.Email, current.Status = previous.Email, previous.Status
+				current.UpdatedAt = time.Now().UTC()
+				err = users.UpdateUser(current)
+			}
+			if err != nil {
+				logger.Printf("Error restoring user %s: %v\n", name, err)
+			}
+			http.Error(w, "Error sending verification email", http.StatusInternalServerError)
+			return
+		}
+		logger.Printf("Email address of user %s changed, verification email sent\n", name)
+	}
+	if (userDetails.Status == store.StatusDisabled && !wasDisabled) || !slices.Equal(userDetails.Roles, oldRoles) {
+		revokeAllTokens(name)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(userDetails)
+	logger.Printf("User %s updated by %s\n", name, updatedBy)
+}
+
+// deleteUser removes the user and their password and revokes all their auth
+// tokens
+func deleteUser(w http.ResponseWriter, name, deletedBy string) {
+	if err := users.DeleteUser(name); err != nil {
+		writeStoreError(w, name, err)
+		return
+	}
+
+	// The account is already gone, so the deletion is reported even if the
+	// tokens could not be revoked
+	revokeAllTokens(name)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("User deleted successfully"))
+	logger.Printf("User %s deleted by %s\n", name, deletedBy)
+}
+
+// revokeAllTokens revokes the auth tokens of a deleted or disabled user, or
+// one whose roles changed
+func revokeAllTokens(name string) {
+	err := tokens.UpdateTokens(func(authTokens map[string]store.Token) error {
+		store.RevokeUserTokens(authTokens, name)
+		return nil
+	})
+	if err != nil {
+		logger.Printf("Error revoking tokens of user %s: %v\n", name, err)
+	}
+}
+
+func writeStoreError(w http.ResponseWriter, name string, err error) {
+	if err == store.ErrNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		logger.Printf("User not found: %s\n", name)
+		return
+	}
+	http.Error(w, "Error accessing user store", http.StatusInternalServerError)
+	logger.Println("Error accessing user store:", err)
+}
+
+// deref returns the string s points to, or "" if s is nil
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// queryInt parses an integer query parameter, def is used when it is empty
+func queryInt(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// emailDomain returns the lower case domain part of an email address
+func emailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(email[at+1:])
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/m/authz"
+	"example.com/m/store"
+	"example.com/m/token"
+)
+
+// fakeVerifier accepts the auth tokens it holds, keyed by the raw token
+type fakeVerifier map[string]*token.Claims
+
+func (v fakeVerifier) Verify(raw string) (*token.Claims, error) {
+	claims, ok := v[raw]
+	if !ok {
+		return nil, token.ErrSignature
+	}
+	return claims, nil
+}
+
+// setupTest points the userinfo service's globals at the stores, with an
+// authorizer that accepts the token "admin-token" of the admin boss,
+// "ann-token" of the user ann and "ann-client", ann's access token of an
+// OAuth client
+func setupTest(t *testing.T, userStore store.UserStore, tokenStore store.TokenStore) {
+	t.Helper()
+	logger = log.New(io.Discard, "", 0)
+	users, tokens = userStore, tokenStore
+	authorizer = &authz.Authorizer{Logger: logger, Verifier: fakeVerifier{
+		"admin-token": {Subject: "boss", Scope: token.ScopeProfile, Roles: authz.Effective([]string{authz.RoleAdmin})},
+		"ann-token":   {Subject: "ann", Scope: token.ScopeProfile, Roles: authz.Effective(nil)},
+		"ann-client":  {Subject: "ann", Scope: "openid profile", ClientID: "demo-client"},
+	}}
+}
+
+// slowUpdates takes a while to save a user, like a busy disk, so concurrent
+// requests overlap
+type slowUpdates struct {
+	store.UserStore
+}
+
+func (s slowUpdates) UpdateUser(user store.User) error {
+	time.Sleep(100 * time.Millisecond)
+	return s.UserStore.UpdateUser(user)
+}
+
+func TestPatchUserConcurrent(t *testing.T) {
+	s := store.NewMemoryStore()
+	setupTest(t, slowUpdates{s}, s)
+	now := time.Now().UTC()
+	err := s.CreateUser(store.User{Name: "ann", Email: "ann@example.com", Age: 30, Status: store.StatusActive, CreatedAt: now, UpdatedAt: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two requests changing different fields at the same time
+	patches := []string{`{"display_name": "Ann Smith"}`, `{"birth_date": "1990-05-17"}`}
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, patch := range patches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPatch, "/users/ann", strings.NewReader(patch))
+			req.Header.Set("username", "ann")
+			req.Header.Set("Authorization", "ann-token")
+			w := httptest.NewRecorder()
+			<-start
+			UserHandler(w, req)
+			if w.Code != http.StatusOK {
+				t.Errorf("PATCH %s: status %d: %s", patch, w.Code, w.Body)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	user, err := s.GetUser("ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.DisplayName != "Ann Smith" || user.BirthDate != "1990-05-17" {
+		t.Errorf("display name %q, birth date %q: an update was lost", user.DisplayName, user.BirthDate)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"example.com/m/mailer"
+	"example.com/m/store"
+)
+
+// verifyTokenTTL is how long the link in a verification email works
+const verifyTokenTTL = 24 * time.Hour
+
+var (
+	// mail sends the verification emails
+	mail mailer.Mailer
+	// publicURL is the address of the webserver, used in the links in emails
+	publicURL string
+)
+
+// VerifyRequest is the body of a /verify request
+type VerifyRequest struct {
+	Token string `json:"token"`
+}
+
+// sendVerificationEmail issues a verification token for a new user and
+// mails the link that activates the account
+func sendVerificationEmail(user UserDetails) error {
+	var secret string
+	err := tokens.UpdateTokens(func(authTokens map[string]store.Token) error {
+		var err error
+		secret, err = store.IssueOneTimeToken(authTokens, user.Name, store.PurposeVerifyEmail, verifyTokenTTL)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	link := publicURL + "/verify?token=" + url.QueryEscape(secret)
+	return mail.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Hello %s,\n\nplease confirm your email address to activate your account:\n\n%s\n\n"+
+			"The link works once and expires in %d hours. If you did not sign up, you can ignore this email.\n",
+			user.Name, link, int(verifyTokenTTL.Hours())),
+	})
+}
+
+// VerifyHandler activates a pending account with the token from its
+// verification email, POST /verify
+func VerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		logger.Println("Invalid request method:", r.Method)
+		return
+	}
+
+	var req VerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "Missing verification token", http.StatusBadRequest)
+		logger.Println("Missing verification token:", err)
+		return
+	}
+
+	var record store.Token
+	err := tokens.UpdateTokens(func(authTokens map[string]store.Token) error {
+		var err error
+		record, err = store.UseOneTimeToken(authTokens, req.Token, store.PurposeVerifyEmail)
+		return err
+	})
+	if err == store.ErrNotFound {
+		http.Error(w, "Invalid or expired verification link", http.StatusBadRequest)
+		logger.Println("Invalid or expired verification token")
+		return
+	} else if err != nil {
+		http.Error(w, "Error updating tokens", http.StatusInternalServerError)
+		logger.Println("Error updating tokens:", err)
+		return
+	}
+
+	defer lockUser(record.Username)()
+	userDetails, err := users.GetUser(record.Username)
+	if err != nil {
+		writeStoreError(w, record.Username, err)
+		return
+	}
+	// Verifying again is harmless, but a disabled account stays disabled
+	if userDetails.Status == store.StatusPending {
+		userDetails.Status = store.StatusActive
+		userDetails.UpdatedAt = time.Now().UTC()
+		if err := users.UpdateUser(userDetails); err != nil {
+			writeStoreError(w, record.Username, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email address verified", "username": userDetails.Name})
+	logger.Printf("Email address verified for user: %s\n", userDetails.Name)
+}
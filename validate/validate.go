@@ -0,0 +1,248 @@
+// Package validate checks user input shared by the services and the signup
+// form. Problems are reported per field so APIs can return them as JSON and
+// the webserver can show each message next to its input.
+package validate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	MinUsernameLength = 3
+	MaxUsernameLength = 32
+	MinPasswordLength = 8
+	// MaxPasswordLength is the longest password bcrypt hashes in full
+	MaxPasswordLength = 72
+	MaxEmailLength    = 254
+	MinAge            = 13
+	MaxAge            = 120
+
+	MaxDisplayNameLength = 64
+)
+
+// FieldError describes why the value of one field was rejected
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Errors holds the field errors of a request, in the order they were found
+type Errors []FieldError
+
+// Response is the JSON body of a response rejecting invalid input
+type Response struct {
+	Errors Errors `json:"errors"`
+}
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Field + ": " + fe.Message
+	}
+	return "invalid input: " + strings.Join(msgs, "; ")
+}
+
+// Add records an error for field, an empty message is ignored so the result
+// of a check can be added directly
+func (e *Errors) Add(field, message string) {
+	if message != "" {
+		*e = append(*e, FieldError{Field: field, Message: message})
+	}
+}
+
+// For returns the first message for field, or "" if it has none
+func (e Errors) For(field string) string {
+	for _, fe := range e {
+		if fe.Field == field {
+			return fe.Message
+		}
+	}
+	return ""
+}
+
+// Err returns the errors as an error, or nil if there are none
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Username checks the length and characters of a username: letters, digits,
+// '.', '_' and '-', starting with a letter or digit
+func Username(name string) string {
+	if name == "" {
+		return "Username is required"
+	}
+	if len(name) < MinUsernameLength || len(name) > MaxUsernameLength {
+		return fmt.Sprintf("Username must be %d to %d characters long", MinUsernameLength, MaxUsernameLength)
+	}
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case i > 0 && (c == '.' || c == '_' || c == '-'):
+		default:
+			return "Username may only contain letters, digits, '.', '_' and '-', and must start with a letter or digit"
+		}
+	}
+	return ""
+}
+
+// Email checks that email is a plain address like name@example.com
+func Email(email string) string {
+	if email == "" {
+		return "Email is required"
+	}
+	if len(email) > MaxEmailLength {
+		return fmt.Sprintf("Email must be at most %d characters long", MaxEmailLength)
+	}
+	// ParseAddress also accepts forms like "Name <name@example.com>"
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || !strings.Contains(email[strings.LastIndex(email, "@"):], ".") {
+		return "Email is not a valid address"
+	}
+	return ""
+}
+
+// Age checks that age is in the allowed range
+func Age(age int) string {
+	if age < MinAge || age > MaxAge {
+		return fmt.Sprintf("Age must be between %d and %d", MinAge, MaxAge)
+	}
+	return ""
+}
+
+// ParseAge parses the age entered in a form, the message is set if it is not
+// a valid age
+func ParseAge(age string) (int, string) {
+	if age == "" {
+		return 0, "Age is required"
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(age))
+	if err != nil {
+		return 0, "Age must be a whole number"
+	}
+	return n, Age(n)
+}
+
+// BirthDate checks a date of birth formatted as YYYY-MM-DD, the resulting age
+// must be in the allowed range
+func BirthDate(date string, now time.Time) string {
+	birth, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return "Birth date must be a date like 2000-12-31"
+	}
+	age := now.Year() - birth.Year()
+	if now.Month() < birth.Month() || (now.Month() == birth.Month() && now.Day() < birth.Day()) {
+		age--
+	}
+	if Age(age) != "" {
+		return fmt.Sprintf("Birth date must give an age between %d and %d", MinAge, MaxAge)
+	}
+	return ""
+}
+
+// DisplayName checks the optional name shown instead of the username
+func DisplayName(name string) string {
+	if utf8.RuneCountInString(name) > MaxDisplayNameLength {
+		return fmt.Sprintf("Display name must be at most %d characters long", MaxDisplayNameLength)
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) {
+			return "Display name cannot contain control characters"
+		}
+	}
+	return ""
+}
+
+// Password checks the length of a new password
+func Password(password string) string {
+	if password == "" {
+		return "Password is required"
+	}
+	if len(password) < MinPasswordLength || len(password) > MaxPasswordLength {
+		return fmt.Sprintf("Password must be %d to %d characters long", MinPasswordLength, MaxPasswordLength)
+	}
+	return ""
+}
+
+// User checks the details of a new user. Either the age or the birth date
+// is required, the birth date is checked if both are given.
+func User(name, displayName, email string, age int, birthDate string) Errors {
+	var errs Errors
+	errs.Add("name", Username(name))
+	errs.Add("display_name", DisplayName(displayName))
+	errs.Add("email", Email(email))
+	errs.Add(AgeOrBirthDate(age, birthDate))
+	return errs
+}
+
+// AgeOrBirthDate checks the birth date if there is one, the age otherwise,
+// and returns the field the message is about
+func AgeOrBirthDate(age int, birthDate string) (field, message string) {
+	if birthDate != "" {
+		return "birth_date", BirthDate(birthDate, time.Now())
+	}
+	if age == 0 {
+		return "age", "Age or birth date is required"
+	}
+	return "age", Age(age)
+}
+
+// DecodeJSON decodes a JSON request body into v, rejecting fields v does not
+// have. An unknown field is reported as a field error, other problems with
+// the body as a plain error.
+func DecodeJSON(r io.Reader, v interface{}) error {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err == nil {
+		return nil
+	}
+
+	// encoding/json has no error type for unknown fields
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		field, _ = strconv.Unquote(field)
+		return Errors{{Field: field, Message: "Unknown field"}}
+	}
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok && typeErr.Field != "" {
+		return Errors{{Field: typeErr.Field, Message: "Must be " + jsonType(typeErr.Type.Kind())}}
+	}
+	return err
+}
+
+// jsonType describes the JSON value expected for a Go kind
+func jsonType(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a whole number"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	default:
+		return "a " + kind.String()
+	}
+}
+
+// WriteErrors responds with 400 Bad Request and the field errors as JSON
+func WriteErrors(w http.ResponseWriter, errs Errors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(Response{Errors: errs})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// Category is a product category of productlist
+type Category struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Parent string `json:"parent"`
+}
+
+// CategoryDetails is a category with its parents, top-level first, and its
+// subcategories, as returned by GET /categories/{id} of productlist
+type CategoryDetails struct {
+	Category
+	Children []Category `json:"children"`
+	Path     []Category `json:"path"`
+}
+
+// CategoryPage is the data of the pages browsing the products and services,
+// a page of the products in the selected category and its subcategories
+type CategoryPage struct {
+	HomePage
+	// Page is the path of the page, /products or /services
+	Page     string
+	Category CategoryDetails
+}
+
+// CategoryPageHandler serves the page of the top-level category root. The
+// category parameter selects one of its subcategories, the other parameters
+// are those of the home page.
+func CategoryPageHandler(root string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("category") == "" {
+			query.Set("category", root)
+		}
+		selected := query.Get("category")
+		log.Printf("CategoryPageHandler: Fetching category %s\n", selected)
+
+		page := CategoryPage{Page: "/" + root}
+		found, err := fetchCategory(selected, &page.Category)
+		if err != nil {
+			log.Printf("ERROR: CategoryPageHandler: Error fetching category %s - %v\n", selected, err)
+			http.Error(w, "Unable to fetch products", http.StatusInternalServerError)
+			return
+		}
+		if !found || page.Category.Path[0].ID != root {
+			log.Printf("CategoryPageHandler: Category %s not found under %s\n", selected, root)
+			http.NotFound(w, r)
+			return
+		}
+
+		status, err := fetchProducts(query, page.Page, &page.HomePage)
+		if err != nil {
+			log.Printf("ERROR: CategoryPageHandler: Error fetching products - %v\n", err)
+			http.Error(w, "Unable to fetch products", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("CategoryPageHandler: Successfully fetched %d products of category %s\n", len(page.Products), selected)
+		w.WriteHeader(status)
+		render(w, r, "category.html", page)
+	}
+}
+
+// fetchCategory gets a category from productlist. It returns false if there
+// is no such category.
+func fetchCategory(id string, details *CategoryDetails) (bool, error) {
+	resp, err := backend.Get(productlistURL + "/categories/" + url.PathEscape(id))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status code %d from categories API", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(details); err != nil {
+		return false, fmt.Errorf("parsing category data: %w", err)
+	}
+	return len(details.Path) > 0, nil
+}
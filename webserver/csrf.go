@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+	"log"
+	"net/http"
+)
+
+const (
+	// csrfCookie holds the browser's CSRF secret, csrfField the token derived
+	// from it in every form
+	csrfCookie = "csrf"
+	csrfField  = "csrf_token"
+)
+
+type csrfTokenKey struct{}
+
+// ErrorPage is the data of the error page
+type ErrorPage struct {
+	Title   string
+	Message string
+}
+
+// templateFuncs are available to all templates. The functions that depend on
+// the request are replaced by render.
+var templateFuncs = template.FuncMap{
+	"csrfField": func() template.HTML { return "" },
+	"price":     formatPrice,
+}
+
+// newCSRFSecret sets a new CSRF secret cookie and returns the secret
+func newCSRFSecret(w http.ResponseWriter) string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	setCookie(w, &http.Cookie{Name: csrfCookie, Value: secret, Path: "/", HttpOnly: true})
+	return secret
+}
+
+// csrfToken derives the form token from the browser's secret. Signing it
+// means a cookie planted by another site cannot be paired with a token
+// without knowing SESSION_SECRET.
+func csrfToken(secret string) string {
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write([]byte("csrf:" + secret))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// csrfProtect checks the CSRF token of every request that is not a GET or
+// HEAD against the browser's secret cookie, and gives browsers without one a
+// secret. The secret is replaced on every login, see startSession.
+func csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var secret string
+		if cookie, err := r.Cookie(csrfCookie); err == nil {
+			secret = cookie.Value
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if secret == "" || !hmac.Equal([]byte(r.FormValue(csrfField)), []byte(csrfToken(secret))) {
+				log.Printf("csrfProtect: Invalid CSRF token for %s %s from %s\n", r.Method, r.URL.Path, clientIP(r))
+				if secret == "" {
+					secret = newCSRFSecret(w)
+				}
+				r = r.WithContext(context.WithValue(r.Context(), csrfTokenKey{}, csrfToken(secret)))
+				renderError(w, r, http.StatusForbidden, "Form expired",
+					"This form was sent from an old or another page. Please go back, reload the page and try again.")
+				return
+			}
+		}
+
+		if secret == "" {
+			secret = newCSRFSecret(w)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfTokenKey{}, csrfToken(secret))))
+	})
+}
+
+// render executes a template with the request's CSRF token available to it,
+// {{csrfField}} adds it to a form
+func render(w http.ResponseWriter, r *http.Request, name string, data interface{}) {
+	t, err := tmpl.Clone()
+	if err != nil {
+		log.Printf("ERROR: render: Error cloning templates - %v\n", err)
+		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+		return
+	}
+	token, _ := r.Context().Value(csrfTokenKey{}).(string)
+	t.Funcs(template.FuncMap{
+		"csrfField": func() template.HTML {
+			return template.HTML(`<input type="hidden" name="` + csrfField + `" value="` + template.HTMLEscapeString(token) + `">`)
+		},
+	})
+	if err := t.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("ERROR: render: Error rendering %s - %v\n", name, err)
+	}
+}
+
+// renderError shows the error page with the status code
+func renderError(w http.ResponseWriter, r *http.Request, status int, title, message string) {
+	w.WriteHeader(status)
+	render(w, r, "error.html", ErrorPage{Title: title, Message: message})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/base64"
+	"log"
+	"net/http"
+	"time"
+)
+
+// flashCookie carries a message to the next page shown, e.g. after logging
+// out
+const flashCookie = "flash"
+
+// LogoutPage is the data of the page asking whether to log out here or on
+// every device
+type LogoutPage struct {
+	Username string
+}
+
+// setFlash shows message on the next page that displays messages
+func setFlash(w http.ResponseWriter, message string) {
+	setCookie(w, &http.Cookie{
+		Name:     flashCookie,
+		Value:    base64.RawURLEncoding.EncodeToString([]byte(message)),
+		Path:     "/",
+		HttpOnly: true,
+		MaxAge:   60,
+	})
+}
+
+// popFlash returns the flash message, if any, and removes it so it is only
+// shown once
+func popFlash(w http.ResponseWriter, r *http.Request) string {
+	cookie, err := r.Cookie(flashCookie)
+	if err != nil {
+		return ""
+	}
+	setCookie(w, &http.Cookie{
+		Name:     flashCookie,
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		Expires:  time.Now().Add(-24 * time.Hour), // Set to a past date to delete
+	})
+	message, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return ""
+	}
+	return string(message)
+}
+
+// LogoutHandler asks whether to log out (GET) and logs out (POST): it
+// revokes the auth token with the auth service and ends the browser's
+// session. With everywhere set, all sessions of the user are revoked and
+// ended, on every device.
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	session, ok := currentSession(r)
+	if r.Method != http.MethodPost {
+		if !ok {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		log.Println("LogoutHandler: Serving logout page")
+		render(w, r, "logout.html", LogoutPage{Username: session.Username})
+		return
+	}
+
+	message := "You have been logged out."
+	if ok {
+		everywhere := r.FormValue("everywhere") != ""
+		method, path := "POST", "/logout"
+		if everywhere {
+			method, path = "DELETE", "/sessions"
+		}
+
+		revoked := false
+		resp, err := authAPIRequest(r, session.AuthToken, session.Username, method, path, nil)
+		if err != nil {
+			log.Printf("ERROR: LogoutHandler: Error revoking auth token of user %s - %v\n", session.Username, err)
+		} else {
+			resp.Body.Close()
+			revoked = resp.StatusCode == http.StatusOK
+			if !revoked {
+				log.Printf("LogoutHandler: Revoking auth token of user %s failed - status code %d\n", session.Username, resp.StatusCode)
+			}
+		}
+
+		if everywhere {
+			// The other browsers' sessions would only fail on their next
+			// request to a backend, end them right away
+			if err := sessions.DeleteUser(session.Username); err != nil {
+				log.Printf("ERROR: LogoutHandler: Error deleting sessions of user %s - %v\n", session.Username, err)
+			}
+			message = "You have been logged out on all devices."
+			if !revoked {
+				message = "You have been logged out here, but your other sessions could not be ended. Please log in and try again."
+			}
+		}
+		log.Printf("LogoutHandler: Logged out user %s (everywhere: %t)\n", session.Username, everywhere)
+	}
+
+	endSession(w, r)
+	setFlash(w, message)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
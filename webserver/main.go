@@ -6,22 +6,45 @@ import (
 	"html/template"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
+
+	"example.com/m/money"
+	"example.com/m/svcauth"
+	"example.com/m/tlsutil"
+	"example.com/m/validate"
 )
 
 type TokenResponse struct {
-	AuthToken string `json:"auth_token"`
-	Message   string `json:"message"`
+	AuthToken string    `json:"auth_token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	ExpiresIn int64     `json:"expires_in"`
+	Message   string    `json:"message"`
+	// Username is the user the token was issued to
+	Username string `json:"username"`
+	// MFARequired is set instead of a token when the user has a second
+	// factor, the login is finished with MFAToken and a code
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
 }
 
-// Product represents the structure for a product item
+// Product represents the structure for a product item. The price is
+// formatted from PriceMinor and Currency when a page is rendered, Price is
+// only shown for products from a productlist without currencies.
 type Product struct {
-	ID    int    `json:"id"`
-	Name  string `json:"name"`
-	Price string `json:"price"`
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Price       string   `json:"price"`
+	PriceMinor  int64    `json:"price_minor"`
+	Currency    string   `json:"currency"`
+	Category    string   `json:"category"`
+	Tags        []string `json:"tags"`
 }
 
 // User represents the structure for a user
@@ -32,14 +55,102 @@ type User struct {
 
 // UserDetails represents the user details fetched from the API
 type UserDetails struct {
-	Name  string `json:"name"`
-	Email string `json:"email"`
-	Age   string    `json:"age"`
+	Name        string    `json:"name"`
+	DisplayName string    `json:"display_name"`
+	Email       string    `json:"email"`
+	Age         int       `json:"age"`
+	BirthDate   string    `json:"birth_date"`
+	Roles       []string  `json:"roles"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// NewUser is the user sent to userinfo on signup
+type NewUser struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name,omitempty"`
+	Email       string `json:"email"`
+	Age         int    `json:"age"`
+}
+
+// productParams are the query parameters of the home and category pages
+// passed on to GET /products of productlist
+var productParams = []string{"q", "min_price", "max_price", "sort", "category", "tag", "cursor"}
+
+// HomePage is the data of the home page, a page of the products matching a
+// search
+type HomePage struct {
+	Products []Product
+	// Total counts the matching products on all pages
+	Total    int
+	Query    string
+	MinPrice string
+	MaxPrice string
+	Sort     string
+	Tag      string
+	// Next and First are the links to the next and the first page, empty
+	// when there is none or the first page is shown
+	Next  string
+	First string
+	Error string
+}
+
+// LoginPage is the data of the login page
+type LoginPage struct {
+	Username string
+	Message  string
+	Error    string
+	// Next is the local page to go to after logging in
+	Next string
+}
+
+// VerifyPage is the data of the email verification page
+type VerifyPage struct {
+	Token   string
+	Message string
+	Error   string
+}
+
+// SignUpPage is the data of the signup page. After a failed signup it holds
+// the submitted values, except the password, and the errors for each field.
+type SignUpPage struct {
+	Username    string
+	DisplayName string
+	Email       string
+	Age         string
+	Errors      validate.Errors
 }
 
 var tmpl *template.Template
 var logFile *os.File
 
+// backend calls the backend services, signing the requests as the webserver
+var backend *http.Client
+
+// The addresses of the backend services, https:// ones when they serve TLS
+var (
+	authURL        = getenv("AUTH_URL", "http://auth:8082")
+	userinfoURL    = getenv("USERINFO_URL", "http://userinfo:8083")
+	productlistURL = getenv("PRODUCTLIST_URL", "http://productlist:8081")
+)
+
+func getenv(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return strings.TrimSuffix(value, "/")
+	}
+	return def
+}
+
+// setCookie sets a cookie that is only sent over HTTPS when the webserver
+// serves it and is not sent along with requests from other sites, except
+// when following links
+func setCookie(w http.ResponseWriter, cookie *http.Cookie) {
+	cookie.Secure = tlsutil.Enabled()
+	cookie.SameSite = http.SameSiteLaxMode
+	http.SetCookie(w, cookie)
+}
+
 func init() {
 	var err error
 
@@ -54,7 +165,20 @@ func init() {
 	log.SetOutput(logFile)
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	tmpl = template.Must(template.ParseGlob("templates/*"))
+	tmpl = template.Must(template.New("").Funcs(templateFuncs).ParseGlob("templates/*"))
+
+	if err := tlsutil.TrustCAFromEnv(); err != nil {
+		log.Fatalf("ERROR: Error loading TLS_CA_FILE - %v\n", err)
+	}
+	services, err := svcauth.FromEnv()
+	if err != nil {
+		log.Fatalf("ERROR: Error setting up service authentication - %v\n", err)
+	}
+	backend = services.Client()
+
+	if err := setupSessions(); err != nil {
+		log.Fatalf("ERROR: Error setting up sessions - %v\n", err)
+	}
 }
 func HealthHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -70,52 +194,91 @@ func HealthHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 	log.Println("Health check requested.")
 }
-// HomeHandler serves the home page with product details
+// HomeHandler serves the home page with product details. The search, sort
+// and page parameters are passed on to productlist, see HomePage.
 func HomeHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("HomeHandler: Fetching product details")
 
-	resp, err := http.Get("http://productlist:8081/products") // Replace with actual API URL
+	var page HomePage
+	status, err := fetchProducts(r.URL.Query(), "/", &page)
 	if err != nil {
 		log.Printf("ERROR: HomeHandler: Error fetching products - %v\n", err)
 		http.Error(w, "Unable to fetch products", http.StatusInternalServerError)
 		return
 	}
+
+	log.Printf("HomeHandler: Successfully fetched %d products\n", len(page.Products))
+	w.WriteHeader(status)
+	render(w, r, "home.html", page)
+}
+
+// fetchProducts gets a page of products from productlist with the search,
+// sort and page parameters in query, and fills in page with links to pagePath
+// for the other pages. A search productlist rejects sets page.Error and
+// returns 400.
+func fetchProducts(query url.Values, pagePath string, page *HomePage) (int, error) {
+	page.Query, page.MinPrice, page.MaxPrice = query.Get("q"), query.Get("min_price"), query.Get("max_price")
+	page.Sort, page.Tag = query.Get("sort"), query.Get("tag")
+	params := url.Values{}
+	for _, name := range productParams {
+		if value := query.Get(name); value != "" {
+			params.Set(name, value)
+		}
+	}
+
+	resp, err := backend.Get(productlistURL + "/products?" + params.Encode())
+	if err != nil {
+		return 0, err
+	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusBadRequest {
+		// A search the products API does not accept, e.g. an invalid price
+		reason, _ := ioutil.ReadAll(resp.Body)
+		log.Printf("fetchProducts: Products API rejected search - %s\n", strings.TrimSpace(string(reason)))
+		page.Error = strings.TrimSpace(string(reason))
+		return http.StatusBadRequest, nil
+	}
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("ERROR: HomeHandler: Unexpected status code %d from products API\n", resp.StatusCode)
-		http.Error(w, "Error fetching products", http.StatusInternalServerError)
-		return
+		return 0, fmt.Errorf("unexpected status code %d from products API", resp.StatusCode)
 	}
 
-	var products []Product
-	if err := json.NewDecoder(resp.Body).Decode(&products); err != nil {
-		log.Printf("ERROR: HomeHandler: Error parsing product data - %v\n", err)
-		http.Error(w, "Error parsing product data", http.StatusInternalServerError)
-		return
+	if err := json.NewDecoder(resp.Body).Decode(&page.Products); err != nil {
+		return 0, fmt.Errorf("parsing product data: %w", err)
+	}
+	page.Total, _ = strconv.Atoi(resp.Header.Get("X-Total-Count"))
+	if cursor := nextCursor(resp.Header.Get("Link")); cursor != "" {
+		params.Set("cursor", cursor)
+		page.Next = pagePath + "?" + params.Encode()
+	}
+	if query.Get("cursor") != "" {
+		params.Del("cursor")
+		page.First = pagePath + "?" + params.Encode()
 	}
+	return http.StatusOK, nil
+}
 
-	log.Printf("HomeHandler: Successfully fetched %d products\n", len(products))
-	tmpl.ExecuteTemplate(w, "home.html", products)
+// nextCursor returns the cursor of the rel="next" link in a Link header of
+// the products API, or "" on the last page
+func nextCursor(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		target, params, ok := strings.Cut(link, ";")
+		if !ok || !strings.Contains(params, `rel="next"`) {
+			continue
+		}
+		next, err := url.Parse(strings.Trim(strings.TrimSpace(target), "<>"))
+		if err != nil {
+			return ""
+		}
+		return next.Query().Get("cursor")
+	}
+	return ""
 }
 
 // LoginHandler serves the login page and handles login form submission
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodPost {
-		http.SetCookie(w, &http.Cookie{
-			Name:     "auth_key",
-			Value:    "",
-			Path:     "/",
-			HttpOnly: true,
-			Expires:  time.Now().Add(-24 * time.Hour), // Set to a past date to delete
-		})
-		http.SetCookie(w, &http.Cookie{
-			Name:     "username",
-			Value:    "",
-			Path:     "/",
-			HttpOnly: true,
-			Expires:  time.Now().Add(-24 * time.Hour), // Set to a past date to delete
-		})
+		endSession(w, r)
 		username := r.FormValue("username")
 		password := r.FormValue("password")
 
@@ -124,17 +287,40 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 
 		log.Printf("LoginHandler: Attempting to log in user %s\n", username)
 
-		resp, err := http.Post("http://auth:8082/auth", "application/json", strings.NewReader(string(userJson)))
+		// Pass on the browser details so the auth service can record them with
+		// the session
+		req, _ := http.NewRequest("POST", authURL+"/auth", strings.NewReader(string(userJson)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", r.UserAgent())
+		req.Header.Set("X-Forwarded-For", clientIP(r))
+
+		next := r.FormValue("next")
+		page := LoginPage{Username: username, Next: next}
+
+		resp, err := backend.Do(req)
 		if err != nil {
 			log.Printf("ERROR: LoginHandler: Error sending login request - %v\n", err)
-			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			page.Error = "Login is not available right now, please try again later"
+			w.WriteHeader(http.StatusServiceUnavailable)
+			render(w, r, "login.html", page)
 			return
 		}
 		defer resp.Body.Close()
 
 		if resp.StatusCode != http.StatusOK {
-			log.Printf("LoginHandler: Invalid credentials for user %s - status code %d\n", username, resp.StatusCode)
-			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			log.Printf("LoginHandler: Login failed for user %s - status code %d\n", username, resp.StatusCode)
+			page.Error = "Invalid username or password"
+			if resp.StatusCode == http.StatusTooManyRequests {
+				page.Error = "Too many failed login attempts. " + retryAfterMessage(resp.Header.Get("Retry-After")) +
+					" If you forgot your password, you can reset it."
+			} else if resp.StatusCode == http.StatusForbidden {
+				// The account exists but cannot log in, e.g. it is not
+				// verified yet; auth explains why
+				reason, _ := ioutil.ReadAll(resp.Body)
+				page.Error = strings.TrimSpace(string(reason))
+			}
+			w.WriteHeader(resp.StatusCode)
+			render(w, r, "login.html", page)
 			return
 		}
 
@@ -147,55 +333,54 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 			log.Fatal("ERROR: Error parsing JSON:", erro)
 		}
 
-		log.Printf("LoginHandler: Successfully authenticated user %s\n", username)
+		if tokenResponse.MFARequired {
+			log.Printf("LoginHandler: Asking user %s for the second factor\n", username)
+			render(w, r, "mfa.html", MFALoginPage{MFAToken: tokenResponse.MFAToken, Next: next})
+			return
+		}
 
-		// Set cookies for auth_key and username
-		http.SetCookie(w, &http.Cookie{
-			Name:     "auth_key",
-			Value:    string(tokenResponse.AuthToken),
-			Path:     "/",
-			HttpOnly: true, // Security enhancement
-			Expires:  time.Now().Add(24 * time.Hour), // Cookie expiration
-		})
-		http.SetCookie(w, &http.Cookie{
-			Name:     "username",
-			Value:    username,
-			Path:     "/",
-			HttpOnly: true, // Security enhancement
-			Expires:  time.Now().Add(24 * time.Hour), // Cookie expiration
-		})
-
-		http.Redirect(w, r, "/userhome", http.StatusSeeOther)
+		if err := startSession(w, username, tokenResponse); err != nil {
+			log.Printf("ERROR: LoginHandler: Error starting session - %v\n", err)
+			http.Error(w, "Error logging in", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("LoginHandler: Successfully authenticated user %s\n", username)
+		http.Redirect(w, r, localRedirect(next), http.StatusSeeOther)
 		return
 	}
 	log.Println("LoginHandler: Serving login page")
-	tmpl.ExecuteTemplate(w, "login.html", nil)
+	page := LoginPage{Next: r.URL.Query().Get("next"), Message: popFlash(w, r)}
+	if r.URL.Query().Get("signup") == "1" {
+		page.Message = "Your account was created. Please open the link in the email we sent you to verify your address, then log in."
+	}
+	render(w, r, "login.html", page)
 }
 
-// UserHomeHandler serves the user home page with user details
-func UserHomeHandler(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("auth_key")
-	if err != nil {
-		log.Println("UserHomeHandler: Auth key cookie not found or expired")
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
-		return
+// localRedirect returns next if it is a page of this site, so a login link
+// cannot send the user elsewhere, or the user home page
+func localRedirect(next string) string {
+	if strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") && !strings.HasPrefix(next, "/\\") {
+		return next
 	}
+	return "/userhome"
+}
 
-	usernameCookie, err := r.Cookie("username")
-	if err != nil {
-		log.Println("UserHomeHandler: Username cookie not found or expired")
+// UserHomeHandler serves the user home page with user details
+func UserHomeHandler(w http.ResponseWriter, r *http.Request) {
+	authKey, username, ok := loginSession(r)
+	if !ok {
+		log.Println("UserHomeHandler: Not logged in or session expired")
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	log.Printf("UserHomeHandler: Fetching details for user %s\n", usernameCookie.Value)
+	log.Printf("UserHomeHandler: Fetching details for user %s\n", username)
 
-	req, _ := http.NewRequest("GET", "http://userinfo:8083/userdetails", nil)
-	req.Header.Set("Authorization", cookie.Value)
-	req.Header.Set("username", usernameCookie.Value)
+	req, _ := http.NewRequest("GET", userinfoURL+"/userdetails", nil)
+	req.Header.Set("Authorization", authKey)
+	req.Header.Set("username", username)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := backend.Do(req)
 	if err != nil {
 		log.Printf("ERROR: UserHomeHandler: Error sending request for user details - %v\n", err)
 		http.Error(w, "Error fetching user details", http.StatusInternalServerError)
@@ -216,41 +401,46 @@ func UserHomeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("UserHomeHandler: Successfully fetched details for user %s\n", usernameCookie.Value)
-	tmpl.ExecuteTemplate(w, "userhome.html", userDetails)
+	log.Printf("UserHomeHandler: Successfully fetched details for user %s\n", username)
+	render(w, r, "userhome.html", userDetails)
 }
 
 func SignUpHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodPost {
-		// Clear existing cookies
-		http.SetCookie(w, &http.Cookie{
-			Name:     "auth_key",
-			Value:    "",
-			Path:     "/",
-			HttpOnly: true,
-			Expires:  time.Now().Add(-24 * time.Hour), // Set to a past date to delete
-		})
-		http.SetCookie(w, &http.Cookie{
-			Name:     "username",
-			Value:    "",
-			Path:     "/",
-			HttpOnly: true,
-			Expires:  time.Now().Add(-24 * time.Hour), // Set to a past date to delete
-		})
+		// Log out whoever was logged in
+		endSession(w, r)
 
 		username := r.FormValue("username")
-		_ = r.FormValue("password")
+		password := r.FormValue("password")
 		email := r.FormValue("email")
 		age := r.FormValue("age")
+		displayName := r.FormValue("display_name")
+
+		page := SignUpPage{Username: username, DisplayName: displayName, Email: email, Age: age}
+
+		// Check the input here too, so the password is never stored for a user
+		// that cannot be added and all problems are shown at once
+		years, ageMsg := validate.ParseAge(age)
+		page.Errors.Add("name", validate.Username(username))
+		page.Errors.Add("display_name", validate.DisplayName(displayName))
+		page.Errors.Add("email", validate.Email(email))
+		page.Errors.Add("age", ageMsg)
+		page.Errors.Add("password", validate.Password(password))
+		if len(page.Errors) > 0 {
+			log.Printf("SignUpHandler: Invalid signup for user %s - %v\n", username, page.Errors)
+			w.WriteHeader(http.StatusBadRequest)
+			render(w, r, "signup.html", page)
+			return
+		}
 
-		//user := User{Username: username, Password: password}
-		userDetails := UserDetails{Name: username, Email: email, Age: age}
+		user := User{Username: username, Password: password}
+		userDetails := NewUser{Name: username, DisplayName: displayName, Email: email, Age: years}
 
 		log.Printf("SignUpHandler: Registering new user %s\n", username)
 
 		// First, send user details to register
 		userJson, _ := json.Marshal(userDetails)
-		resp, err := http.Post("http://userinfo:8083/useradd", "application/json", strings.NewReader(string(userJson)))
+		resp, err := backend.Post(userinfoURL+"/register", "application/json", strings.NewReader(string(userJson)))
 		if err != nil {
 			log.Printf("ERROR: SignUpHandler: Error sending signup request - %v\n", err)
 			http.Error(w, "Error signing up", http.StatusInternalServerError)
@@ -261,11 +451,45 @@ func SignUpHandler(w http.ResponseWriter, r *http.Request) {
 		// Handle different response status codes
 		if resp.StatusCode == http.StatusOK {
 			log.Printf("SignUpHandler: Successfully added user %s\n", username)
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
+
+			// Then store the password with the auth service
+			userJson, _ = json.Marshal(user)
+			credResp, err := backend.Post(authURL+"/credentials", "application/json", strings.NewReader(string(userJson)))
+			if err != nil {
+				log.Printf("ERROR: SignUpHandler: Error sending credentials request - %v\n", err)
+				cancelSignup(username)
+				http.Error(w, "Error signing up", http.StatusInternalServerError)
+				return
+			}
+			defer credResp.Body.Close()
+
+			if credResp.StatusCode != http.StatusOK {
+				log.Printf("ERROR: SignUpHandler: Error storing password for user %s - status code %d\n", username, credResp.StatusCode)
+				cancelSignup(username)
+				http.Error(w, "Error signing up", http.StatusInternalServerError)
+				return
+			}
+
+			log.Printf("SignUpHandler: Stored password for user %s\n", username)
+			http.Redirect(w, r, "/login?signup=1", http.StatusSeeOther)
 		} else if resp.StatusCode == http.StatusConflict {
 			// User already exists
 			log.Printf("ERROR: SignUpHandler: User already exists - %s\n", username)
-			http.Error(w, "User already exists", http.StatusConflict)
+			page.Errors.Add("name", "Username is already taken")
+			w.WriteHeader(http.StatusConflict)
+			render(w, r, "signup.html", page)
+		} else if resp.StatusCode == http.StatusBadRequest {
+			// Show the field errors reported by userinfo with the form
+			var body validate.Response
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || len(body.Errors) == 0 {
+				log.Printf("ERROR: SignUpHandler: Signup for user %s rejected without field errors\n", username)
+				http.Error(w, "Error signing up", http.StatusBadRequest)
+				return
+			}
+			log.Printf("SignUpHandler: Signup for user %s rejected - %v\n", username, body.Errors)
+			page.Errors = body.Errors
+			w.WriteHeader(http.StatusBadRequest)
+			render(w, r, "signup.html", page)
 		} else {
 			log.Printf("ERROR: SignUpHandler: Error response while signing up user %s - status code %d\n", username, resp.StatusCode)
 			http.Error(w, "Error signing up", http.StatusInternalServerError)
@@ -276,19 +500,123 @@ func SignUpHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Println("SignUpHandler: Serving signup page")
 	// Serve the signup page template
-	tmpl.ExecuteTemplate(w, "signup.html", nil)
+	render(w, r, "signup.html", SignUpPage{})
+}
+
+// cancelSignup removes a just registered user whose password could not be
+// stored, so the signup can be retried instead of leaving an account nobody
+// can log in to
+func cancelSignup(username string) {
+	req, err := http.NewRequest(http.MethodDelete, userinfoURL+"/register?name="+url.QueryEscape(username), nil)
+	if err != nil {
+		log.Printf("ERROR: cancelSignup: Error creating request - %v\n", err)
+		return
+	}
+	resp, err := backend.Do(req)
+	if err != nil {
+		log.Printf("ERROR: cancelSignup: Error removing user %s - %v\n", username, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("ERROR: cancelSignup: Error removing user %s - status code %d\n", username, resp.StatusCode)
+		return
+	}
+	log.Printf("cancelSignup: Removed user %s after the failed signup\n", username)
+}
+
+// VerifyHandler confirms a new account's email address. The link in the
+// verification email opens a page that submits the token, so link scanners
+// fetching the page do not use it up.
+func VerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		log.Println("VerifyHandler: Serving verification page")
+		page := VerifyPage{Token: r.URL.Query().Get("token")}
+		if page.Token == "" {
+			page.Error = "The verification link is incomplete, please open the full link from the email."
+		}
+		render(w, r, "verify.html", page)
+		return
+	}
+
+	verifyJson, _ := json.Marshal(map[string]string{"token": r.FormValue("token")})
+	resp, err := backend.Post(userinfoURL+"/verify", "application/json", strings.NewReader(string(verifyJson)))
+	if err != nil {
+		log.Printf("ERROR: VerifyHandler: Error sending verification request - %v\n", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		render(w, r, "verify.html", VerifyPage{Error: "Verification is not available right now, please try again later."})
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		log.Println("VerifyHandler: Email address verified")
+		render(w, r, "verify.html", VerifyPage{Message: "Your email address is verified, you can log in now."})
+	case http.StatusBadRequest:
+		log.Println("VerifyHandler: Invalid or expired verification token")
+		w.WriteHeader(http.StatusBadRequest)
+		render(w, r, "verify.html", VerifyPage{Error: "This verification link is invalid, already used or expired."})
+	default:
+		log.Printf("ERROR: VerifyHandler: Unexpected status code %d from verification API\n", resp.StatusCode)
+		w.WriteHeader(http.StatusInternalServerError)
+		render(w, r, "verify.html", VerifyPage{Error: "Your email address could not be verified, please try again later."})
+	}
+}
+
+// retryAfterMessage tells the user how long to wait, from a Retry-After
+// header in seconds
+func retryAfterMessage(retryAfter string) string {
+	seconds, err := strconv.Atoi(retryAfter)
+	switch {
+	case err != nil || seconds <= 0:
+		return "Please wait a while before trying again."
+	case seconds < 60:
+		return fmt.Sprintf("Please wait %d seconds before trying again.", seconds)
+	case seconds <= 90:
+		return "Please wait a minute before trying again."
+	default:
+		return fmt.Sprintf("Please wait %d minutes before trying again.", (seconds+59)/60)
+	}
+}
+
+// clientIP returns the address of the browser making the request
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// formatPrice formats a product's price for display in its currency
+func formatPrice(product Product) string {
+	if product.Currency == "" {
+		return product.Price
+	}
+	return money.Money{Amount: product.PriceMinor, Currency: product.Currency}.String()
 }
 
 func main() {
 	defer logFile.Close() // Ensure log file is closed when main function exits
+	go runSessionCleanup(time.Minute)
 	http.Handle("/styles.css", http.FileServer(http.Dir(".")))
 	http.HandleFunc("/", HomeHandler)
+	http.HandleFunc("/products", CategoryPageHandler("products"))
+	http.HandleFunc("/services", CategoryPageHandler("services"))
 	http.HandleFunc("/login", LoginHandler)
+	http.HandleFunc("/login/mfa", MFALoginHandler)
+	http.HandleFunc("/logout", LogoutHandler)
+	http.HandleFunc("/security", SecurityHandler)
+	http.HandleFunc("/oauth/authorize", OAuthAuthorizeHandler)
 	http.HandleFunc("/userhome", UserHomeHandler)
 	http.HandleFunc("/signup", SignUpHandler)
+	http.HandleFunc("/verify", VerifyHandler)
+	http.HandleFunc("/forgot", ForgotHandler)
+	http.HandleFunc("/reset", ResetHandler)
 
 	log.Println("Server started at http://webserver:8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	if err := tlsutil.ListenAndServe(":8080", csrfProtect(http.DefaultServeMux), log.Default()); err != nil {
 		log.Fatalf("Server failed to start - %v\n", err)
 	}
 }
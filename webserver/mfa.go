@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"rsc.io/qr"
+)
+
+// MFALoginPage is the data of the second login step, asking for a code. The
+// user is the one the auth service issued MFAToken for.
+type MFALoginPage struct {
+	MFAToken string
+	Error    string
+	Next     string
+}
+
+// SecurityPage is the data of the page setting up two-factor authentication
+type SecurityPage struct {
+	Enabled           bool
+	RecoveryCodesLeft int
+	// Secret, URI and QRCode are set while an authenticator app is added
+	Secret string
+	URI    string
+	QRCode template.URL
+	// RecoveryCodes are only shown right after they were created
+	RecoveryCodes []string
+	Message       string
+	Error         string
+}
+
+// MFAStatus is the second factor state returned by the auth service
+type MFAStatus struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+// MFAEnrollment is a new authenticator secret returned by the auth service
+type MFAEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// RecoveryCodes are the codes returned once by the auth service
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// MFALoginHandler finishes a login with an authenticator or recovery code,
+// after LoginHandler checked the password
+func MFALoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	page := MFALoginPage{MFAToken: r.FormValue("mfa_token"), Next: r.FormValue("next")}
+	verifyJson, _ := json.Marshal(map[string]string{"mfa_token": page.MFAToken, "code": r.FormValue("code")})
+
+	req, _ := http.NewRequest("POST", authURL+"/mfa/verify", strings.NewReader(string(verifyJson)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", r.UserAgent())
+	req.Header.Set("X-Forwarded-For", clientIP(r))
+
+	resp, err := backend.Do(req)
+	if err != nil {
+		log.Printf("ERROR: MFALoginHandler: Error sending code - %v\n", err)
+		page.Error = "Login is not available right now, please try again later"
+		w.WriteHeader(http.StatusServiceUnavailable)
+		render(w, r, "mfa.html", page)
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var tokenResponse TokenResponse
+		if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
+			log.Printf("ERROR: MFALoginHandler: Error parsing token - %v\n", err)
+			http.Error(w, "Error logging in", http.StatusInternalServerError)
+			return
+		}
+		// The session is for the user the challenge was issued to
+		username := tokenResponse.Username
+		if username == "" {
+			log.Println("ERROR: MFALoginHandler: Token response without username")
+			http.Error(w, "Error logging in", http.StatusInternalServerError)
+			return
+		}
+		if err := startSession(w, username, tokenResponse); err != nil {
+			log.Printf("ERROR: MFALoginHandler: Error starting session - %v\n", err)
+			http.Error(w, "Error logging in", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("MFALoginHandler: Successfully authenticated user %s\n", username)
+		http.Redirect(w, r, localRedirect(page.Next), http.StatusSeeOther)
+	case http.StatusBadRequest:
+		// The code was asked for too long ago, start over
+		log.Println("MFALoginHandler: Login expired")
+		w.WriteHeader(http.StatusBadRequest)
+		render(w, r, "login.html", LoginPage{Next: page.Next, Error: "Your login took too long, please log in again"})
+	case http.StatusUnauthorized:
+		log.Println("MFALoginHandler: Invalid code")
+		page.Error = "Invalid code, please try again"
+		w.WriteHeader(http.StatusUnauthorized)
+		render(w, r, "mfa.html", page)
+	case http.StatusTooManyRequests:
+		log.Println("MFALoginHandler: Too many invalid codes")
+		page.Error = "Too many invalid codes. " + retryAfterMessage(resp.Header.Get("Retry-After"))
+		w.WriteHeader(http.StatusTooManyRequests)
+		render(w, r, "mfa.html", page)
+	default:
+		log.Printf("ERROR: MFALoginHandler: Unexpected status code %d from auth API\n", resp.StatusCode)
+		page.Error = "Login is not available right now, please try again later"
+		w.WriteHeader(http.StatusInternalServerError)
+		render(w, r, "mfa.html", page)
+	}
+}
+
+// SecurityHandler shows whether two-factor authentication is enabled and
+// sets it up, turns it off or replaces the recovery codes with the auth
+// service, depending on the submitted action
+func SecurityHandler(w http.ResponseWriter, r *http.Request) {
+	authKey, username, ok := loginSession(r)
+	if !ok {
+		log.Println("SecurityHandler: Not logged in or session expired")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	authRequest := func(method, path string, body interface{}) (*http.Response, error) {
+		return authAPIRequest(r, authKey, username, method, path, body)
+	}
+
+	var err error
+	page := SecurityPage{}
+	if r.Method == http.MethodPost {
+		code := map[string]string{"code": r.FormValue("code")}
+		var resp *http.Response
+		action := r.FormValue("action")
+		switch action {
+		case "enroll":
+			resp, err = authRequest("POST", "/mfa/enroll", nil)
+		case "confirm":
+			resp, err = authRequest("POST", "/mfa/confirm", code)
+		case "recovery-codes":
+			resp, err = authRequest("POST", "/mfa/recovery-codes", code)
+		case "disable":
+			resp, err = authRequest("POST", "/mfa/disable", code)
+		default:
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("ERROR: SecurityHandler: Error sending %s request - %v\n", action, err)
+			http.Error(w, "Error updating two-factor authentication", http.StatusServiceUnavailable)
+			return
+		}
+		defer resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized:
+			log.Printf("SecurityHandler: Auth token of user %s rejected\n", username)
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		case resp.StatusCode != http.StatusOK:
+			reason, _ := ioutil.ReadAll(resp.Body)
+			log.Printf("SecurityHandler: %s for user %s failed - status code %d\n", action, username, resp.StatusCode)
+			page.Error = strings.TrimSpace(string(reason))
+			if resp.StatusCode == http.StatusTooManyRequests {
+				page.Error = "Too many invalid codes. " + retryAfterMessage(resp.Header.Get("Retry-After"))
+			}
+			if action == "confirm" {
+				// Show the same secret again to retry the code
+				page.Secret = r.FormValue("secret")
+				page.URI = r.FormValue("uri")
+				page.QRCode = qrCodeURL(page.URI)
+			}
+		case action == "enroll":
+			var enrollment MFAEnrollment
+			if err := json.NewDecoder(resp.Body).Decode(&enrollment); err != nil {
+				log.Printf("ERROR: SecurityHandler: Error parsing enrollment - %v\n", err)
+				http.Error(w, "Error setting up two-factor authentication", http.StatusInternalServerError)
+				return
+			}
+			page.Secret = enrollment.Secret
+			page.URI = enrollment.URI
+			page.QRCode = qrCodeURL(enrollment.URI)
+		case action == "disable":
+			page.Message = "Two-factor authentication is turned off."
+		default:
+			var codes RecoveryCodes
+			if err := json.NewDecoder(resp.Body).Decode(&codes); err != nil {
+				log.Printf("ERROR: SecurityHandler: Error parsing recovery codes - %v\n", err)
+				http.Error(w, "Error setting up two-factor authentication", http.StatusInternalServerError)
+				return
+			}
+			page.RecoveryCodes = codes.RecoveryCodes
+			page.Message = "Save these recovery codes somewhere safe. Each one logs you in once if you lose your authenticator app, and they are not shown again."
+		}
+		log.Printf("SecurityHandler: %s for user %s done\n", action, username)
+	}
+
+	resp, err := authRequest("GET", "/mfa", nil)
+	if err != nil {
+		log.Printf("ERROR: SecurityHandler: Error fetching two-factor status - %v\n", err)
+		http.Error(w, "Error fetching two-factor status", http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		log.Printf("SecurityHandler: Auth token of user %s rejected\n", username)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	var status MFAStatus
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&status) != nil {
+		log.Printf("ERROR: SecurityHandler: Unexpected status code %d while fetching two-factor status\n", resp.StatusCode)
+		http.Error(w, "Error fetching two-factor status", http.StatusInternalServerError)
+		return
+	}
+	page.Enabled = status.Enabled
+	page.RecoveryCodesLeft = status.RecoveryCodesLeft
+
+	render(w, r, "security.html", page)
+}
+
+// authAPIRequest calls the auth service on behalf of the logged in user
+func authAPIRequest(r *http.Request, authKey, username, method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		bodyJson, _ := json.Marshal(body)
+		reader = strings.NewReader(string(bodyJson))
+	}
+	req, _ := http.NewRequest(method, authURL+path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", authKey)
+	req.Header.Set("username", username)
+	req.Header.Set("X-Forwarded-For", clientIP(r))
+	return backend.Do(req)
+}
+
+// qrCodeURL renders text as a QR code image in a data URL, or returns ""
+// if it does not fit
+func qrCodeURL(text string) template.URL {
+	if text == "" {
+		return ""
+	}
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		log.Printf("ERROR: qrCodeURL: Error encoding QR code - %v\n", err)
+		return ""
+	}
+	code.Scale = 4
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(code.PNG()))
+}
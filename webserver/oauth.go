@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// oauthParams are the parameters of an authorization request passed on to
+// the auth service
+var oauthParams = []string{"client_id", "redirect_uri", "response_type", "scope", "state", "nonce",
+	"code_challenge", "code_challenge_method"}
+
+// scopeDescriptions explain on the consent page what a client gets to see
+var scopeDescriptions = map[string]string{
+	"openid":  "Know who you are, by your username",
+	"profile": "See your name, birth date and when you last changed your details",
+	"email":   "See your email address",
+}
+
+// ConsentPage is the data of the page where the user allows an application
+// to log them in
+type ConsentPage struct {
+	ClientName string
+	Username   string
+	// Permissions describe the requested scopes
+	Permissions []string
+	// Params are the authorization request, sent again with the decision
+	Params map[string]string
+	Error  string
+}
+
+// AuthorizeResponse is the auth service's answer to an authorization request
+type AuthorizeResponse struct {
+	ClientName string   `json:"client_name"`
+	Scopes     []string `json:"scopes"`
+	Redirect   string   `json:"redirect"`
+}
+
+// OAuthError is an error of the auth service's OAuth endpoints
+type OAuthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// OAuthAuthorizeHandler is the OAuth authorization endpoint. Other
+// applications send the browser here to log the user in: after logging in to
+// this site the user is asked whether to allow the application, and the auth
+// service sends them back to it with a code (GET shows the consent page,
+// POST submits the decision).
+func OAuthAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		values = r.PostForm
+	}
+	params := make(map[string]string)
+	request := make(url.Values)
+	for _, name := range oauthParams {
+		if value := values.Get(name); value != "" {
+			params[name] = value
+			request.Set(name, value)
+		}
+	}
+	loginURL := "/login?next=" + url.QueryEscape("/oauth/authorize?"+request.Encode())
+
+	authKey, username, ok := loginSession(r)
+	if !ok {
+		log.Println("OAuthAuthorizeHandler: Not logged in, redirecting to login")
+		http.Redirect(w, r, loginURL, http.StatusSeeOther)
+		return
+	}
+
+	body := make(map[string]string)
+	for name, value := range params {
+		body[name] = value
+	}
+	if r.Method == http.MethodPost {
+		body["decision"] = "deny"
+		if r.FormValue("decision") == "approve" {
+			body["decision"] = "approve"
+		}
+	}
+	resp, err := authAPIRequest(r, authKey, username, "POST", "/oauth/authorize", body)
+	if err != nil {
+		log.Printf("ERROR: OAuthAuthorizeHandler: Error sending authorization request - %v\n", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		render(w, r, "consent.html", ConsentPage{Error: "Logging in to other applications is not available right now, please try again later."})
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var authorize AuthorizeResponse
+		if err := json.NewDecoder(resp.Body).Decode(&authorize); err != nil {
+			log.Printf("ERROR: OAuthAuthorizeHandler: Error parsing authorization response - %v\n", err)
+			http.Error(w, "Error logging in to the application", http.StatusInternalServerError)
+			return
+		}
+		if authorize.Redirect != "" {
+			log.Printf("OAuthAuthorizeHandler: Sending user %s back to client %s\n", username, params["client_id"])
+			http.Redirect(w, r, authorize.Redirect, http.StatusSeeOther)
+			return
+		}
+		page := ConsentPage{ClientName: authorize.ClientName, Username: username, Params: params}
+		for _, scope := range authorize.Scopes {
+			page.Permissions = append(page.Permissions, scopeDescriptions[scope])
+		}
+		log.Printf("OAuthAuthorizeHandler: Asking user %s to allow client %s\n", username, params["client_id"])
+		render(w, r, "consent.html", page)
+	case http.StatusUnauthorized:
+		log.Printf("OAuthAuthorizeHandler: Auth token of user %s rejected, redirecting to login\n", username)
+		http.Redirect(w, r, loginURL, http.StatusSeeOther)
+	case http.StatusBadRequest:
+		// The request names no known client or redirect URI, so it cannot be
+		// sent back
+		var oauthErr OAuthError
+		json.NewDecoder(resp.Body).Decode(&oauthErr)
+		log.Printf("OAuthAuthorizeHandler: Invalid authorization request - %s %s\n", oauthErr.Error, oauthErr.Description)
+		w.WriteHeader(http.StatusBadRequest)
+		render(w, r, "consent.html", ConsentPage{Error: "The application sent an invalid login request: " + oauthErr.Description})
+	default:
+		log.Printf("ERROR: OAuthAuthorizeHandler: Unexpected status code %d from authorization API\n", resp.StatusCode)
+		w.WriteHeader(http.StatusInternalServerError)
+		render(w, r, "consent.html", ConsentPage{Error: "Logging in to the application failed, please try again later."})
+	}
+}
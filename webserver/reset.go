@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"example.com/m/validate"
+)
+
+// ForgotPage is the data of the page asking for a password reset link
+type ForgotPage struct {
+	Login   string
+	Message string
+	Error   string
+}
+
+// ResetPage is the data of the page setting a new password
+type ResetPage struct {
+	Token   string
+	Message string
+	Error   string
+	Errors  validate.Errors
+}
+
+// ForgotHandler serves the forgot password page and asks the auth service to
+// mail a reset link to the account with the given username or email address
+func ForgotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		log.Println("ForgotHandler: Serving forgot password page")
+		render(w, r, "forgot.html", ForgotPage{})
+		return
+	}
+
+	login := strings.TrimSpace(r.FormValue("login"))
+	page := ForgotPage{Login: login}
+	if login == "" {
+		page.Error = "Please enter your username or email address."
+		w.WriteHeader(http.StatusBadRequest)
+		render(w, r, "forgot.html", page)
+		return
+	}
+
+	request := map[string]string{"username": login}
+	if strings.Contains(login, "@") {
+		request = map[string]string{"email": login}
+	}
+	requestJson, _ := json.Marshal(request)
+	resp, err := backend.Post(authURL+"/reset/request", "application/json", strings.NewReader(string(requestJson)))
+	if err != nil {
+		log.Printf("ERROR: ForgotHandler: Error sending reset request - %v\n", err)
+		page.Error = "Password reset is not available right now, please try again later."
+		w.WriteHeader(http.StatusServiceUnavailable)
+		render(w, r, "forgot.html", page)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("ERROR: ForgotHandler: Unexpected status code %d from reset API\n", resp.StatusCode)
+		page.Error = "The reset link could not be sent, please try again later."
+		w.WriteHeader(http.StatusInternalServerError)
+		render(w, r, "forgot.html", page)
+		return
+	}
+
+	// The same answer whether or not the account exists
+	log.Println("ForgotHandler: Reset link requested")
+	render(w, r, "forgot.html", ForgotPage{
+		Message: "If an account matches, we sent a link to choose a new password to its email address. The link expires soon, so please use it right away.",
+	})
+}
+
+// ResetHandler serves the form opened from a reset link and sets the new
+// password with the auth service
+func ResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		log.Println("ResetHandler: Serving reset password page")
+		page := ResetPage{Token: r.URL.Query().Get("token")}
+		if page.Token == "" {
+			page.Error = "The reset link is incomplete, please open the full link from the email."
+		}
+		render(w, r, "reset.html", page)
+		return
+	}
+
+	page := ResetPage{Token: r.FormValue("token")}
+	password := r.FormValue("password")
+	page.Errors.Add("password", validate.Password(password))
+	if password != r.FormValue("confirm_password") {
+		page.Errors.Add("confirm_password", "Passwords do not match")
+	}
+	if len(page.Errors) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		render(w, r, "reset.html", page)
+		return
+	}
+
+	confirmJson, _ := json.Marshal(map[string]string{"token": page.Token, "password": password})
+	resp, err := backend.Post(authURL+"/reset/confirm", "application/json", strings.NewReader(string(confirmJson)))
+	if err != nil {
+		log.Printf("ERROR: ResetHandler: Error sending reset confirmation - %v\n", err)
+		page.Error = "Password reset is not available right now, please try again later."
+		w.WriteHeader(http.StatusServiceUnavailable)
+		render(w, r, "reset.html", page)
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		log.Println("ResetHandler: Password reset")
+		render(w, r, "reset.html", ResetPage{Message: "Your password was changed and all sessions were logged out. You can log in with the new password now."})
+	case http.StatusBadRequest:
+		// Field errors for the password, or an unusable token
+		var body validate.Response
+		if json.NewDecoder(resp.Body).Decode(&body) == nil && len(body.Errors) > 0 {
+			page.Errors = body.Errors
+		} else {
+			log.Println("ResetHandler: Invalid or expired reset token")
+			page = ResetPage{Error: "This reset link is invalid, already used or expired. Please ask for a new one."}
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		render(w, r, "reset.html", page)
+	default:
+		log.Printf("ERROR: ResetHandler: Unexpected status code %d from reset API\n", resp.StatusCode)
+		page.Error = "Your password could not be changed, please try again later."
+		w.WriteHeader(http.StatusInternalServerError)
+		render(w, r, "reset.html", page)
+	}
+}
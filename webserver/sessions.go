@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/m/store"
+)
+
+// sessionCookie names the cookie holding the signed session ID
+const sessionCookie = "session"
+
+// errSessionNotFound is returned by a SessionStore for unknown session IDs
+var errSessionNotFound = errors.New("session not found")
+
+var (
+	// sessions keeps the logged in browsers' sessions
+	sessions SessionStore
+	// sessionSecret signs the session cookies
+	sessionSecret []byte
+	// sessionIdleTimeout ends sessions that were not used for this long
+	sessionIdleTimeout = 30 * time.Minute
+	// sessionMaxAge ends sessions this long after the login, even when they
+	// are in use
+	sessionMaxAge = 12 * time.Hour
+)
+
+// Session is a logged in browser. The browser only gets the session ID in a
+// signed cookie, the username and the auth token stay in the webserver.
+type Session struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	AuthToken string    `json:"auth_token"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	// ExpiresAt is the end of the session by sessionMaxAge, or the expiry of
+	// the auth token if that comes first
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Expired reports whether the session ended by one of the timeouts
+func (s Session) Expired(now time.Time) bool {
+	return !now.Before(s.ExpiresAt) || now.Sub(s.LastSeen) >= sessionIdleTimeout
+}
+
+// SessionStore keeps sessions by ID
+type SessionStore interface {
+	// Get returns the session, or errSessionNotFound
+	Get(id string) (Session, error)
+	Save(session Session) error
+	Delete(id string) error
+	// DeleteUser removes all sessions of a user
+	DeleteUser(username string) error
+	// Prune removes the sessions expired at now
+	Prune(now time.Time) error
+}
+
+// MemorySessionStore keeps sessions in memory, they are lost on restart
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+// NewMemorySessionStore returns an empty store
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]Session)}
+}
+
+func (m *MemorySessionStore) Get(id string) (Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[id]
+	if !ok {
+		return Session{}, errSessionNotFound
+	}
+	return session, nil
+}
+
+func (m *MemorySessionStore) Save(session Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[session.ID] = session
+	return nil
+}
+
+func (m *MemorySessionStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *MemorySessionStore) DeleteUser(username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deleteUserLocked(username)
+	return nil
+}
+
+// deleteUserLocked removes the sessions of a user and reports whether there
+// were any
+func (m *MemorySessionStore) deleteUserLocked(username string) bool {
+	deleted := false
+	for id, session := range m.sessions {
+		if session.Username == username {
+			delete(m.sessions, id)
+			deleted = true
+		}
+	}
+	return deleted
+}
+
+func (m *MemorySessionStore) Prune(now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, session := range m.sessions {
+		if session.Expired(now) {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+// FileSessionStore keeps sessions in memory and in a JSON file, so logins
+// survive a restart of the webserver. The file holds auth tokens and is
+// written with mode 0600.
+type FileSessionStore struct {
+	MemorySessionStore
+	filename string
+}
+
+// NewFileSessionStore loads the sessions file, a missing file has no
+// sessions
+func NewFileSessionStore(filename string) (*FileSessionStore, error) {
+	f := &FileSessionStore{MemorySessionStore: MemorySessionStore{sessions: make(map[string]Session)}, filename: filename}
+	data, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &f.sessions); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (f *FileSessionStore) Save(session Session) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.sessions[session.ID] = session
+	return f.saveLocked()
+}
+
+func (f *FileSessionStore) Delete(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.sessions[id]; !ok {
+		return nil
+	}
+	delete(f.sessions, id)
+	return f.saveLocked()
+}
+
+func (f *FileSessionStore) DeleteUser(username string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.deleteUserLocked(username) {
+		return nil
+	}
+	return f.saveLocked()
+}
+
+func (f *FileSessionStore) Prune(now time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pruned := false
+	for id, session := range f.sessions {
+		if session.Expired(now) {
+			delete(f.sessions, id)
+			pruned = true
+		}
+	}
+	if !pruned {
+		return nil
+	}
+	return f.saveLocked()
+}
+
+func (f *FileSessionStore) saveLocked() error {
+	data, err := json.MarshalIndent(f.sessions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.WriteFileAtomic(f.filename, data, 0600)
+}
+
+// setupSessions configures the session store from SESSION_STORE (memory or
+// file), SESSION_FILE, SESSION_SECRET, SESSION_IDLE_TIMEOUT and
+// SESSION_MAX_AGE
+func setupSessions() error {
+	var err error
+	switch kind := getenv("SESSION_STORE", "memory"); kind {
+	case "memory":
+		sessions = NewMemorySessionStore()
+	case "file":
+		sessions, err = NewFileSessionStore(getenv("SESSION_FILE", "/app/sessions/sessions.json"))
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New("unknown SESSION_STORE " + kind)
+	}
+
+	sessionSecret = []byte(os.Getenv("SESSION_SECRET"))
+	if len(sessionSecret) == 0 {
+		// Cookies signed with a random secret stop working on restart
+		log.Println("SESSION_SECRET is not set, using a random secret")
+		sessionSecret = make([]byte, 32)
+		if _, err := rand.Read(sessionSecret); err != nil {
+			return err
+		}
+	}
+
+	for name, timeout := range map[string]*time.Duration{"SESSION_IDLE_TIMEOUT": &sessionIdleTimeout, "SESSION_MAX_AGE": &sessionMaxAge} {
+		if value := os.Getenv(name); value != "" {
+			if *timeout, err = time.ParseDuration(value); err != nil {
+				return errors.New("invalid " + name + ": " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// runSessionCleanup removes expired sessions periodically until the process
+// exits
+func runSessionCleanup(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := sessions.Prune(time.Now()); err != nil {
+			log.Printf("ERROR: runSessionCleanup: Error pruning sessions - %v\n", err)
+		}
+	}
+}
+
+// signSessionID returns the cookie value for a session ID
+func signSessionID(id string) string {
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// startSession logs the browser in as username with the auth token of
+// tokenResponse. It always starts a new session with a new CSRF secret, so a
+// session ID or CSRF token known before the login is worthless.
+func startSession(w http.ResponseWriter, username string, tokenResponse TokenResponse) error {
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	session := Session{
+		ID:        base64.RawURLEncoding.EncodeToString(id),
+		Username:  username,
+		AuthToken: tokenResponse.AuthToken,
+		CreatedAt: now,
+		LastSeen:  now,
+		ExpiresAt: now.Add(sessionMaxAge),
+	}
+	if tokenResponse.ExpiresAt.Before(session.ExpiresAt) {
+		session.ExpiresAt = tokenResponse.ExpiresAt
+	}
+	if err := sessions.Save(session); err != nil {
+		return err
+	}
+
+	setCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    signSessionID(session.ID),
+		Path:     "/",
+		HttpOnly: true,
+		Expires:  session.ExpiresAt,
+	})
+	newCSRFSecret(w)
+	return nil
+}
+
+// currentSession returns the session of the logged in browser, if its cookie
+// is valid and the session has not expired
+func currentSession(r *http.Request) (Session, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return Session{}, false
+	}
+	id, _, _ := strings.Cut(cookie.Value, ".")
+	if !hmac.Equal([]byte(cookie.Value), []byte(signSessionID(id))) {
+		log.Println("currentSession: Invalid session cookie signature")
+		return Session{}, false
+	}
+	session, err := sessions.Get(id)
+	if err != nil {
+		if err != errSessionNotFound {
+			log.Printf("ERROR: currentSession: Error loading session - %v\n", err)
+		}
+		return Session{}, false
+	}
+
+	now := time.Now()
+	if session.Expired(now) {
+		log.Printf("currentSession: Session of user %s expired\n", session.Username)
+		sessions.Delete(id)
+		return Session{}, false
+	}
+	// Saving on every request would rewrite the file store constantly, the
+	// idle timeout does not need to be that exact
+	if now.Sub(session.LastSeen) >= time.Minute {
+		session.LastSeen = now.UTC()
+		if err := sessions.Save(session); err != nil {
+			log.Printf("ERROR: currentSession: Error saving session - %v\n", err)
+		}
+	}
+	return session, true
+}
+
+// loginSession returns the auth token and username of the logged in user
+func loginSession(r *http.Request) (authKey, username string, ok bool) {
+	session, ok := currentSession(r)
+	return session.AuthToken, session.Username, ok
+}
+
+// endSession removes the browser's session and its cookie, and the
+// auth_key and username cookies set by earlier versions
+func endSession(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		id, _, _ := strings.Cut(cookie.Value, ".")
+		if err := sessions.Delete(id); err != nil {
+			log.Printf("ERROR: endSession: Error deleting session - %v\n", err)
+		}
+	}
+	for _, name := range []string{sessionCookie, "auth_key", "username"} {
+		setCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			Path:     "/",
+			HttpOnly: true,
+			Expires:  time.Now().Add(-24 * time.Hour), // Set to a past date to delete
+		})
+	}
+}